@@ -0,0 +1,71 @@
+package main
+
+import (
+	"consensus-algorithms-with-golang/pbft"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// keygen creates keys from secure randomness: a single key file with
+// `-out`, or the key files of `-n` validators and their genesis file
+// in `-dir`. Validators take the key types of `-type` in turn, so a
+// set can mix schemes.
+func keygen(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	OUT := fs.String("out", "", "Key file to create")
+	N := fs.Int("n", 0, "Number of validator keys to create with a genesis file")
+	DIR := fs.String("dir", ".", "Directory of the validator keys and genesis file")
+	TYPE := fs.String("type", "ed25519", "Comma separated key types: ed25519 or p256")
+	fs.Parse(args)
+
+	schemes := parseSchemes(*TYPE)
+	if *OUT != "" {
+		fmt.Println(chain_util.BytesToHex(newKeyFile(*OUT, schemes[0])))
+		return
+	}
+	if *N <= 0 {
+		log.Fatalln("keygen needs -out or -n")
+	}
+	keys := make([]pbft.PublicKey, *N)
+	for i := range keys {
+		path := filepath.Join(*DIR, "node-"+strconv.Itoa(i)+".key")
+		keys[i] = newKeyFile(path, schemes[i%len(schemes)])
+		fmt.Printf("%s %s\n", path, chain_util.BytesToHex(keys[i]))
+	}
+	genesisPath := filepath.Join(*DIR, "genesis.json")
+	if err := pbft.SaveGenesisFile(genesisPath, *pbft.NewValidatorsFromKeys(keys)); err != nil {
+		log.Fatalf("Create genesis file failed, %v\n", err)
+	}
+	fmt.Println(genesisPath)
+}
+
+// parseSchemes returns the schemes of comma separated key types
+func parseSchemes(types string) []chain_util.Scheme {
+	var schemes []chain_util.Scheme
+	for _, name := range strings.Split(types, ",") {
+		scheme, ok := chain_util.SchemeByName(name)
+		if !ok {
+			log.Fatalf("Unknown key type [%s]\n", name)
+		}
+		schemes = append(schemes, scheme)
+	}
+	return schemes
+}
+
+// newKeyFile creates a random key file of given scheme and returns its
+// public key
+func newKeyFile(path string, scheme chain_util.Scheme) pbft.PublicKey {
+	wallet, err := pbft.NewRandomWallet(scheme)
+	if err != nil {
+		log.Fatalf("Generate key failed, %v\n", err)
+	}
+	if err := pbft.SaveKeyFile(path, *wallet); err != nil {
+		log.Fatalf("Create key file failed, %v\n", err)
+	}
+	return wallet.PublicKey()
+}
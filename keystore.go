@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"consensus-algorithms-with-golang/pbft"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// keystoreCmd manages encrypted keystores of node and client keys:
+//   - create -out FILE [-type TYPE]: creates a keystore of a new random
+//     key, ed25519 or p256
+//   - import -out FILE [-key-file KEY]: encrypts the key of a plain key
+//     file, or of PRIVATE_KEY_ENV
+//   - pubkey -in FILE: prints the public key, without the passphrase
+//   - passwd -in FILE: changes the passphrase
+//
+// The passphrase is read from -passphrase-file, KEYSTORE_PASSPHRASE_ENV
+// or the terminal, a new one from -new-passphrase-file or the terminal
+func keystoreCmd(args []string) {
+	if len(args) == 0 {
+		log.Fatalln("keystore needs a command: create, import, pubkey or passwd")
+	}
+	fs := flag.NewFlagSet("keystore "+args[0], flag.ExitOnError)
+	IN := fs.String("in", "", "Keystore to read")
+	OUT := fs.String("out", "", "Keystore to create")
+	KEY_FILE := fs.String("key-file", "", "Plain key file to import")
+	PASSPHRASE_FILE := fs.String("passphrase-file", "", "File holding the passphrase")
+	NEW_PASSPHRASE_FILE := fs.String("new-passphrase-file", "", "File holding the new passphrase")
+	TYPE := fs.String("type", "ed25519", "Key type of a new key: ed25519 or p256")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "create":
+		wallet, err := pbft.NewRandomWallet(parseSchemes(*TYPE)[0])
+		if err != nil {
+			log.Fatalf("Generate key failed, %v\n", err)
+		}
+		saveKeystore(*OUT, wallet, *PASSPHRASE_FILE)
+	case "import":
+		var wallet *pbft.Wallet
+		var found bool
+		var err error
+		if *KEY_FILE != "" {
+			wallet, err = pbft.LoadKeyFile(*KEY_FILE)
+			found = true
+		} else {
+			wallet, found, err = pbft.LoadWalletFromEnv()
+		}
+		if err != nil || !found {
+			log.Fatalf("No key to import, use -key-file or %s, %v\n", pbft.PRIVATE_KEY_ENV, err)
+		}
+		saveKeystore(*OUT, wallet, *PASSPHRASE_FILE)
+	case "pubkey":
+		ks, err := pbft.LoadKeystore(*IN)
+		if err != nil {
+			log.Fatalf("Load keystore failed, %v\n", err)
+		}
+		fmt.Println(ks.PublicKey)
+	case "passwd":
+		oldPassphrase := readPassphrase(*PASSPHRASE_FILE, pbft.KEYSTORE_PASSPHRASE_ENV, "Passphrase: ", false)
+		newPassphrase := readPassphrase(*NEW_PASSPHRASE_FILE, "", "New passphrase: ", true)
+		if err := pbft.ChangePassphrase(*IN, oldPassphrase, newPassphrase); err != nil {
+			log.Fatalf("Change passphrase failed, %v\n", err)
+		}
+	default:
+		log.Fatalf("Unknown keystore command [%s]\n", args[0])
+	}
+}
+
+// saveKeystore encrypts the wallet's key into a new keystore and prints
+// its public key
+func saveKeystore(path string, wallet *pbft.Wallet, passphraseFile string) {
+	if path == "" {
+		log.Fatalln("keystore needs -out")
+	}
+	passphrase := readPassphrase(passphraseFile, pbft.KEYSTORE_PASSPHRASE_ENV, "New passphrase: ", true)
+	if err := pbft.SaveKeystore(path, *wallet, passphrase); err != nil {
+		log.Fatalf("Create keystore failed, %v\n", err)
+	}
+	ks, err := pbft.LoadKeystore(path)
+	if err != nil {
+		log.Fatalf("Load keystore failed, %v\n", err)
+	}
+	fmt.Println(ks.PublicKey)
+}
+
+// readPassphrase reads a passphrase from the first line of a file, or
+// from an environment variable, or prompts for it on the terminal, a
+// new passphrase is prompted for twice
+func readPassphrase(path string, env string, prompt string, confirm bool) []byte {
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatalf("Read passphrase file failed, %v\n", err)
+		}
+		passphrase, _, _ := bytes.Cut(raw, []byte("\n"))
+		return bytes.TrimSuffix(passphrase, []byte("\r"))
+	}
+	if passphrase, ok := os.LookupEnv(env); env != "" && ok {
+		return []byte(passphrase)
+	}
+	passphrase := promptPassphrase(prompt)
+	if confirm && !bytes.Equal(passphrase, promptPassphrase("Repeat "+prompt)) {
+		log.Fatalln("Passphrases do not match")
+	}
+	return passphrase
+}
+
+// promptPassphrase reads a line from the terminal, with echo turned off
+// if stty is available
+var stdin = bufio.NewReader(os.Stdin)
+
+func promptPassphrase(prompt string) []byte {
+	fmt.Fprint(os.Stderr, prompt)
+	if stty("-echo") {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+	line, err := stdin.ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		log.Fatalf("Read passphrase failed, %v\n", err)
+	}
+	return bytes.TrimRight(line, "\r\n")
+}
+
+// stty sets the terminal mode, it returns false if stdin is no terminal
+func stty(mode string) bool {
+	cmd := exec.Command("stty", mode)
+	cmd.Stdin = os.Stdin
+	return cmd.Run() == nil
+}
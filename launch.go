@@ -2,6 +2,7 @@ package main
 
 import (
 	"consensus-algorithms-with-golang/pbft"
+	"consensus-algorithms-with-golang/pbft/chain_util"
 	"flag"
 	"log"
 	"os"
@@ -11,20 +12,71 @@ import (
 )
 
 func main() {
-	SECRET := flag.String("SECRET", "", "secret key")
+	if len(os.Args) > 1 && os.Args[1] == "keygen" {
+		keygen(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "keystore" {
+		keystoreCmd(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "signer" {
+		signerCmd(os.Args[2:])
+		return
+	}
+
+	SIGNER := flag.String("SIGNER", "", "Unix socket of a remote signer holding the node's key, see signer")
+	KEYSTORE := flag.String("KEYSTORE", "", "Encrypted keystore of the node, see keystore create")
+	PASSPHRASE_FILE := flag.String("PASSPHRASE_FILE", "", "File holding the keystore passphrase, else "+pbft.KEYSTORE_PASSPHRASE_ENV+" or a prompt")
+	KEY_FILE := flag.String("KEY_FILE", "", "Plain key file of the node, see keygen")
+	GENESIS := flag.String("GENESIS", "", "Genesis file listing the validators")
+	SECRET := flag.String("SECRET", "", "Secret to derive the key from, insecure, for demos only, requires -INSECURE_DEMO")
+	INSECURE_DEMO := flag.Bool("INSECURE_DEMO", false, "Allow the publicly derivable demo keys of -SECRET and the NODE-{i} validators")
 	HOST := flag.String("HOST", "localhost", "Hostname")
 	WSPORT := flag.Uint64("WSPORT", 8080, "WebSocket port")
 	PEERS := flag.String("PEERS", "", "Comma separated list of peers")
+	CLIENTS := flag.String("CLIENTS", "", "Comma separated list of hex client public keys, any client is allowed if empty")
+	ELECTION := flag.String("ELECTION", pbft.PROPOSER_ELECTION, "Proposer election: round-robin, weighted, beacon or reputation")
+	MAX_CLOCK_DRIFT := flag.Duration("MAX_CLOCK_DRIFT", pbft.MAX_CLOCK_DRIFT, "Max block timestamp ahead of the local clock")
 	flag.Parse()
 
-	validators := pbft.NewValidators(pbft.NUM_OF_NODES)
+	validators := loadValidators(*GENESIS, *INSECURE_DEMO)
+	var clientKeys []pbft.PublicKey
+	if *CLIENTS != "" {
+		for _, keyHex := range strings.Split(*CLIENTS, ",") {
+			key, err := chain_util.ParsePublicKey(keyHex)
+			if err != nil {
+				log.Fatalf("Invalid client public key [%s], %v\n", keyHex, err)
+			}
+			clientKeys = append(clientKeys, key)
+		}
+	}
+	clients := pbft.NewClients(*CLIENTS == "", clientKeys)
 	blockchain := pbft.NewBlockchain(*validators)
-	wallet := pbft.NewWallet(*SECRET)
+	blockchain.SetMaxClockDrift(*MAX_CLOCK_DRIFT)
+	election, ok := pbft.NewProposerElection(*ELECTION)
+	if !ok {
+		log.Fatalf("Invalid proposer election [%s]\n", *ELECTION)
+	}
+	blockchain.SetElection(election)
+	var wallet *pbft.Wallet
+	if *SIGNER != "" {
+		signer, err := pbft.DialSigner(*SIGNER)
+		if err != nil {
+			log.Fatalf("Connect to signer failed, %v\n", err)
+		}
+		wallet = pbft.NewSignerWallet(signer)
+	} else {
+		wallet = loadWallet(*KEYSTORE, *PASSPHRASE_FILE, *KEY_FILE, *SECRET, *INSECURE_DEMO)
+	}
 	txPool := pbft.NewTxPool()
 	blockPool := pbft.NewBlockPool()
 	preparePool := pbft.NewMsgPool()
 	commitPool := pbft.NewMsgPool()
 	rcPool := pbft.NewMsgPool()
+	replyPool := pbft.NewReplyPool()
+	viewChangePool := pbft.NewViewChangePool()
+	futureBuffer := pbft.NewFutureBuffer()
 
 	var peers []string
 	if *PEERS != "" {
@@ -36,7 +88,7 @@ func main() {
 	node := pbft.NewNode(
 		*HOST,
 		*WSPORT,
-		*validators,
+		*clients,
 		*blockchain,
 		*wallet,
 		*txPool,
@@ -44,6 +96,9 @@ func main() {
 		*preparePool,
 		*commitPool,
 		*rcPool,
+		*replyPool,
+		*viewChangePool,
+		*futureBuffer,
 	)
 	node.Listen(peers)
 
@@ -56,3 +111,57 @@ func main() {
 		conn.Close()
 	}
 }
+
+// loadValidators reads the validators from the genesis file, or falls
+// back to the demo `NODE-{i}` validators if insecure demo keys are
+// allowed
+func loadValidators(genesisPath string, insecureDemo bool) *pbft.Validators {
+	if genesisPath == "" {
+		if !insecureDemo {
+			log.Fatalln("No genesis file, use -GENESIS, or -INSECURE_DEMO for the demo validators")
+		}
+		log.Println("No genesis file, using the INSECURE demo validators")
+		return pbft.NewValidators(pbft.NUM_OF_NODES)
+	}
+	genesis, err := pbft.LoadGenesisFile(genesisPath)
+	if err != nil {
+		log.Fatalf("Load genesis file failed, %v\n", err)
+	}
+	return &genesis.Validators
+}
+
+// loadWallet unlocks the node's key from the keystore, or reads it from
+// the plain key file or the environment, or derives it from the demo
+// secret if insecure demo keys are allowed
+func loadWallet(keystorePath string, passphrasePath string, keyPath string, secret string, insecureDemo bool) *pbft.Wallet {
+	if keystorePath != "" {
+		passphrase := readPassphrase(passphrasePath, pbft.KEYSTORE_PASSPHRASE_ENV, "Passphrase: ", false)
+		wallet, err := pbft.UnlockKeystore(keystorePath, passphrase)
+		if err != nil {
+			log.Fatalf("Unlock keystore failed, %v\n", err)
+		}
+		return wallet
+	}
+	if keyPath != "" {
+		wallet, err := pbft.LoadKeyFile(keyPath)
+		if err != nil {
+			log.Fatalf("Load key file failed, %v\n", err)
+		}
+		return wallet
+	}
+	wallet, found, err := pbft.LoadWalletFromEnv()
+	if err != nil {
+		log.Fatalf("Load key from environment failed, %v\n", err)
+	}
+	if found {
+		return wallet
+	}
+	if secret == "" {
+		log.Fatalf("No key, use -KEYSTORE, -KEY_FILE or %s\n", pbft.PRIVATE_KEY_ENV)
+	}
+	if !insecureDemo {
+		log.Fatalln("Key derived from -SECRET is INSECURE, add -INSECURE_DEMO to use it")
+	}
+	log.Println("Key derived from -SECRET is INSECURE, for demos only")
+	return pbft.NewWallet(secret)
+}
@@ -4,32 +4,71 @@ import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
 	"encoding/json"
 	"log"
-	"strconv"
 	"time"
 )
 
 /**
-A Block stores the pool collected from tx pool, featured with the following methods:
+A Block stores the pool collected from tx pool. It is made of:
+- BlockHeader: the chain id, height, view, timestamp, parent hash,
+  tx root, app hash, hashes of this and the next block's validator
+  sets, last commit hash, random beacon and proposer, all covered by
+  the block hash, plus the proposer's signature over the hash
+- BlockBody: the txs, committed to by the header's tx root, and the
+  last commit, committed to by the header's last commit hash. The last
+  commit is the COMMIT quorum of the block PIPELINE_DEPTH heights
+  below, which is committed at any node accepting the block. Unlike
+  certificates, it is the same at every node, see election.go.
+- Certificate: the votes that committed the block, attached once the
+  block is committed. It is not covered by the hash, since every node
+  may collect a different quorum. The COMMIT votes are kept so a light
+  client can check the block, the PREPARE votes are auxiliary and only
+  kept for the latest VOTE_RETENTION blocks.
+A proposed block, i.e. a PRE-PREPARE message, has no certificate.
+Blocks are featured with the following methods:
 1. NewBlock
 2. Genesis
 3. HashBlock
 4. VerifyBlock
 5. VerifyBlockProposer
+6. TxLeaves
+7. TxRoot
+8. Commits
+9. NextBlockTime
+10. HashCommits
 */
 
+type BlockHeader struct {
+	ChainID            string    `json:"chainId"`
+	Height             uint64    `json:"height"`
+	View               uint64    `json:"view"`
+	Timestamp          int64     `json:"timestamp"` // unix nanoseconds
+	LastHash           []byte    `json:"lastHash"`
+	TxRoot             []byte    `json:"txRoot"`
+	AppHash            []byte    `json:"appHash"`
+	ValidatorsHash     []byte    `json:"validatorsHash"`     // validator set of this block
+	NextValidatorsHash []byte    `json:"nextValidatorsHash"` // validator set of the next block
+	LastCommitHash     []byte    `json:"lastCommitHash"`
+	Beacon             []byte    `json:"beacon"` // see election.go
+	Proposer           PublicKey `json:"proposer"`
+	Hash               []byte    `json:"hash"`      // hash of all the fields above
+	Signature          []byte    `json:"signature"` // proposer's signature over the hash
+}
+
+type BlockBody struct {
+	Data       []Transaction `json:"data"`
+	LastCommit []Message     `json:"lastCommit,omitempty"` // COMMIT quorum of the block PIPELINE_DEPTH heights below
+}
+
+type Certificate struct {
+	PrepareMsgs []Message `json:"prepareMsgs,omitempty"`
+	CommitMsgs  []Message `json:"commitMsgs"`
+}
+
 type Block struct {
-	Timestamp   string        `json:"timestamp"`
-	LastHash    []byte        `json:"lastHash"`
-	Hash        []byte        `json:"hash"`
-	Data        []Transaction `json:"data"`
-	Proposer    PublicKey     `json:"proposer"`
-	Signature   []byte        `json:"signature"`
-	Nonce       uint64        `json:"nonce"`
-	BlockMsgs   []Block       `json:"blockMsgs"`
-	PrepareMsgs []Message     `json:"prepareMsgs"`
-	CommitMsgs  []Message     `json:"commitMsgs"`
-	RCMsgs      []Message     `json:"rcMsgs"`
-	MsgType     string        `json:"msgType"`
+	BlockHeader `json:"header"`
+	BlockBody   `json:"body"`
+	Certificate *Certificate `json:"certificate,omitempty"`
+	MsgType     string       `json:"msgType"`
 }
 
 /**
@@ -43,101 +82,132 @@ It features the following methods:
 */
 
 type BlockPool struct {
-	pool []Block
-}
-
-// NewBlock creates a new block
-func NewBlock(
-	timestamp string,
-	lastHash []byte,
-	hash []byte,
-	data []Transaction,
-	proposer PublicKey,
-	signature []byte,
-	nonce uint64,
-	blockMsgs []Block,
-	prepareMsgs []Message,
-	commitMsgs []Message,
-	rcMsgs []Message,
-) *Block {
+	pool  []Block                // blocks in arrival order
+	index map[chain_util.Key]int // block hash -> position in pool
+}
+
+// NewBlock creates a new block from its header and body
+func NewBlock(header BlockHeader, body BlockBody) *Block {
 	block := &Block{
-		Timestamp:   timestamp,
-		LastHash:    lastHash,
-		Hash:        hash,
-		Data:        data,
-		Proposer:    proposer,
-		Signature:   signature,
-		Nonce:       nonce,
-		BlockMsgs:   blockMsgs,
-		PrepareMsgs: prepareMsgs,
-		CommitMsgs:  commitMsgs,
-		RCMsgs:      rcMsgs,
+		BlockHeader: header,
+		BlockBody:   body,
 		MsgType:     MsgPrePrepare,
 	}
 	return block
 }
 
-// Genesis creates the first block of the chain
+// Genesis creates the first block of the chain, it is the same at
+// every node
 func Genesis() *Block {
-	return NewBlock(
-		time.Now().String(),
-		[]byte("------"),
-		[]byte("------"),
-		nil,
-		[]byte("------"),
-		[]byte("------"),
-		0,
-		nil,
-		nil,
-		nil,
-		nil,
-	)
-}
-
-// HashBlock returns the hash of the block with timestamp, lastBlock's hash,
-// marshalled data and current nonce
-func HashBlock(timestamp string, lastHash []byte, data []Transaction, nonce uint64) []byte {
-	dataInByte, err := json.Marshal(data)
+	return NewBlock(BlockHeader{
+		ChainID:   CHAIN_ID,
+		Height:    0,
+		View:      0,
+		Timestamp: 0,
+		LastHash:  []byte("------"),
+		AppHash:   chain_util.NewSparseMerkleTree().Root(),
+		Beacon:    chain_util.Hash(CHAIN_ID),
+		Proposer:  []byte("------"),
+		Hash:      []byte("------"),
+		Signature: []byte("------"),
+	}, BlockBody{})
+}
+
+// Commits returns the COMMIT votes of a committed block
+func (block *Block) Commits() []Message {
+	if block.Certificate == nil {
+		return nil
+	}
+	return block.Certificate.CommitMsgs
+}
+
+// TxLeaves returns the Merkle leaf hash of each tx, the leaf commits to
+// the whole marshalled tx rather than only its signed event
+func TxLeaves(data []Transaction) [][]byte {
+	leaves := make([][]byte, len(data))
+	for i, tx := range data {
+		txInByte, err := json.Marshal(tx)
+		if err != nil {
+			panic(err)
+		}
+		leaves[i] = chain_util.MerkleLeafHash(txInByte)
+	}
+	return leaves
+}
+
+// TxRoot returns the Merkle root over the given txs
+func TxRoot(data []Transaction) []byte {
+	return chain_util.MerkleRoot(TxLeaves(data))
+}
+
+// NextBlockTime returns the timestamp of a block chaining on a parent
+// with given timestamp: the local time, or just after the parent if
+// the local clock is behind it
+func NextBlockTime(parentTimestamp int64) int64 {
+	return max(time.Now().UnixNano(), parentTimestamp+1)
+}
+
+// HashCommits returns the hash of a block's last commit
+func HashCommits(msgs []Message) []byte {
+	msgsInByte, err := json.Marshal(msgs)
+	if err != nil {
+		panic(err)
+	}
+	return chain_util.Hash(string(msgsInByte))
+}
+
+// HashBlock returns the hash of a block header, it covers every
+// header field but the hash itself and the proposer's signature
+func HashBlock(header BlockHeader) []byte {
+	header.Hash = nil
+	header.Signature = nil
+	headerInByte, err := json.Marshal(header)
 	if err != nil {
 		panic(err)
 	}
-	return chain_util.Hash(
-		timestamp + chain_util.BytesToHex(lastHash) + string(dataInByte) + strconv.FormatUint(nonce, 10),
-	)
+	return chain_util.Hash(string(headerInByte))
 }
 
-// VerifyBlock verifies the block information and its signature
+// VerifyBlock verifies the block information, its signature and the
+// signature of every tx in it, the signatures are checked concurrently
 func VerifyBlock(block Block) bool {
-	hash := HashBlock(block.Timestamp, block.LastHash, block.Data, block.Nonce)
-	if chain_util.BytesToHex(hash) != chain_util.BytesToHex(block.Hash) {
+	txRoot := TxRoot(block.Data)
+	if !chain_util.Equal(txRoot, block.TxRoot) ||
+		!chain_util.Equal(HashCommits(block.LastCommit), block.LastCommitHash) {
 		return false
 	}
-	return chain_util.Verify(
-		block.Proposer,
-		block.Hash,
-		block.Signature,
-	)
+	if !chain_util.Equal(HashBlock(block.BlockHeader), block.Hash) {
+		return false
+	}
+	checks := make([]chain_util.SigCheck, 0, len(block.Data)+1)
+	checks = append(checks, chain_util.SigCheck{PublicKey: block.Proposer, Hash: block.Hash, Signature: block.Signature})
+	for _, tx := range block.Data {
+		if !tx.validTxHash() {
+			return false
+		}
+		checks = append(checks, chain_util.SigCheck{PublicKey: tx.From, Hash: tx.Hash, Signature: tx.Signature})
+	}
+	return sigVerifier.VerifyBatch(checks)
 }
 
 // VerifyBlockProposer verifies the block's proposer matches the proposer
 func VerifyBlockProposer(block Block, proposer PublicKey) bool {
-	return chain_util.BytesToHex(block.Proposer) == chain_util.BytesToHex(proposer)
+	return chain_util.Equal(block.Proposer, proposer)
 }
 
 // NewBlockPool creates a new block pool
 func NewBlockPool() *BlockPool {
-	return &BlockPool{pool: make([]Block, 0)}
+	return &BlockPool{pool: make([]Block, 0), index: make(map[chain_util.Key]int)}
 }
 
 // BlockExists checks if a given block exists in the pool
-// by comparing its hash
+// by looking up its hash
 func (bp *BlockPool) BlockExists(hash []byte) (bool, int) {
-	for idx, b := range bp.pool {
-		if chain_util.BytesToHex(b.Hash) == chain_util.BytesToHex(hash) {
-			return true, idx
-		}
+	idx, ok := bp.index[chain_util.KeyOf(hash)]
+	if !ok {
+		return false, -1
 	}
-	return false, -1
+	return true, idx
 }
 
 // AddBlock2Pool adds a block to the block pool
@@ -147,6 +217,7 @@ func (bp *BlockPool) AddBlock2Pool(block Block) bool {
 		return false
 	}
 
+	bp.index[chain_util.KeyOf(block.Hash)] = len(bp.pool)
 	bp.pool = append(bp.pool, block)
 	log.Printf("Added block [%s] to pool\n", chain_util.BytesToHex(block.Hash)[:6])
 	return true
@@ -154,13 +225,12 @@ func (bp *BlockPool) AddBlock2Pool(block Block) bool {
 
 // GetBlock get a copy of the block from the pool with given hash
 func (bp *BlockPool) GetBlock(hash []byte) *Block {
-	for _, b := range bp.pool {
-		if chain_util.BytesToHex(b.Hash) == chain_util.BytesToHex(hash) {
-			blockCopy := b
-			return &blockCopy
-		}
+	exists, idx := bp.BlockExists(hash)
+	if !exists {
+		return nil
 	}
-	return nil
+	blockCopy := bp.pool[idx]
+	return &blockCopy
 }
 
 // CleanPool removes the block from the pool by matching block hash
@@ -168,6 +238,11 @@ func (bp *BlockPool) CleanPool(hash []byte) bool {
 	exists, idx := bp.BlockExists(hash)
 	if exists {
 		bp.pool = append(bp.pool[:idx], bp.pool[idx+1:]...)
+		delete(bp.index, chain_util.KeyOf(hash))
+		// blocks after the removed one moved up
+		for i := idx; i < len(bp.pool); i++ {
+			bp.index[chain_util.KeyOf(bp.pool[i].Hash)] = i
+		}
 		return true
 	} else {
 		return false
@@ -177,4 +252,5 @@ func (bp *BlockPool) CleanPool(hash []byte) bool {
 // Clear clears contents of block pool
 func (bp *BlockPool) Clear() {
 	bp.pool = bp.pool[:0]
+	bp.index = make(map[chain_util.Key]int)
 }
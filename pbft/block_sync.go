@@ -0,0 +1,162 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"github.com/gorilla/websocket"
+	"log"
+	"time"
+)
+
+/**
+Missing-block retrieval. A replica that never received a PRE-PREPARE
+still learns about the block from the PREPAREs buffered for it. Once
+validators holding more than 1/3 of the power prepared the block, at
+least one honest validator holds it, so the replica broadcasts a signed BLOCK-REQUEST for the hash and
+any validator holding the block answers with a BLOCK-RESPONSE on the
+connection the request arrived on.
+A response is only accepted for a hash this node asked for, and the
+block goes through the same checks as a PRE-PREPARE (hash, proposer
+signature, expected proposer, last hash) before it enters the block
+pool. The replica then prepares it and replays the buffered votes.
+It features the following methods:
+1. NewBlockRequests
+2. Request
+3. Pending
+4. Done
+5. requestBlock
+6. respondBlock
+7. acceptFetchedBlock
+8. prepareBlock
+*/
+
+// BlockResponse carries a proposed block back to a requesting replica,
+// the block is authenticated by its proposer's signature
+type BlockResponse struct {
+	MsgType string `json:"msgType"`
+	Block   Block  `json:"block"`
+}
+
+// BlockRequests tracks the block hashes this node asked peers for
+type BlockRequests struct {
+	pending map[chain_util.Key]time.Time // block hash -> when to ask again
+	timeout time.Duration
+}
+
+// NewBlockRequests creates a block request tracker, a request is sent
+// again if no valid response arrives within the timeout
+func NewBlockRequests(timeout time.Duration) *BlockRequests {
+	return &BlockRequests{
+		pending: make(map[chain_util.Key]time.Time),
+		timeout: timeout,
+	}
+}
+
+// Request marks a block hash as requested, it returns false if a
+// request for it is still in flight
+func (br *BlockRequests) Request(hash []byte, now time.Time) bool {
+	hashKey := chain_util.KeyOf(hash)
+	if retryAt, ok := br.pending[hashKey]; ok && now.Before(retryAt) {
+		return false
+	}
+	br.pending[hashKey] = now.Add(br.timeout)
+	return true
+}
+
+// Pending checks if a block hash was requested and not received yet
+func (br *BlockRequests) Pending(hash []byte) bool {
+	_, ok := br.pending[chain_util.KeyOf(hash)]
+	return ok
+}
+
+// Done removes a block hash once its block is received
+func (br *BlockRequests) Done(hash []byte) {
+	delete(br.pending, chain_util.KeyOf(hash))
+}
+
+// Clear clears all pending requests
+func (br *BlockRequests) Clear() {
+	br.pending = make(map[chain_util.Key]time.Time)
+}
+
+// requestBlock broadcasts a signed request for a missing block
+func (node *Node) requestBlock(hash []byte, height uint64, view uint64) {
+	log.Printf("Requesting missing block [%s] from peers\n", chain_util.BytesToHex(hash)[:6])
+	request := node.Wallet.CreateMsg(MsgBlockRequest, hash, height, view)
+	if request == nil {
+		return
+	}
+	newMsg, err := json.Marshal(request)
+	if err != nil {
+		log.Printf("Marshal blockRequest failed, %s, msg won't be sent, skip this one!\n", err)
+		return
+	}
+	node.broadcast(string(newMsg))
+}
+
+// respondBlock answers a block request if the block is in the pool,
+// the response goes back on the connection the request came from only
+func (node *Node) respondBlock(request Message, origin *websocket.Conn) {
+	if origin == nil {
+		return
+	}
+	mutex.Lock()
+	block := node.BlockPool.GetBlock(request.BlockHash)
+	mutex.Unlock()
+	if block == nil {
+		return
+	}
+	newMsg, err := json.Marshal(BlockResponse{MsgType: MsgBlockResponse, Block: *block})
+	if err != nil {
+		log.Printf("Marshal blockResponse failed, %s, msg won't be sent, skip this one!\n", err)
+		return
+	}
+	mutex.Lock()
+	err = origin.WriteMessage(websocket.TextMessage, newMsg)
+	mutex.Unlock()
+	if err != nil {
+		log.Printf("Error sending blockResponse to [%s], %v\n", origin.RemoteAddr(), err)
+	}
+}
+
+// acceptFetchedBlock verifies a requested block and adds it to the
+// block pool, it returns false if the block was not requested or is
+// not valid
+func (node *Node) acceptFetchedBlock(block Block) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if !node.BlockRequests.Pending(block.Hash) {
+		return false
+	}
+	if exists, _ := node.BlockPool.BlockExists(block.Hash); exists {
+		node.BlockRequests.Done(block.Hash)
+		return false
+	}
+	if !node.Blockchain.VerifyBlock(block) {
+		log.Printf("Fetched block [%s] is invalid, skip this one!\n", chain_util.BytesToHex(block.Hash)[:6])
+		return false
+	}
+	node.BlockRequests.Done(block.Hash)
+	return node.BlockPool.AddBlock2Pool(block) && node.Blockchain.AddInflight(block)
+}
+
+// prepareBlock broadcasts this node's PREPARE for a block that just
+// entered the block pool, then replays the votes buffered for it
+func (node *Node) prepareBlock(block Block) {
+	mutex.Lock()
+	height, _ := node.Blockchain.InflightHeight(block.Hash)
+	view := node.Blockchain.View()
+	mutex.Unlock()
+	prepareMsg := node.Wallet.CreateMsg(MsgPrepare, block.Hash, height, view)
+	if prepareMsg == nil {
+		return
+	}
+	newMsg, err := json.Marshal(prepareMsg)
+	if err != nil {
+		log.Printf("Marshal prepareMsg failed, %s, msg won't be sent, skip this one!\n", err)
+		return
+	}
+	node.broadcast(string(newMsg))
+	// votes that arrived before the block can be counted now
+	go node.replayFuture()
+}
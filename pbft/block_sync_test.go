@@ -0,0 +1,83 @@
+package pbft
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBlockRequests(t *testing.T) {
+	br := NewBlockRequests(time.Second)
+	hash := []byte("block")
+	now := time.Now()
+	if !br.Request(hash, now) || !br.Pending(hash) {
+		t.Errorf("Request should mark the block as pending")
+	}
+	if br.Request(hash, now.Add(time.Second/2)) {
+		t.Errorf("Request should not ask again while in flight")
+	}
+	if !br.Request(hash, now.Add(2*time.Second)) {
+		t.Errorf("Request should ask again after the timeout")
+	}
+	br.Done(hash)
+	if br.Pending(hash) {
+		t.Errorf("Done should clear the pending request")
+	}
+}
+
+func TestNode_AcceptFetchedBlock(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	node := &Node{Blockchain: *bc, BlockPool: *NewBlockPool(), BlockRequests: NewBlockRequests(time.Second)}
+	proposer, sender := proposerWallet(bc), NewWallet("sender")
+	newBlock := func(w Wallet, data string) *Block {
+		header, body, _ := bc.NextBlock([]Transaction{*sender.CreateTx(data)})
+		return w.CreateBlock(header, body)
+	}
+	requested := newBlock(proposer, "key=requested")
+	node.BlockRequests.Request(requested.Hash, time.Now())
+
+	if node.acceptFetchedBlock(*newBlock(proposer, "key=other")) {
+		t.Errorf("acceptFetchedBlock should reject a block nobody asked for")
+	}
+	tampered := *requested
+	tampered.Data = newBlock(proposer, "key=other").Data
+	if node.acceptFetchedBlock(tampered) {
+		t.Errorf("acceptFetchedBlock should reject a block that does not hash to the requested hash")
+	}
+	// well hashed and signed, but not by the elected proposer
+	forged := newBlock(*NewWallet("outsider"), "key=forged")
+	node.BlockRequests.Request(forged.Hash, time.Now())
+	if node.acceptFetchedBlock(*forged) {
+		t.Errorf("acceptFetchedBlock should reject a block failing VerifyBlock")
+	}
+	if !node.BlockRequests.Pending(requested.Hash) {
+		t.Errorf("rejected blocks should keep the request pending")
+	}
+	if !node.acceptFetchedBlock(*requested) || node.BlockRequests.Pending(requested.Hash) {
+		t.Errorf("acceptFetchedBlock should accept the requested block")
+	}
+	if exists, _ := node.BlockPool.BlockExists(requested.Hash); !exists {
+		t.Errorf("acceptFetchedBlock should add the block to the pool")
+	}
+}
+
+func TestFutureBuffer_Voters(t *testing.T) {
+	fb := NewFutureBuffer()
+	hash := []byte("block")
+	for _, secret := range []string{"NODE-0", "NODE-1"} {
+		fb.AddMsg2Buffer(nil, *NewWallet(secret).CreateMsg(MsgPrepare, hash, 1, 0))
+	}
+	fb.AddMsg2Buffer(nil, *NewWallet("NODE-2").CreateMsg(MsgPrepare, []byte("other"), 1, 0))
+	fb.AddMsg2Buffer(nil, *NewWallet("NODE-2").CreateMsg(MsgCommit, hash, 1, 0))
+	if voters := fb.Voters(*NewWallet("NODE-0").CreateMsg(MsgPrepare, hash, 1, 0)); len(voters) != 2 {
+		t.Errorf("Voters should return the 2 prepare senders, got %d", len(voters))
+	}
+}
+
+func TestIsBlockRequest(t *testing.T) {
+	if !isBlockRequest([]byte(`{"msgType":"` + MsgBlockRequest + `"}`)) {
+		t.Errorf("isBlockRequest should detect a block request")
+	}
+	if isBlockRequest([]byte(`{"msgType":"`+MsgBlockResponse+`"}`)) || isBlockRequest([]byte("garbage")) {
+		t.Errorf("isBlockRequest should only detect block requests")
+	}
+}
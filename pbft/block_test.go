@@ -2,8 +2,6 @@ package pbft
 
 import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
-	"encoding/json"
-	"strconv"
 	"testing"
 	"time"
 )
@@ -16,29 +14,140 @@ func TestGenesis(t *testing.T) {
 		genesis.Data != nil ||
 		chain_util.BytesToHex(genesis.Proposer) != dHex ||
 		chain_util.BytesToHex(genesis.Signature) != dHex ||
-		genesis.Nonce != 0 ||
-		genesis.BlockMsgs != nil ||
-		genesis.PrepareMsgs != nil ||
-		genesis.CommitMsgs != nil ||
-		genesis.RCMsgs != nil {
+		genesis.Height != 0 ||
+		genesis.ChainID != CHAIN_ID ||
+		genesis.Certificate != nil {
 		t.Error("genesis block fail")
 	}
 }
 
 func TestHashBlock(t *testing.T) {
-	timestamp := time.Now().String()
-	lastHash := []byte("-")
-	var data []Transaction
-	data = nil
-	dataInByte, err := json.Marshal(data)
-	if err != nil {
-		t.Error(err)
-	}
-	nonce := uint64(0)
-	hash := chain_util.Hash(
-		timestamp + chain_util.BytesToHex(lastHash) + string(dataInByte) + strconv.FormatUint(nonce, 10),
-	)
-	if chain_util.BytesToHex(hash) != chain_util.BytesToHex(HashBlock(timestamp, lastHash, data, nonce)) {
-		t.Error("HashBlock fail")
+	header := BlockHeader{
+		ChainID:   CHAIN_ID,
+		Height:    1,
+		Timestamp: time.Now().UnixNano(),
+		LastHash:  []byte("-"),
+		TxRoot:    TxRoot(nil),
+		AppHash:   NewStateStore().AppHash(),
+	}
+	hash := HashBlock(header)
+	signed := header
+	signed.Hash, signed.Signature = hash, []byte("signature")
+	if !chain_util.Equal(hash, HashBlock(signed)) {
+		t.Error("HashBlock should not cover the hash and the signature")
+	}
+	for _, forge := range []func(h *BlockHeader){
+		func(h *BlockHeader) { h.ChainID = "other" },
+		func(h *BlockHeader) { h.Height++ },
+		func(h *BlockHeader) { h.View++ },
+		func(h *BlockHeader) { h.ValidatorsHash = []byte("other") },
+		func(h *BlockHeader) { h.Proposer = []byte("other") },
+	} {
+		forged := header
+		forge(&forged)
+		if chain_util.Equal(hash, HashBlock(forged)) {
+			t.Errorf("HashBlock should cover every header field, %+v", forged)
+		}
+	}
+}
+
+func TestNextBlockTime(t *testing.T) {
+	now := time.Now().UnixNano()
+	if next := NextBlockTime(0); next < now {
+		t.Errorf("NextBlockTime should follow the local clock, got %d", next)
+	}
+	ahead := now + int64(time.Hour)
+	if next := NextBlockTime(ahead); next != ahead+1 {
+		t.Errorf("NextBlockTime should stay above a parent ahead of the clock, got %d", next)
+	}
+}
+
+func TestBlockchain_VerifyHeader(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	parent := Genesis().BlockHeader
+	header := BlockHeader{
+		ChainID:            CHAIN_ID,
+		Height:             1,
+		Timestamp:          time.Now().UnixNano(),
+		ValidatorsHash:     bc.epochAt(1).hash,
+		NextValidatorsHash: bc.epochAt(2).hash,
+	}
+	if !bc.verifyHeader(header, parent) {
+		t.Fatal("verifyHeader should accept the next header")
+	}
+	for name, forge := range map[string]func(h *BlockHeader){
+		"chain id":   func(h *BlockHeader) { h.ChainID = "other" },
+		"height":     func(h *BlockHeader) { h.Height = 2 },
+		"view":       func(h *BlockHeader) { h.View = 1 },
+		"validators": func(h *BlockHeader) { h.ValidatorsHash = []byte("other") },
+		"past":       func(h *BlockHeader) { h.Timestamp = parent.Timestamp },
+		"future":     func(h *BlockHeader) { h.Timestamp = time.Now().Add(2 * bc.maxDrift).UnixNano() },
+	} {
+		forged := header
+		forge(&forged)
+		if bc.verifyHeader(forged, parent) {
+			t.Errorf("verifyHeader should reject a header with a bad %s", name)
+		}
+	}
+}
+
+func TestVerifyTxProof(t *testing.T) {
+	w := NewWallet("test")
+	data := []Transaction{*w.CreateTx("a"), *w.CreateTx("b"), *w.CreateTx("c")}
+	block := w.CreateBlock(BlockHeader{Height: 1, LastHash: Genesis().Hash, AppHash: NewStateStore().Simulate(BlockEnv{Height: 1}, data)}, BlockBody{Data: data})
+	if !VerifyBlock(*block) {
+		t.Fatal("VerifyBlock fail")
+	}
+	for _, tx := range data {
+		proof := NewTxProof(*block, tx.Hash)
+		if proof == nil || !VerifyTxProof(*proof, block.Hash) {
+			t.Errorf("VerifyTxProof fail for tx [%s]", tx.Id)
+		}
+	}
+	proof := NewTxProof(*block, data[0].Hash)
+	proof.Tx.Event.Data = "forged"
+	if VerifyTxProof(*proof, block.Hash) {
+		t.Error("VerifyTxProof should fail for a forged tx")
+	}
+	if NewTxProof(*block, []byte("missing")) != nil {
+		t.Error("NewTxProof should return nil for a missing tx")
+	}
+}
+
+func TestVerifyBlock_TxSignatures(t *testing.T) {
+	w := NewWallet("test")
+	other := NewWallet("other")
+	forged := *w.CreateTx("a")
+	forged.Signature = other.Sign(SignRequest{Type: MsgTx, From: forged.From, Event: &forged.Event, Nonce: forged.Nonce, Priority: forged.Priority})
+	data := []Transaction{*w.CreateTx("b"), forged}
+	block := w.CreateBlock(BlockHeader{Height: 1, LastHash: Genesis().Hash, AppHash: NewStateStore().Simulate(BlockEnv{Height: 1}, data)}, BlockBody{Data: data})
+	if VerifyBlock(*block) {
+		t.Error("VerifyBlock should fail for a block holding a forged tx signature")
+	}
+}
+
+func TestBlockchain_CertificateRetention(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	bc.retention = 2
+	for range 4 {
+		w := proposerWallet(bc)
+		block := bc.CreateBlock(w, nil)
+		blockPool, preparePool, commitPool := NewBlockPool(), NewMsgPool(), NewMsgPool()
+		blockPool.AddBlock2Pool(*block)
+		preparePool.AddMsg2Pool(*w.CreateMsg(MsgPrepare, block.Hash, bc.Height()+1, 0))
+		commitPool.AddMsg2Pool(*w.CreateMsg(MsgCommit, block.Hash, bc.Height()+1, 0))
+		if _, ok := bc.AddUpdatedBlock2Chain(block.Hash, *blockPool, *preparePool, *commitPool); !ok {
+			t.Fatal("AddUpdatedBlock2Chain failed")
+		}
+	}
+	for height := uint64(1); height <= 4; height++ {
+		block, _ := bc.GetBlock(height)
+		if block.Certificate == nil || len(block.Commits()) != 1 {
+			t.Fatalf("block %d should keep its COMMIT votes", height)
+		}
+		retained := height > bc.Height()-bc.retention
+		if retained != (len(block.Certificate.PrepareMsgs) == 1) {
+			t.Errorf("block %d should keep its PREPARE votes: %v", height, retained)
+		}
 	}
 }
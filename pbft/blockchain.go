@@ -3,6 +3,7 @@ package pbft
 import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
 	"log"
+	"time"
 )
 
 /**
@@ -13,74 +14,211 @@ However, block hashes are the same since they depend on the data
 contained in the block.
 Blockchain features the following methods:
 1. NewBlockchain
-2. CreateBlock
+2. CreateBlock / NextBlock / AddProposal
 3. AddUpdatedBlock2Chain
 4. GetProposer
 5. VerifyBlock
+6. FindTx
+7. QueryState
+8. GetBlock
+9. View / SetView
+10. SetMaxClockDrift
+11. SetElection
+
+The current view rotates the proposer when the primary is replaced by
+a view change, see viewchange.go. Blocks accepted but not committed
+yet are kept in flight, see pipeline.go. The validator set changes
+per epoch through governance txs, see governance.go.
 */
 
 type Blockchain struct {
-	validators []PublicKey
-	chain      []Block
+	chainID     string
+	epochs      []*epoch // validator sets by starting height
+	epochLength uint64   // heights per epoch
+	election    ProposerElection
+	chain       []Block
+	state       *StateStore
+	view        uint64
+	justified   uint64                            // latest view whose NEW-VIEW was applied
+	carried     uint64                            // height of the last block carried into the view
+	depth       uint64                            // pipeline depth
+	retention   uint64                            // blocks keeping their PREPARE votes
+	maxDrift    time.Duration                     // max block time ahead of the local clock
+	inflight    map[chain_util.Key]*inflightBlock // block hash -> block in flight
 }
 
 // NewBlockchain creates a new blockchain
 func NewBlockchain(vs Validators) *Blockchain {
-	validators := vs.list
+	election, _ := NewProposerElection(PROPOSER_ELECTION)
 	chain := make([]Block, 0, 1)
 	chain = append(chain, *Genesis())
 	return &Blockchain{
-		validators: validators,
-		chain:      chain,
+		chainID:     CHAIN_ID,
+		epochs:      []*epoch{{start: 0, validators: vs, hash: vs.Hash()}},
+		epochLength: EPOCH_LENGTH,
+		election:    election,
+		chain:       chain,
+		state:       NewStateStore(),
+		depth:       PIPELINE_DEPTH,
+		retention:   VOTE_RETENTION,
+		maxDrift:    MAX_CLOCK_DRIFT,
+		inflight:    make(map[chain_util.Key]*inflightBlock),
 	}
 }
 
 // CreateBlock creates a new block with given wallet and collected
-// txs. It calls wallet's `CreateBlock` method.
+// txs, chained on the head of the pipeline. It gets the block's
+// content from `NextBlock`, calls wallet's `CreateBlock` method and
+// keeps the block in flight with `AddProposal`. It returns nil if the
+// wallet's signer refused to sign the block.
 func (bc *Blockchain) CreateBlock(wallet Wallet, txs []Transaction) *Block {
-	return wallet.CreateBlock(bc.chain[len(bc.chain)-1], txs)
+	header, body, state := bc.NextBlock(txs)
+	block := wallet.CreateBlock(header, body)
+	if block == nil || !bc.AddProposal(*block, state) {
+		return nil
+	}
+	return block
+}
+
+// NextBlock returns the unsigned header and body of a new block with
+// given txs, chained on the head of the pipeline, and the state after
+// executing the txs on a copy of the head's state. A node snapshots it
+// under the mutex and signs it without holding the mutex.
+func (bc *Blockchain) NextBlock(txs []Transaction) (BlockHeader, BlockBody, *chain_util.SparseMerkleTree) {
+	lastBlock, height, state := bc.head()
+	lastCommit := bc.lastCommit(height + 1)
+	state = SimulateOn(state, bc.envAt(height+1), txs)
+	return BlockHeader{
+		ChainID:            bc.chainID,
+		Height:             height + 1,
+		View:               bc.view,
+		Timestamp:          NextBlockTime(lastBlock.Timestamp),
+		LastHash:           lastBlock.Hash,
+		AppHash:            state.Root(),
+		ValidatorsHash:     bc.epochAt(height + 1).hash,
+		NextValidatorsHash: bc.epochAt(height + 2).hash,
+		Beacon:             BeaconFrom(lastBlock.Beacon, lastCommit),
+	}, BlockBody{Data: txs, LastCommit: lastCommit}, state
+}
+
+// AddProposal keeps a block signed from `NextBlock` in flight with
+// the given state. It returns false if the pipeline moved on while the
+// block was signed, i.e. the head, its height or the view changed.
+func (bc *Blockchain) AddProposal(block Block, state *chain_util.SparseMerkleTree) bool {
+	lastBlock, height, _ := bc.head()
+	if block.Height != height+1 || block.View != bc.view || !chain_util.Equal(block.LastHash, lastBlock.Hash) {
+		log.Printf("Proposal [%s] is stale, skip this one!\n", chain_util.BytesToHex(block.Hash)[:6])
+		return false
+	}
+	bc.inflight[chain_util.KeyOf(block.Hash)] = &inflightBlock{
+		block:  block,
+		height: height + 1,
+		state:  state,
+	}
+	return true
 }
 
 // AddUpdatedBlock2Chain first get a copy of block with given hash,
-// then add the PRE-PREPARE pool, PREPARE pool, COMMIT pool to update
-// the block. Finally, it adds the updated block to the chain.
+// then attaches the block's PREPARE and COMMIT votes as its
+// certificate. Finally, it adds the updated block to the chain and
+// executes its txs on the state, returning the result of each tx.
 func (bc *Blockchain) AddUpdatedBlock2Chain(
 	hash []byte,
-	blockPool BlockPool, preparePool MsgPool, commitPool MsgPool) {
+	blockPool BlockPool, preparePool MsgPool, commitPool MsgPool) ([]string, bool) {
 
 	existsInPool, _ := blockPool.BlockExists(hash)
 	if !existsInPool {
 		log.Printf("Added block [%s] to blockchain failed, BLOCK NOT EXISTS IN BLOCK POOL!", chain_util.BytesToHex(hash)[:6])
+		return nil, false
 	} else {
-		hashHex := chain_util.BytesToHex(hash)
 		block := blockPool.GetBlock(hash)
 		// check if the proposed block is matching the lastblock
-		if chain_util.BytesToHex(block.LastHash) != chain_util.BytesToHex(bc.chain[len(bc.chain)-1].Hash) {
+		if !chain_util.Equal(block.LastHash, bc.chain[len(bc.chain)-1].Hash) {
 			log.Printf("Added block [%s] to blockchain failed, BLOCK'S LASTHASH NOT MATCHED!", chain_util.BytesToHex(hash)[:6])
-			return
+			return nil, false
 		}
 
-		block.BlockMsgs = blockPool.pool
-		block.PrepareMsgs = preparePool.mapPool[hashHex]
-		block.CommitMsgs = commitPool.mapPool[hashHex]
+		block.Certificate = &Certificate{
+			PrepareMsgs: append([]Message(nil), preparePool.Msgs(hash)...),
+			CommitMsgs:  append([]Message(nil), commitPool.Msgs(hash)...),
+		}
 		bc.chain = append(bc.chain, *block)
+		bc.pruneVotes()
+		results := bc.state.ApplyBlock(bc.envAt(bc.Height()), block.Data)
+		bc.applyGovernance(*block, results)
+		if !chain_util.Equal(bc.state.AppHash(), block.AppHash) {
+			log.Printf("Block [%s] app hash MISMATCHED the local state!", chain_util.BytesToHex(hash)[:6])
+		}
+		bc.pruneInflight()
 		log.Printf("Added block [%s] to blockchain succeed!", chain_util.BytesToHex(hash)[:6])
+		return results, true
 	}
 }
 
-// GetProposer get the proposer according to the latest block's info in the chain
+// pruneVotes drops the PREPARE votes of the block leaving the
+// retention window, the COMMIT votes are kept for light clients
+func (bc *Blockchain) pruneVotes() {
+	if bc.retention == 0 || bc.Height() <= bc.retention {
+		return
+	}
+	block := &bc.chain[bc.Height()-bc.retention]
+	if block.Certificate != nil {
+		block.Certificate = &Certificate{CommitMsgs: block.Certificate.CommitMsgs}
+	}
+}
+
+// envAt returns the env of a block at given height
+func (bc *Blockchain) envAt(height uint64) BlockEnv {
+	return BlockEnv{Height: height, Validators: bc.ValidatorsAt(height), EpochLength: bc.epochLength}
+}
+
+// GetProposer get the proposer of the next block chained on the head
+// of the pipeline, shifted by the current view
 func (bc *Blockchain) GetProposer() PublicKey {
-	index := bc.chain[len(bc.chain)-1].Hash[0] % NUM_OF_NODES
-	return bc.validators[index]
+	lastBlock, _, _ := bc.head()
+	proposer, _ := bc.ProposerFor(lastBlock.Hash)
+	return proposer
+}
+
+// View returns the current view
+func (bc *Blockchain) View() uint64 {
+	return bc.view
+}
+
+// SetView moves the chain to a new view, no block is accepted in the
+// view until its NEW-VIEW is applied, see viewchange.go
+func (bc *Blockchain) SetView(view uint64) {
+	bc.view = view
 }
 
-// VerifyBlock verifies a block with respect to the blockchain
+// SetMaxClockDrift sets how far ahead of the local clock a block may
+// be timestamped
+func (bc *Blockchain) SetMaxClockDrift(drift time.Duration) {
+	bc.maxDrift = drift
+}
+
+// SetElection sets the proposer election strategy, every node of the
+// chain must use the same one. The beacon election only draws from the
+// COMMITs of validators with unique signatures, see BeaconFrom.
+func (bc *Blockchain) SetElection(election ProposerElection) {
+	bc.election = election
+}
+
+// VerifyBlock verifies a block with respect to the blockchain, the
+// block must chain on the tip or on a block in flight within the
+// pipeline depth, above the blocks carried into a justified view
 func (bc *Blockchain) VerifyBlock(block Block) bool {
-	lastBlock := bc.chain[len(bc.chain)-1]
-	if chain_util.BytesToHex(block.LastHash) == chain_util.BytesToHex(lastBlock.Hash) &&
-		chain_util.BytesToHex(block.Hash) == chain_util.BytesToHex(HashBlock(block.Timestamp, block.LastHash, block.Data, block.Nonce)) &&
+	parentHeight, parentState, ok := bc.parent(block.LastHash)
+	parent, _ := bc.parentBlock(block.LastHash)
+	proposer, _ := bc.ProposerFor(block.LastHash)
+	if ok && parentHeight+1 <= bc.Height()+bc.depth &&
+		bc.justified == bc.view && parentHeight+1 > bc.carried &&
+		bc.verifyHeader(block.BlockHeader, parent.BlockHeader) &&
 		VerifyBlock(block) &&
-		VerifyBlockProposer(block, block.Proposer) {
+		VerifyBeacon(block, parent.BlockHeader) &&
+		bc.verifyLastCommit(block) &&
+		chain_util.Equal(block.AppHash, SimulateOn(parentState, bc.envAt(parentHeight+1), block.Data).Root()) &&
+		VerifyBlockProposer(block, proposer) {
 		log.Printf("Block [%s] is VALID", chain_util.BytesToHex(block.Hash)[:6])
 		return true
 	} else {
@@ -89,7 +227,112 @@ func (bc *Blockchain) VerifyBlock(block Block) bool {
 	}
 }
 
+// verifyHeader checks a header against its parent's: same chain and
+// validator set, the next height, the current view, and a timestamp
+// after the parent's that is not too far ahead of the local clock
+func (bc *Blockchain) verifyHeader(header BlockHeader, parent BlockHeader) bool {
+	switch {
+	case header.ChainID != bc.chainID:
+		log.Printf("Block at height %d is from chain %q", header.Height, header.ChainID)
+	case header.Height != parent.Height+1:
+		log.Printf("Block height %d does not follow %d", header.Height, parent.Height)
+	case header.View != bc.view:
+		log.Printf("Block at height %d has view %d, not the current view", header.Height, header.View)
+	case !chain_util.Equal(header.ValidatorsHash, bc.epochAt(header.Height).hash) ||
+		!chain_util.Equal(header.NextValidatorsHash, bc.epochAt(header.Height+1).hash):
+		log.Printf("Block at height %d validator set MISMATCHED", header.Height)
+	case header.Timestamp <= parent.Timestamp:
+		log.Printf("Block at height %d timestamp is not after its parent's", header.Height)
+	case header.Timestamp > time.Now().Add(bc.maxDrift).UnixNano():
+		log.Printf("Block at height %d timestamp is too far in the future", header.Height)
+	default:
+		return true
+	}
+	return false
+}
+
+// lastCommit returns the COMMIT votes a block at given height
+// carries, i.e. those of the committed block depth heights below
+func (bc *Blockchain) lastCommit(height uint64) []Message {
+	if height <= bc.depth || height-bc.depth > bc.Height() {
+		return nil
+	}
+	return bc.chain[height-bc.depth].Commits()
+}
+
+// verifyLastCommit checks the block carries a COMMIT quorum for the
+// committed block depth heights below, if any, and nothing else: the
+// last commit feeds the beacon, see election.go
+func (bc *Blockchain) verifyLastCommit(block Block) bool {
+	if block.Height <= bc.depth {
+		return len(block.LastCommit) == 0
+	}
+	target := block.Height - bc.depth
+	if target > bc.Height() {
+		log.Printf("Block [%s] last commit is INVALID", chain_util.BytesToHex(block.Hash)[:6])
+		return false
+	}
+	vs := bc.ValidatorsAt(target)
+	signers := CommitSigners(block.LastCommit, bc.chain[target].Hash, target, *vs)
+	if len(signers) != len(block.LastCommit) || !vs.HasQuorum(signers) {
+		log.Printf("Block [%s] last commit is INVALID", chain_util.BytesToHex(block.Hash)[:6])
+		return false
+	}
+	return true
+}
+
+// FindTx searches the chain for the committed tx with given hash,
+// it returns the block holding the tx and the block's height
+func (bc *Blockchain) FindTx(txHash []byte) (*Block, uint64, bool) {
+	for height, block := range bc.chain {
+		for _, tx := range block.Data {
+			if chain_util.Equal(tx.Hash, txHash) {
+				blockCopy := block
+				return &blockCopy, uint64(height), true
+			}
+		}
+	}
+	return nil, 0, false
+}
+
+// QueryState queries a state key at given height, the returned proof
+// is checked against the app hash of the block at that height
+func (bc *Blockchain) QueryState(key string, height uint64) (*StateProof, *Block, bool) {
+	if height >= uint64(len(bc.chain)) {
+		return nil, nil, false
+	}
+	sp, ok := bc.state.Query(key, height)
+	if !ok {
+		return nil, nil, false
+	}
+	blockCopy := bc.chain[height]
+	return sp, &blockCopy, true
+}
+
+// GetBlock returns a copy of the committed block at given height
+func (bc *Blockchain) GetBlock(height uint64) (*Block, bool) {
+	if height >= uint64(len(bc.chain)) {
+		return nil, false
+	}
+	blockCopy := bc.chain[height]
+	return &blockCopy, true
+}
+
+// Nonce returns a sender's last nonce executed on the chain
+func (bc *Blockchain) Nonce(from []byte) uint64 {
+	return bc.state.Nonce(from)
+}
+
+// Height returns the height of the latest committed block
+func (bc *Blockchain) Height() uint64 {
+	return uint64(len(bc.chain) - 1)
+}
+
 // Clear clears the content of chain
 func (bc *Blockchain) Clear() {
 	bc.chain = bc.chain[:1]
+	bc.state = NewStateStore()
+	bc.view, bc.justified, bc.carried = 0, 0, 0
+	bc.epochs = bc.epochs[:1]
+	bc.inflight = make(map[chain_util.Key]*inflightBlock)
 }
@@ -1,17 +1,12 @@
 package chain_util
 
 import (
-	"crypto/ed25519"
 	"crypto/sha256"
 	"encoding/hex"
 	"github.com/google/uuid"
 	"strconv"
 )
 
-// set alias
-type PrivateKey = ed25519.PrivateKey
-type PublicKey = ed25519.PublicKey
-
 // Hash hashes the data using SHA-256
 func Hash(data string) []byte {
 	hash := sha256.Sum256([]byte(data))
@@ -34,14 +29,16 @@ func FormatUrl(host string, port uint64) string {
 	return host + ":" + strconv.FormatUint(port, 10)
 }
 
-// GenKeypair generates keypair with given secret
+// GenKeypair generates an ed25519 keypair with given secret, anyone
+// knowing the secret gets the private key, so it is for demos and tests
+// only
 func GenKeypair(secret string) (PrivateKey, PublicKey) {
 	// hash the secret
 	hash := Hash(secret)
 
 	// generate Ed25519 keypair from the seed
-	privateKey := ed25519.NewKeyFromSeed(hash)
-	publicKey := privateKey.Public().(PublicKey)
+	privateKey, _ := ed25519Scheme{}.PrivateKeyFromBytes(hash)
+	publicKey := privateKey.Public()
 
 	return privateKey, publicKey
 }
@@ -57,11 +54,11 @@ func Id() string {
 
 // Sign signs given hash with privateKey then returns a signature
 func Sign(privateKey PrivateKey, hash []byte) []byte {
-	signature := ed25519.Sign(privateKey, hash)
-	return signature
+	return privateKey.Sign(hash)
 }
 
 // Verify verifies the given hash and signature with the given publicKey
+// of any scheme
 func Verify(publicKey PublicKey, hash []byte, signature []byte) bool {
-	return ed25519.Verify(publicKey, hash, signature)
+	return publicKey.Verify(hash, signature)
 }
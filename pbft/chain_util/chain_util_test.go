@@ -58,10 +58,10 @@ func TestGenKeypair(t *testing.T) {
 
 	hash := Hash(secret)
 	expectedPrivateKey := ed25519.NewKeyFromSeed(hash)
-	expectedPublicKey := expectedPrivateKey.Public().(PublicKey)
+	expectedPublicKey := NewPublicKey(KeyTypeEd25519, expectedPrivateKey.Public().(ed25519.PublicKey))
 
 	actualPrivateKey, actualPublicKey := GenKeypair(secret)
-	if !bytes.Equal(expectedPrivateKey, actualPrivateKey) {
+	if !bytes.Equal(expectedPrivateKey.Seed(), actualPrivateKey.Bytes()) {
 		t.Errorf("GenKeypair failed, expected %s, actual %s\n", expectedPrivateKey, actualPrivateKey)
 	}
 	if !bytes.Equal(expectedPublicKey, actualPublicKey) {
@@ -82,7 +82,7 @@ func TestSign(t *testing.T) {
 	data := "test data"
 	hash := Hash(data)
 	privateKey, _ := GenKeypair(secret)
-	expected := ed25519.Sign(privateKey, hash)
+	expected := ed25519.Sign(ed25519.NewKeyFromSeed(privateKey.Bytes()), hash)
 	actual := Sign(privateKey, hash)
 
 	if !bytes.Equal(expected, actual) {
@@ -100,3 +100,13 @@ func TestVerify(t *testing.T) {
 		t.Errorf("Verify failed, expected true, actual false\n")
 	}
 }
+
+func TestKeyOf(t *testing.T) {
+	hash := Hash("block")
+	if KeyOf(hash) != Key(sha256.Sum256(hash)) {
+		t.Errorf("KeyOf() failed, a 32-byte value is not hashed\n")
+	}
+	if KeyOf(hash) == KeyOf(append([]byte{1}, hash...)) {
+		t.Errorf("KeyOf() failed, values of different sizes share a key\n")
+	}
+}
@@ -0,0 +1,283 @@
+package chain_util
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+	"math/big"
+)
+
+/**
+Signature schemes. A PublicKey is serialized as the KeyType tag of its
+scheme followed by the scheme's encoding of the key, so keys of any
+scheme can be mixed, e.g. in a validator set, and a signature is
+verified with the scheme its key is tagged with.
+- ed25519: 32-byte keys and 64-byte signatures, a private key is
+  serialized as its 32-byte seed. A key has a single signature per
+  message.
+- ECDSA over NIST P-256 (FIPS 186): keys in the 33-byte compressed
+  form of SEC 1, ASN.1 DER signatures, a private key is serialized as
+  its 32-byte scalar. Signatures are randomized, and only the one with
+  the low s value is valid so that a signature cannot be altered.
+It features the following methods:
+1. SchemeOf
+2. SchemeByName
+3. NewPublicKey
+4. Type
+5. Valid
+6. Verify
+7. ParsePublicKey
+*/
+
+type KeyType byte
+
+const (
+	KeyTypeEd25519 KeyType = 1
+	KeyTypeP256    KeyType = 2
+)
+
+// Scheme is a signature scheme, it works on untagged keys
+type Scheme interface {
+	Type() KeyType
+	Name() string
+	// GenerateKey generates a private key from secure randomness
+	GenerateKey() (PrivateKey, error)
+	// PrivateKeyFromBytes parses a serialized private key
+	PrivateKeyFromBytes(b []byte) (PrivateKey, error)
+	ValidPublicKey(raw []byte) bool
+	Verify(raw []byte, hash []byte, signature []byte) bool
+	// UniqueSignatures tells if a key signs a message deterministically,
+	// so that signing it again gives no choice of signature
+	UniqueSignatures() bool
+}
+
+type PrivateKey interface {
+	Public() PublicKey
+	Sign(hash []byte) []byte
+	// Bytes returns the serialized private key
+	Bytes() []byte
+}
+
+// PublicKey is a key type tag followed by the key
+type PublicKey []byte
+
+type ed25519Scheme struct{}
+
+type p256Scheme struct{}
+
+type ed25519PrivateKey struct {
+	key ed25519.PrivateKey
+}
+
+type p256PrivateKey struct {
+	key *ecdsa.PrivateKey
+}
+
+// ecdsaSignature is the ASN.1 structure of an ECDSA signature
+type ecdsaSignature struct {
+	R, S *big.Int
+}
+
+var schemes = map[KeyType]Scheme{
+	KeyTypeEd25519: ed25519Scheme{},
+	KeyTypeP256:    p256Scheme{},
+}
+
+// SchemeOf returns the scheme of given key type
+func SchemeOf(keyType KeyType) (Scheme, bool) {
+	scheme, ok := schemes[keyType]
+	return scheme, ok
+}
+
+// SchemeByName returns the scheme with given name, "ed25519" or "p256"
+func SchemeByName(name string) (Scheme, bool) {
+	for _, scheme := range schemes {
+		if scheme.Name() == name {
+			return scheme, true
+		}
+	}
+	return nil, false
+}
+
+// NewPublicKey tags a key of given type
+func NewPublicKey(keyType KeyType, raw []byte) PublicKey {
+	return append(PublicKey{byte(keyType)}, raw...)
+}
+
+// ParsePublicKey decodes the hex of a public key. A key of the files
+// written before keys were tagged is a bare 32-byte ed25519 key, it
+// is tagged as such, any other key must be a valid tagged key.
+func ParsePublicKey(keyHex string) (PublicKey, error) {
+	raw, err := HexToBytes(keyHex)
+	if err != nil {
+		return nil, err
+	}
+	pk := PublicKey(raw)
+	if len(raw) == ed25519.PublicKeySize {
+		pk = NewPublicKey(KeyTypeEd25519, raw)
+	}
+	if !pk.Valid() {
+		return nil, fmt.Errorf("invalid public key [%s]", keyHex)
+	}
+	return pk, nil
+}
+
+// Type returns the key type the key is tagged with
+func (pk PublicKey) Type() KeyType {
+	if len(pk) == 0 {
+		return 0
+	}
+	return KeyType(pk[0])
+}
+
+// Valid checks that the key is a valid key of a known scheme
+func (pk PublicKey) Valid() bool {
+	scheme, ok := SchemeOf(pk.Type())
+	return ok && scheme.ValidPublicKey(pk[1:])
+}
+
+// Verify verifies a signature over a hash with the key's scheme
+func (pk PublicKey) Verify(hash []byte, signature []byte) bool {
+	scheme, ok := SchemeOf(pk.Type())
+	return ok && scheme.Verify(pk[1:], hash, signature)
+}
+
+func (ed25519Scheme) Type() KeyType {
+	return KeyTypeEd25519
+}
+
+func (ed25519Scheme) Name() string {
+	return "ed25519"
+}
+
+func (ed25519Scheme) GenerateKey() (PrivateKey, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519PrivateKey{key: key}, nil
+}
+
+func (ed25519Scheme) PrivateKeyFromBytes(b []byte) (PrivateKey, error) {
+	if len(b) != ed25519.SeedSize {
+		return nil, fmt.Errorf("ed25519 private key must be %d bytes, got %d", ed25519.SeedSize, len(b))
+	}
+	return ed25519PrivateKey{key: ed25519.NewKeyFromSeed(b)}, nil
+}
+
+func (ed25519Scheme) ValidPublicKey(raw []byte) bool {
+	return len(raw) == ed25519.PublicKeySize
+}
+
+func (ed25519Scheme) Verify(raw []byte, hash []byte, signature []byte) bool {
+	// ed25519 panics on keys of the wrong size
+	if len(raw) != ed25519.PublicKeySize {
+		return false
+	}
+	return ed25519.Verify(raw, hash, signature)
+}
+
+func (ed25519Scheme) UniqueSignatures() bool {
+	return true
+}
+
+func (k ed25519PrivateKey) Public() PublicKey {
+	return NewPublicKey(KeyTypeEd25519, k.key.Public().(ed25519.PublicKey))
+}
+
+func (k ed25519PrivateKey) Sign(hash []byte) []byte {
+	return ed25519.Sign(k.key, hash)
+}
+
+func (k ed25519PrivateKey) Bytes() []byte {
+	return k.key.Seed()
+}
+
+func (p256Scheme) Type() KeyType {
+	return KeyTypeP256
+}
+
+func (p256Scheme) Name() string {
+	return "p256"
+}
+
+func (p256Scheme) GenerateKey() (PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return p256PrivateKey{key: key}, nil
+}
+
+func (p256Scheme) PrivateKeyFromBytes(b []byte) (PrivateKey, error) {
+	// checks the scalar is in range
+	if _, err := ecdh.P256().NewPrivateKey(b); err != nil {
+		return nil, fmt.Errorf("invalid p256 private key, %v", err)
+	}
+	curve := elliptic.P256()
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(b)}
+	key.Curve = curve
+	key.X, key.Y = curve.ScalarBaseMult(b)
+	return p256PrivateKey{key: key}, nil
+}
+
+func (p256Scheme) ValidPublicKey(raw []byte) bool {
+	x, _ := elliptic.UnmarshalCompressed(elliptic.P256(), raw)
+	return x != nil
+}
+
+func (p256Scheme) Verify(raw []byte, hash []byte, signature []byte) bool {
+	curve := elliptic.P256()
+	x, y := elliptic.UnmarshalCompressed(curve, raw)
+	if x == nil {
+		return false
+	}
+	var sig ecdsaSignature
+	rest, err := asn1.Unmarshal(signature, &sig)
+	if err != nil || len(rest) > 0 || sig.R == nil || sig.S == nil ||
+		sig.S.Cmp(halfOrder(curve)) > 0 {
+		return false
+	}
+	// only the canonical encoding is valid
+	if canonical, err := asn1.Marshal(sig); err != nil || !Equal(canonical, signature) {
+		return false
+	}
+	return ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: curve, X: x, Y: y}, hash, signature)
+}
+
+func (p256Scheme) UniqueSignatures() bool {
+	return false
+}
+
+func (k p256PrivateKey) Public() PublicKey {
+	return NewPublicKey(KeyTypeP256, elliptic.MarshalCompressed(k.key.Curve, k.key.X, k.key.Y))
+}
+
+func (k p256PrivateKey) Sign(hash []byte) []byte {
+	r, s, err := ecdsa.Sign(rand.Reader, k.key, hash)
+	if err != nil {
+		return nil
+	}
+	// (r, n-s) is valid too, the low s one is kept
+	if s.Cmp(halfOrder(k.key.Curve)) > 0 {
+		s.Sub(k.key.Curve.Params().N, s)
+	}
+	signature, err := asn1.Marshal(ecdsaSignature{R: r, S: s})
+	if err != nil {
+		return nil
+	}
+	return signature
+}
+
+func (k p256PrivateKey) Bytes() []byte {
+	return k.key.D.FillBytes(make([]byte, 32))
+}
+
+// halfOrder returns half the order of the curve
+func halfOrder(curve elliptic.Curve) *big.Int {
+	return new(big.Int).Rsh(curve.Params().N, 1)
+}
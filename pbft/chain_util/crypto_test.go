@@ -0,0 +1,76 @@
+package chain_util
+
+import (
+	"crypto/elliptic"
+	"encoding/asn1"
+	"testing"
+)
+
+func TestSchemes(t *testing.T) {
+	hash := Hash("test data")
+	for _, name := range []string{"ed25519", "p256"} {
+		scheme, ok := SchemeByName(name)
+		if !ok {
+			t.Fatalf("scheme %s not found", name)
+		}
+		privateKey, err := scheme.GenerateKey()
+		if err != nil {
+			t.Fatalf("%s GenerateKey failed, %v", name, err)
+		}
+		publicKey := privateKey.Public()
+		if publicKey.Type() != scheme.Type() || !publicKey.Valid() {
+			t.Errorf("%s public key is not tagged with its type", name)
+		}
+		signature := Sign(privateKey, hash)
+		if !Verify(publicKey, hash, signature) {
+			t.Errorf("%s Verify failed, expected true, actual false", name)
+		}
+		if Verify(publicKey, Hash("other data"), signature) {
+			t.Errorf("%s Verify accepted a signature over another hash", name)
+		}
+
+		// the serialized private key restores the same key
+		restored, err := scheme.PrivateKeyFromBytes(privateKey.Bytes())
+		if err != nil || !Equal(restored.Public(), publicKey) {
+			t.Errorf("%s PrivateKeyFromBytes failed, %v", name, err)
+		}
+
+		// a key of another scheme with the same bytes verifies nothing
+		retagged := append(PublicKey{}, publicKey...)
+		retagged[0] = byte(KeyTypeEd25519 + KeyTypeP256 - publicKey.Type())
+		if Verify(retagged, hash, signature) {
+			t.Errorf("%s signature verified under another scheme", name)
+		}
+	}
+	if (PublicKey{}).Valid() || NewPublicKey(KeyType(9), make([]byte, 32)).Valid() {
+		t.Errorf("key of unknown type is valid")
+	}
+}
+
+func TestP256_LowS(t *testing.T) {
+	scheme, _ := SchemeOf(KeyTypeP256)
+	privateKey, _ := scheme.GenerateKey()
+	publicKey := privateKey.Public()
+	if len(publicKey) != 1+33 {
+		t.Errorf("p256 public key is %d bytes, want 34", len(publicKey))
+	}
+	hash := Hash("test data")
+	signature := privateKey.Sign(hash)
+
+	// the high s twin of a valid signature is refused
+	var sig ecdsaSignature
+	if _, err := asn1.Unmarshal(signature, &sig); err != nil {
+		t.Fatal(err)
+	}
+	sig.S.Sub(elliptic.P256().Params().N, sig.S)
+	malleated, _ := asn1.Marshal(sig)
+	if Verify(publicKey, hash, malleated) {
+		t.Errorf("p256 accepted a high s signature")
+	}
+	if Verify(publicKey, hash, append(signature, 0)) {
+		t.Errorf("p256 accepted a signature with trailing data")
+	}
+	if _, err := scheme.PrivateKeyFromBytes(make([]byte, 32)); err == nil {
+		t.Errorf("p256 accepted a zero private key")
+	}
+}
@@ -0,0 +1,50 @@
+package chain_util
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPBKDF2(t *testing.T) {
+	// test vectors of RFC 7914, section 11
+	tests := []struct {
+		passphrase string
+		salt       string
+		iterations int
+		expected   string
+	}{
+		{"passwd", "salt", 1, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783"},
+		{"Password", "NaCl", 80000, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d"},
+	}
+	for _, test := range tests {
+		actual := BytesToHex(PBKDF2([]byte(test.passphrase), []byte(test.salt), test.iterations, 64))
+		if actual != test.expected {
+			t.Errorf("PBKDF2(%s, %s, %d) failed, expected %s, actual %s\n", test.passphrase, test.salt, test.iterations, test.expected, actual)
+		}
+	}
+	if len(PBKDF2([]byte("p"), []byte("s"), 1, 20)) != 20 {
+		t.Errorf("PBKDF2 key length not honoured")
+	}
+}
+
+func TestSealOpen(t *testing.T) {
+	key := PBKDF2([]byte("passphrase"), []byte("salt"), 1, 32)
+	plaintext := []byte("secret seed")
+	nonce, ciphertext, err := Seal(key, plaintext)
+	if err != nil {
+		t.Fatalf("Seal failed, %v", err)
+	}
+	opened, err := Open(key, nonce, ciphertext)
+	if err != nil || !bytes.Equal(opened, plaintext) {
+		t.Errorf("Open failed, %v", err)
+	}
+
+	wrongKey := PBKDF2([]byte("wrong"), []byte("salt"), 1, 32)
+	if _, err := Open(wrongKey, nonce, ciphertext); err == nil {
+		t.Errorf("Open with a wrong key succeeded")
+	}
+	ciphertext[0] ^= 1
+	if _, err := Open(key, nonce, ciphertext); err == nil {
+		t.Errorf("Open of a tampered ciphertext succeeded")
+	}
+}
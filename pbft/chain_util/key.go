@@ -0,0 +1,28 @@
+package chain_util
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Key is a fixed-size map key for hashes and public keys, indexing by
+// Key instead of hex strings keeps lookups allocation-free
+type Key [32]byte
+
+// KeyOf returns the key of a hash or public key, values are always
+// keyed by their SHA-256 so that a value of one size never takes the
+// key of a value of another size
+func KeyOf(b []byte) Key {
+	return sha256.Sum256(b)
+}
+
+// Hex encodes the key into hex code
+func (k Key) Hex() string {
+	return hex.EncodeToString(k[:])
+}
+
+// Equal compares two hashes or public keys without allocating
+func Equal(a []byte, b []byte) bool {
+	return bytes.Equal(a, b)
+}
@@ -0,0 +1,111 @@
+package chain_util
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+/**
+A binary Merkle tree built over a list of leaves (e.g. a block's txs).
+Leaves and inner nodes are domain separated by a prefix byte so that
+an inner node can never be presented as a leaf and vice versa. An odd
+node at any level is promoted to the next level unchanged.
+It features the following functions:
+1. MerkleLeafHash
+2. MerkleRoot
+3. MerkleProof
+4. VerifyMerkleProof
+*/
+
+const (
+	merkleLeafPrefix  = 0x00
+	merkleInnerPrefix = 0x01
+)
+
+// MerkleStep is one sibling on the path from a leaf to the root.
+// `Left` tells whether the sibling sits on the left of the path.
+type MerkleStep struct {
+	Hash []byte `json:"hash"`
+	Left bool   `json:"left"`
+}
+
+// MerkleLeafHash hashes raw leaf data
+func MerkleLeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// merkleInnerHash hashes two children into their parent
+func merkleInnerHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{merkleInnerPrefix})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// nextLevel folds one level of the tree into its parent level
+func nextLevel(level [][]byte) [][]byte {
+	parents := make([][]byte, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			parents = append(parents, level[i])
+			continue
+		}
+		parents = append(parents, merkleInnerHash(level[i], level[i+1]))
+	}
+	return parents
+}
+
+// MerkleRoot returns the root of the tree over the given leaf hashes.
+// The root of an empty tree is the hash of an empty string.
+func MerkleRoot(leaves [][]byte) []byte {
+	if len(leaves) == 0 {
+		empty := sha256.Sum256(nil)
+		return empty[:]
+	}
+	level := leaves
+	for len(level) > 1 {
+		level = nextLevel(level)
+	}
+	return level[0]
+}
+
+// MerkleProof returns the sibling path of the leaf at `index`,
+// ordered from the leaf up to the root. It returns nil if the index
+// is out of range.
+func MerkleProof(leaves [][]byte, index int) []MerkleStep {
+	if index < 0 || index >= len(leaves) {
+		return nil
+	}
+	proof := make([]MerkleStep, 0)
+	level := leaves
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, MerkleStep{
+				Hash: level[sibling],
+				Left: sibling < index,
+			})
+		}
+		level = nextLevel(level)
+		index /= 2
+	}
+	return proof
+}
+
+// VerifyMerkleProof checks that `leaf` is included in the tree with
+// the given `root` by folding the proof path
+func VerifyMerkleProof(leaf []byte, proof []MerkleStep, root []byte) bool {
+	hash := leaf
+	for _, step := range proof {
+		if step.Left {
+			hash = merkleInnerHash(step.Hash, hash)
+		} else {
+			hash = merkleInnerHash(hash, step.Hash)
+		}
+	}
+	return bytes.Equal(hash, root)
+}
@@ -0,0 +1,48 @@
+package chain_util
+
+import (
+	"strconv"
+	"testing"
+)
+
+func makeLeaves(n int) [][]byte {
+	leaves := make([][]byte, n)
+	for i := range n {
+		leaves[i] = MerkleLeafHash([]byte("leaf-" + strconv.Itoa(i)))
+	}
+	return leaves
+}
+
+func TestMerkleRoot(t *testing.T) {
+	leaves := makeLeaves(3)
+	expected := merkleInnerHash(merkleInnerHash(leaves[0], leaves[1]), leaves[2])
+	if BytesToHex(expected) != BytesToHex(MerkleRoot(leaves)) {
+		t.Errorf("MerkleRoot failed, expected %x, actual %x\n", expected, MerkleRoot(leaves))
+	}
+	if BytesToHex(MerkleRoot(leaves[:1])) != BytesToHex(leaves[0]) {
+		t.Errorf("MerkleRoot of a single leaf should be the leaf itself\n")
+	}
+	if MerkleRoot(nil) == nil {
+		t.Errorf("MerkleRoot of no leaves should not be nil\n")
+	}
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := makeLeaves(n)
+		root := MerkleRoot(leaves)
+		for i := range n {
+			proof := MerkleProof(leaves, i)
+			if !VerifyMerkleProof(leaves[i], proof, root) {
+				t.Errorf("VerifyMerkleProof failed, n=%d, index=%d\n", n, i)
+			}
+			other := MerkleLeafHash([]byte("other"))
+			if VerifyMerkleProof(other, proof, root) {
+				t.Errorf("VerifyMerkleProof should fail for a foreign leaf, n=%d, index=%d\n", n, i)
+			}
+		}
+	}
+	if MerkleProof(makeLeaves(2), 2) != nil {
+		t.Errorf("MerkleProof should return nil for out of range index\n")
+	}
+}
@@ -0,0 +1,316 @@
+package chain_util
+
+import (
+	"bytes"
+	"crypto/sha256"
+)
+
+/**
+SparseMerkleTree is an authenticated key-value map. Every key owns a
+fixed leaf slot addressed by the 256 bits of SHA-256(key), so proving
+that a key is absent is the same as proving its slot is empty.
+An empty subtree hashes to 32 zero bytes at every depth, which keeps
+proofs short: only non-empty siblings are shipped, and a bitmap tells
+the verifier which depths they belong to.
+The tree is stored as an immutable trie where a subtree holding a
+single leaf is that leaf, and every node caches its hash. A write
+replaces only the nodes on the path to its leaf, so it rehashes that
+path rather than the whole tree, and a copy shares all the nodes of
+the original.
+It features the following methods:
+1. NewSparseMerkleTree
+2. Set / Delete / Get
+3. Root
+4. Prove
+5. Copy
+6. VerifySMTProof
+*/
+
+const SMTDepth = 256
+
+var smtEmpty = make([]byte, sha256.Size)
+
+type smtLeaf struct {
+	path  [32]byte
+	key   []byte
+	value []byte
+}
+
+// smtNode is an immutable subtree at some depth, either a single leaf
+// or an inner node with at least one non-empty child
+type smtNode struct {
+	leaf  *smtLeaf
+	left  *smtNode // nil if empty
+	right *smtNode // nil if empty
+	hash  []byte   // hash of the subtree at its depth
+}
+
+type SparseMerkleTree struct {
+	root *smtNode // nil if empty
+	size int
+}
+
+// SMTProof proves membership (Exists) or non-membership of a key.
+// Siblings are ordered from the root down to the leaf.
+type SMTProof struct {
+	Key      []byte   `json:"key"`
+	Value    []byte   `json:"value"`
+	Exists   bool     `json:"exists"`
+	Bitmap   []byte   `json:"bitmap"`
+	Siblings [][]byte `json:"siblings"`
+}
+
+// NewSparseMerkleTree creates an empty tree
+func NewSparseMerkleTree() *SparseMerkleTree {
+	return &SparseMerkleTree{}
+}
+
+// smtPath returns the leaf slot of the key
+func smtPath(key []byte) [32]byte {
+	return sha256.Sum256(key)
+}
+
+// bitAt returns the bit of the path at given depth, 0 is the MSB
+func bitAt(path [32]byte, depth int) byte {
+	return (path[depth/8] >> (7 - uint(depth%8))) & 1
+}
+
+// smtLeafHash hashes a non-empty leaf
+func smtLeafHash(path [32]byte, value []byte) []byte {
+	valueHash := sha256.Sum256(value)
+	h := sha256.New()
+	h.Write([]byte{merkleLeafPrefix})
+	h.Write(path[:])
+	h.Write(valueHash[:])
+	return h.Sum(nil)
+}
+
+// smtInnerHash hashes two children, two empty children stay empty
+func smtInnerHash(left, right []byte) []byte {
+	if bytes.Equal(left, smtEmpty) && bytes.Equal(right, smtEmpty) {
+		return smtEmpty
+	}
+	return merkleInnerHash(left, right)
+}
+
+// hashOf returns the hash of a subtree, empty if nil
+func (n *smtNode) hashOf() []byte {
+	if n == nil {
+		return smtEmpty
+	}
+	return n.hash
+}
+
+// newLeafNode returns the subtree at given depth holding a single
+// leaf, its hash climbs from the leaf's slot with empty siblings
+func newLeafNode(leaf *smtLeaf, depth int) *smtNode {
+	hash := smtLeafHash(leaf.path, leaf.value)
+	for d := SMTDepth - 1; d >= depth; d-- {
+		if bitAt(leaf.path, d) == 0 {
+			hash = smtInnerHash(hash, smtEmpty)
+		} else {
+			hash = smtInnerHash(smtEmpty, hash)
+		}
+	}
+	return &smtNode{leaf: leaf, hash: hash}
+}
+
+// newInnerNode returns the subtree at given depth with given children,
+// a subtree left with a single leaf collapses into that leaf
+func newInnerNode(left, right *smtNode, depth int) *smtNode {
+	switch {
+	case left == nil && right == nil:
+		return nil
+	case left == nil && right.leaf != nil:
+		return newLeafNode(right.leaf, depth)
+	case right == nil && left.leaf != nil:
+		return newLeafNode(left.leaf, depth)
+	}
+	return &smtNode{left: left, right: right, hash: smtInnerHash(left.hashOf(), right.hashOf())}
+}
+
+// insert returns the subtree at given depth with the leaf set
+func insert(n *smtNode, leaf *smtLeaf, depth int) *smtNode {
+	if n == nil || (n.leaf != nil && n.leaf.path == leaf.path) {
+		return newLeafNode(leaf, depth)
+	}
+	left, right := n.left, n.right
+	if n.leaf != nil {
+		// push the existing leaf one level down
+		if bitAt(n.leaf.path, depth) == 0 {
+			left, right = newLeafNode(n.leaf, depth+1), nil
+		} else {
+			left, right = nil, newLeafNode(n.leaf, depth+1)
+		}
+	}
+	if bitAt(leaf.path, depth) == 0 {
+		left = insert(left, leaf, depth+1)
+	} else {
+		right = insert(right, leaf, depth+1)
+	}
+	return newInnerNode(left, right, depth)
+}
+
+// remove returns the subtree at given depth without the leaf of path
+func remove(n *smtNode, path [32]byte, depth int) *smtNode {
+	if n == nil {
+		return nil
+	}
+	if n.leaf != nil {
+		if n.leaf.path == path {
+			return nil
+		}
+		return n
+	}
+	left, right := n.left, n.right
+	if bitAt(path, depth) == 0 {
+		left = remove(left, path, depth+1)
+		if left == n.left {
+			return n
+		}
+	} else {
+		right = remove(right, path, depth+1)
+		if right == n.right {
+			return n
+		}
+	}
+	return newInnerNode(left, right, depth)
+}
+
+// find returns the leaf of path, nil if its slot is empty
+func (t *SparseMerkleTree) find(path [32]byte) *smtLeaf {
+	n := t.root
+	for depth := 0; n != nil; depth++ {
+		if n.leaf != nil {
+			if n.leaf.path == path {
+				return n.leaf
+			}
+			return nil
+		}
+		if bitAt(path, depth) == 0 {
+			n = n.left
+		} else {
+			n = n.right
+		}
+	}
+	return nil
+}
+
+// Set sets the value of a key
+func (t *SparseMerkleTree) Set(key []byte, value []byte) {
+	path := smtPath(key)
+	if t.find(path) == nil {
+		t.size++
+	}
+	t.root = insert(t.root, &smtLeaf{
+		path:  path,
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	}, 0)
+}
+
+// Delete removes a key from the tree
+func (t *SparseMerkleTree) Delete(key []byte) {
+	path := smtPath(key)
+	if t.find(path) == nil {
+		return
+	}
+	t.size--
+	t.root = remove(t.root, path, 0)
+}
+
+// Get returns the value of a key
+func (t *SparseMerkleTree) Get(key []byte) ([]byte, bool) {
+	leaf := t.find(smtPath(key))
+	if leaf == nil {
+		return nil, false
+	}
+	return leaf.value, true
+}
+
+// Len returns the number of keys in the tree
+func (t *SparseMerkleTree) Len() int {
+	return t.size
+}
+
+// Root returns the root hash of the tree
+func (t *SparseMerkleTree) Root() []byte {
+	return t.root.hashOf()
+}
+
+// Prove creates a membership or non-membership proof of a key
+func (t *SparseMerkleTree) Prove(key []byte) SMTProof {
+	path := smtPath(key)
+	proof := SMTProof{
+		Key:      append([]byte(nil), key...),
+		Bitmap:   make([]byte, SMTDepth/8),
+		Siblings: make([][]byte, 0),
+	}
+	addSibling := func(depth int, hash []byte) {
+		proof.Bitmap[depth/8] |= 1 << (7 - uint(depth%8))
+		proof.Siblings = append(proof.Siblings, hash)
+	}
+	n := t.root
+	for depth := 0; n != nil && depth < SMTDepth; depth++ {
+		if n.leaf != nil {
+			if n.leaf.path == path {
+				proof.Value = n.leaf.value
+				proof.Exists = true
+				break
+			}
+			// the other leaf is the sibling where their paths part
+			for ; depth < SMTDepth; depth++ {
+				if bitAt(n.leaf.path, depth) != bitAt(path, depth) {
+					addSibling(depth, newLeafNode(n.leaf, depth+1).hash)
+					break
+				}
+			}
+			break
+		}
+		sibling := n.right
+		if bitAt(path, depth) == 1 {
+			n, sibling = n.right, n.left
+		} else {
+			n = n.left
+		}
+		if sibling != nil {
+			addSibling(depth, sibling.hash)
+		}
+	}
+	return proof
+}
+
+// Copy returns an independent copy of the tree. Nodes are immutable
+// once written, so the copy shares them and costs nothing.
+func (t *SparseMerkleTree) Copy() *SparseMerkleTree {
+	return &SparseMerkleTree{root: t.root, size: t.size}
+}
+
+// VerifySMTProof checks a proof against a trusted root
+func VerifySMTProof(root []byte, proof SMTProof) bool {
+	if len(proof.Bitmap) != SMTDepth/8 {
+		return false
+	}
+	path := smtPath(proof.Key)
+	hash := smtEmpty
+	if proof.Exists {
+		hash = smtLeafHash(path, proof.Value)
+	}
+	next := len(proof.Siblings) - 1
+	for depth := SMTDepth - 1; depth >= 0; depth-- {
+		sibling := smtEmpty
+		if proof.Bitmap[depth/8]&(1<<(7-uint(depth%8))) != 0 {
+			if next < 0 {
+				return false
+			}
+			sibling = proof.Siblings[next]
+			next--
+		}
+		if bitAt(path, depth) == 0 {
+			hash = smtInnerHash(hash, sibling)
+		} else {
+			hash = smtInnerHash(sibling, hash)
+		}
+	}
+	return next == -1 && bytes.Equal(hash, root)
+}
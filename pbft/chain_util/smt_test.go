@@ -0,0 +1,73 @@
+package chain_util
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+)
+
+func TestSparseMerkleTree_Root(t *testing.T) {
+	t1 := NewSparseMerkleTree()
+	t2 := NewSparseMerkleTree()
+	if !bytes.Equal(t1.Root(), smtEmpty) {
+		t.Errorf("Root of an empty tree should be empty\n")
+	}
+	// insertion order must not matter
+	for i := range 5 {
+		t1.Set([]byte("key-"+strconv.Itoa(i)), []byte("value"))
+		t2.Set([]byte("key-"+strconv.Itoa(4-i)), []byte("value"))
+	}
+	if !bytes.Equal(t1.Root(), t2.Root()) {
+		t.Errorf("Root should not depend on insertion order\n")
+	}
+	before := t1.Root()
+	t1.Set([]byte("key-0"), []byte("changed"))
+	if bytes.Equal(before, t1.Root()) {
+		t.Errorf("Root should change after Set\n")
+	}
+	t1.Delete([]byte("key-0"))
+	t2.Delete([]byte("key-0"))
+	if !bytes.Equal(t1.Root(), t2.Root()) {
+		t.Errorf("Root should match after Delete\n")
+	}
+}
+
+func TestSparseMerkleTree_Prove(t *testing.T) {
+	tree := NewSparseMerkleTree()
+	for i := range 8 {
+		tree.Set([]byte("key-"+strconv.Itoa(i)), []byte("value-"+strconv.Itoa(i)))
+	}
+	root := tree.Root()
+
+	// membership
+	proof := tree.Prove([]byte("key-3"))
+	if !proof.Exists || string(proof.Value) != "value-3" || !VerifySMTProof(root, proof) {
+		t.Errorf("VerifySMTProof failed for membership\n")
+	}
+	proof.Value = []byte("forged")
+	if VerifySMTProof(root, proof) {
+		t.Errorf("VerifySMTProof should fail for a forged value\n")
+	}
+
+	// non-membership
+	proof = tree.Prove([]byte("missing"))
+	if proof.Exists || !VerifySMTProof(root, proof) {
+		t.Errorf("VerifySMTProof failed for non-membership\n")
+	}
+	proof = tree.Prove([]byte("key-5"))
+	proof.Exists = false
+	proof.Value = nil
+	if VerifySMTProof(root, proof) {
+		t.Errorf("VerifySMTProof should fail when hiding an existing key\n")
+	}
+}
+
+func TestSparseMerkleTree_Copy(t *testing.T) {
+	tree := NewSparseMerkleTree()
+	tree.Set([]byte("a"), []byte("1"))
+	snapshot := tree.Copy()
+	tree.Set([]byte("a"), []byte("2"))
+	if value, _ := snapshot.Get([]byte("a")); string(value) != "1" {
+		t.Errorf("Copy should not be affected by later writes\n")
+	}
+}
@@ -0,0 +1,153 @@
+package chain_util
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"runtime"
+	"sync"
+)
+
+/**
+Verifier checks signatures on a pool of worker goroutines, so the
+signatures of a block's txs are verified concurrently rather than one
+after another on the goroutine reading the message. Successful checks
+are remembered in a bounded cache, so a message gossiped again by
+another peer is not verified twice. Failed checks are never cached.
+It features the following methods:
+1. NewVerifier
+2. Verify
+3. VerifyBatch
+4. CacheLen
+*/
+
+// SigCheck is a signature to verify
+type SigCheck struct {
+	PublicKey PublicKey
+	Hash      []byte
+	Signature []byte
+}
+
+type verifyJob struct {
+	check  SigCheck
+	result chan<- bool
+}
+
+type Verifier struct {
+	workers int
+	jobs    chan verifyJob
+	start   sync.Once
+
+	lock      sync.Mutex
+	cache     map[[32]byte]struct{}
+	order     [][32]byte // cached keys in insertion order
+	cacheSize int
+}
+
+// NewVerifier creates a verifier with given number of workers, one per
+// CPU if not positive, and given cache size. Workers are started on
+// the first batch.
+func NewVerifier(workers int, cacheSize int) *Verifier {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	return &Verifier{
+		workers:   workers,
+		jobs:      make(chan verifyJob, workers),
+		cache:     make(map[[32]byte]struct{}),
+		cacheSize: cacheSize,
+	}
+}
+
+// cacheKey binds the public key, hash and signature of a check
+func cacheKey(check SigCheck) [32]byte {
+	h := sha256.New()
+	for _, field := range [][]byte{check.PublicKey, check.Hash, check.Signature} {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(field)))
+		h.Write(size[:])
+		h.Write(field)
+	}
+	var key [32]byte
+	copy(key[:], h.Sum(nil))
+	return key
+}
+
+// cached checks if a signature was already verified
+func (v *Verifier) cached(key [32]byte) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	_, ok := v.cache[key]
+	return ok
+}
+
+// remember caches a verified signature, evicting the oldest one if full
+func (v *Verifier) remember(key [32]byte) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if _, ok := v.cache[key]; ok || v.cacheSize <= 0 {
+		return
+	}
+	if len(v.order) >= v.cacheSize {
+		delete(v.cache, v.order[0])
+		v.order = v.order[1:]
+	}
+	v.cache[key] = struct{}{}
+	v.order = append(v.order, key)
+}
+
+// Verify verifies a single signature on the calling goroutine
+func (v *Verifier) Verify(publicKey PublicKey, hash []byte, signature []byte) bool {
+	check := SigCheck{PublicKey: publicKey, Hash: hash, Signature: signature}
+	key := cacheKey(check)
+	if v.cached(key) {
+		return true
+	}
+	if !Verify(publicKey, hash, signature) {
+		return false
+	}
+	v.remember(key)
+	return true
+}
+
+// work verifies jobs until the verifier is dropped
+func (v *Verifier) work() {
+	for job := range v.jobs {
+		job.result <- v.Verify(job.check.PublicKey, job.check.Hash, job.check.Signature)
+	}
+}
+
+// VerifyBatch verifies the signatures concurrently, it returns true
+// only if all of them are valid
+func (v *Verifier) VerifyBatch(checks []SigCheck) bool {
+	if len(checks) == 0 {
+		return true
+	}
+	if len(checks) == 1 {
+		return v.Verify(checks[0].PublicKey, checks[0].Hash, checks[0].Signature)
+	}
+	v.start.Do(func() {
+		for range v.workers {
+			go v.work()
+		}
+	})
+	results := make(chan bool, len(checks))
+	go func() {
+		for _, check := range checks {
+			v.jobs <- verifyJob{check: check, result: results}
+		}
+	}()
+	valid := true
+	for range checks {
+		if !<-results {
+			valid = false
+		}
+	}
+	return valid
+}
+
+// CacheLen returns the number of cached signatures
+func (v *Verifier) CacheLen() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.cache)
+}
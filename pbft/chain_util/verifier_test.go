@@ -0,0 +1,45 @@
+package chain_util
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestVerifier_VerifyBatch(t *testing.T) {
+	v := NewVerifier(4, 16)
+	checks := make([]SigCheck, 0, 8)
+	for i := range 8 {
+		privateKey, publicKey := GenKeypair("secret-" + strconv.Itoa(i))
+		hash := Hash("data-" + strconv.Itoa(i))
+		checks = append(checks, SigCheck{PublicKey: publicKey, Hash: hash, Signature: Sign(privateKey, hash)})
+	}
+	if !v.VerifyBatch(checks) {
+		t.Errorf("VerifyBatch should accept valid signatures")
+	}
+	if v.CacheLen() != 8 {
+		t.Errorf("VerifyBatch should cache valid signatures, got %d", v.CacheLen())
+	}
+	forged := append([]SigCheck(nil), checks...)
+	forged[3].Hash = Hash("forged")
+	if v.VerifyBatch(forged) {
+		t.Errorf("VerifyBatch should reject a batch holding a forged signature")
+	}
+	if v.CacheLen() != 8 {
+		t.Errorf("VerifyBatch should not cache invalid signatures")
+	}
+	if v.Verify(PublicKey("short"), checks[0].Hash, checks[0].Signature) {
+		t.Errorf("Verify should reject a malformed public key")
+	}
+}
+
+func TestVerifier_CacheBound(t *testing.T) {
+	v := NewVerifier(1, 2)
+	for i := range 3 {
+		privateKey, publicKey := GenKeypair("secret-" + strconv.Itoa(i))
+		hash := Hash("data")
+		v.Verify(publicKey, hash, Sign(privateKey, hash))
+	}
+	if v.CacheLen() != 2 {
+		t.Errorf("cache should be bounded to 2, got %d", v.CacheLen())
+	}
+}
@@ -0,0 +1,163 @@
+package client
+
+import (
+	"bytes"
+	"consensus-algorithms-with-golang/pbft"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+Client implements the client side of the PBFT request/reply protocol.
+It signs a tx with its own wallet (a client identity, not a validator
+one), submits it to one replica, then polls every replica for its
+signed REPLY and returns as soon as f+1 distinct validators agree on
+the same (height, result), which guarantees at least one honest
+replica executed the tx with that outcome.
+It features the following methods:
+1. NewClient
+2. SyncNonce
+3. Submit
+4. WaitForReplies
+5. SubmitAndWait
+*/
+
+const pollInterval = 200 * time.Millisecond
+
+type Client struct {
+	nodes      []string // http addresses, e.g. "http://localhost:18080"
+	validators pbft.Validators
+	wallet     *pbft.Wallet
+	client     *http.Client
+}
+
+// NewClient creates a client signing txs with given wallet and talking
+// to the given replicas
+func NewClient(nodes []string, validators pbft.Validators, wallet *pbft.Wallet) *Client {
+	return &Client{
+		nodes:      nodes,
+		validators: validators,
+		wallet:     wallet,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// SyncNonce sets the wallet's nonce to the sender's last nonce
+// executed on the chain, as reported by the first reachable replica
+func (c *Client) SyncNonce() error {
+	var lastErr error
+	for _, node := range c.nodes {
+		resp, err := c.client.Get(node + "/nonce/" + chain_util.BytesToHex(c.wallet.PublicKey()))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var account pbft.AccountNonce
+		err = json.NewDecoder(resp.Body).Decode(&account)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.wallet.SetNonce(account.Nonce)
+		return nil
+	}
+	return fmt.Errorf("sync nonce failed, %v", lastErr)
+}
+
+// Submit signs a tx with given data and posts it to the first replica
+// that accepts it
+func (c *Client) Submit(data string) (*pbft.Transaction, error) {
+	tx := c.wallet.CreateTx(data)
+	if tx == nil {
+		return nil, fmt.Errorf("sign tx failed")
+	}
+	body, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, node := range c.nodes {
+		resp, err := c.client.Post(node+"/tx", "application/json", bytes.NewReader(body))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		msg, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusAccepted {
+			lastErr = fmt.Errorf("node [%s] answered %s, %s", node, resp.Status, strings.TrimSpace(string(msg)))
+			continue
+		}
+		return tx, nil
+	}
+	return nil, fmt.Errorf("submit tx failed, %v", lastErr)
+}
+
+// WaitForReplies blocks until f+1 matching replies for the tx are
+// collected or the timeout expires
+func (c *Client) WaitForReplies(txId string, timeout time.Duration) (*pbft.Reply, error) {
+	needed := c.validators.MaxFaulty() + 1
+	replies := make(map[string]pbft.Reply) // replica's public key -> reply
+	deadline := time.Now().Add(timeout)
+	for {
+		for _, node := range c.nodes {
+			reply, ok := c.fetchReply(node, txId)
+			if !ok {
+				continue
+			}
+			replies[chain_util.BytesToHex(reply.PublicKey)] = *reply
+		}
+		// count matching outcomes
+		votes := make(map[string]int)
+		for _, reply := range replies {
+			outcome := strconv.FormatUint(reply.Height, 10) + "/" + reply.Result
+			votes[outcome]++
+			if votes[outcome] >= needed {
+				return &reply, nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("tx [%s] got %d replies, %d matching needed", txId, len(replies), needed)
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// SubmitAndWait submits a tx and waits for its outcome
+func (c *Client) SubmitAndWait(data string, timeout time.Duration) (*pbft.Transaction, *pbft.Reply, error) {
+	tx, err := c.Submit(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	reply, err := c.WaitForReplies(tx.Id, timeout)
+	return tx, reply, err
+}
+
+// fetchReply fetches and verifies one replica's reply
+func (c *Client) fetchReply(node string, txId string) (*pbft.Reply, bool) {
+	resp, err := c.client.Get(node + "/reply/" + txId)
+	if err != nil {
+		return nil, false
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, false
+	}
+	var reply pbft.Reply
+	if err := json.NewDecoder(resp.Body).Decode(&reply); err != nil {
+		return nil, false
+	}
+	if reply.TxId != txId ||
+		!c.validators.ValidatorExists(reply.PublicKey) ||
+		!pbft.VerifyReply(reply) {
+		return nil, false
+	}
+	return &reply, true
+}
@@ -0,0 +1,105 @@
+package client
+
+import (
+	"consensus-algorithms-with-golang/pbft"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newReplica serves the reply of one replica
+func newReplica(reply *pbft.Reply) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /reply/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if reply == nil || reply.TxId != r.PathValue("id") {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(reply)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestClient_WaitForReplies(t *testing.T) {
+	// 4 replicas tolerate f=1 faulty one
+	wallets := make([]*pbft.Wallet, 4)
+	keys := make([]pbft.PublicKey, 4)
+	for i := range wallets {
+		wallets[i] = pbft.NewWallet("NODE-" + strconv.Itoa(i))
+		keys[i] = wallets[i].PublicKey()
+	}
+	validators := pbft.NewValidatorsFromKeys(keys)
+	nodes := make([]string, 0, len(wallets))
+	for i, w := range wallets {
+		result := pbft.TxResultOK
+		if i == 0 {
+			result = "LIE" // a single faulty replica cannot decide the outcome
+		}
+		server := newReplica(w.CreateReply("tx-1", 1, result))
+		defer server.Close()
+		nodes = append(nodes, server.URL)
+	}
+
+	c := NewClient(nodes, *validators, pbft.NewWallet("client"))
+	reply, err := c.WaitForReplies("tx-1", time.Second)
+	if err != nil || reply.Result != pbft.TxResultOK || reply.Height != 1 {
+		t.Errorf("WaitForReplies failed, %v", err)
+	}
+	if _, err = c.WaitForReplies("tx-2", 300*time.Millisecond); err == nil {
+		t.Errorf("WaitForReplies should time out without replies")
+	}
+}
+
+func TestClient_Submit(t *testing.T) {
+	var received pbft.Transaction
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /tx", func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&received)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wallet := pbft.NewWallet("client")
+	c := NewClient([]string{server.URL}, *pbft.NewValidators(pbft.NUM_OF_NODES), wallet)
+	tx, err := c.Submit("key=value")
+	if err != nil {
+		t.Fatalf("Submit failed, %v", err)
+	}
+	if received.Id != tx.Id || !received.VerifyTx() ||
+		chain_util.BytesToHex(received.From) != chain_util.BytesToHex(wallet.PublicKey()) {
+		t.Errorf("Submit should post the tx signed by the client's wallet")
+	}
+}
+
+func TestClient_IgnoresForgedReplies(t *testing.T) {
+	validators := pbft.NewValidators(pbft.NUM_OF_NODES)
+	outsider := pbft.NewWallet("outsider")
+	nodes := make([]string, 0, pbft.NUM_OF_NODES)
+	for range pbft.NUM_OF_NODES {
+		server := newReplica(outsider.CreateReply("tx-1", 1, pbft.TxResultOK))
+		defer server.Close()
+		nodes = append(nodes, server.URL)
+	}
+
+	c := NewClient(nodes, *validators, pbft.NewWallet("client"))
+	if _, err := c.WaitForReplies("tx-1", 300*time.Millisecond); err == nil {
+		t.Errorf("WaitForReplies should ignore replies from non-validators")
+	}
+}
+
+func TestHashReply_Domain(t *testing.T) {
+	// a client-chosen tx id must not make a reply the digest of a vote
+	hash := chain_util.Hash("block")
+	txId := pbft.MsgCommit + chain_util.BytesToHex(hash)
+	if chain_util.Equal(pbft.HashReply(txId, 1, "0"), pbft.HashMsg(pbft.MsgCommit, hash, 1, 0)) {
+		t.Errorf("a reply shares the digest of a vote")
+	}
+	if chain_util.Equal(pbft.HashReply("tx", 1, "23"), pbft.HashReply("tx1", 2, "3")) {
+		t.Errorf("replies of different txs and heights share a digest")
+	}
+}
@@ -0,0 +1,40 @@
+package pbft
+
+import "consensus-algorithms-with-golang/pbft/chain_util"
+
+/**
+Clients is the registry of identities allowed to submit txs. It is
+kept apart from the validators on purpose: a validator key signs
+consensus messages (PRE-PREPARE, PREPARE, COMMIT, ...) while a client
+key signs txs, and holding one does not grant the other.
+In open mode any well-signed tx is accepted, otherwise only the
+registered client keys may submit txs.
+It features the following methods:
+1. NewClients
+2. ClientAllowed
+*/
+
+type Clients struct {
+	open  bool
+	index map[chain_util.Key]struct{}
+}
+
+// NewClients creates a client registry, open registries accept any key
+func NewClients(open bool, keys []PublicKey) *Clients {
+	cs := &Clients{open: open, index: make(map[chain_util.Key]struct{})}
+	for _, key := range keys {
+		cs.index[chain_util.KeyOf(key)] = struct{}{}
+	}
+	return cs
+}
+
+// ClientAllowed checks if a key may submit txs
+func (cs *Clients) ClientAllowed(client PublicKey) bool {
+	return cs.open || cs.clientExists(client)
+}
+
+// clientExists checks if a key is registered
+func (cs *Clients) clientExists(client PublicKey) bool {
+	_, ok := cs.index[chain_util.KeyOf(client)]
+	return ok
+}
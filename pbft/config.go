@@ -1,7 +1,99 @@
 package pbft
 
+import "time"
+
 const (
-	TX_THRESHOLD  = 3
-	NUM_OF_NODES  = 3
-	MIN_APPROVALS = 2*(NUM_OF_NODES/3) + 1
+	TX_THRESHOLD = 3
+	NUM_OF_NODES = 3
+
+	REPLY_CACHE_SIZE = 1024
+	MAX_TX_BYTES     = 64 * 1024
+
+	MEMPOOL_MAX_TXS        = 5000
+	MEMPOOL_MAX_BYTES      = 16 * 1024 * 1024
+	MEMPOOL_MAX_PER_SENDER = 100
+	MEMPOOL_TX_TTL         = 10 * time.Minute
+	MEMPOOL_EVICTION       = EvictLowestPriority
+
+	BATCH_MAX_BYTES = 1024 * 1024
+	BATCH_MAX_WAIT  = 2 * time.Second
+	BATCH_TICK      = 200 * time.Millisecond
+	// an empty block is proposed after this long without any block,
+	// 0 disables heartbeat blocks
+	HEARTBEAT_INTERVAL = 0 * time.Second
+
+	// a backup asks for a view change if the primary does not commit
+	// a client request within this timeout
+	REQUEST_TIMEOUT = 10 * time.Second
+
+	// votes that arrive ahead of their block, height or view are
+	// buffered up to these bounds, and dropped beyond the watermarks
+	FUTURE_BUFFER_SIZE          = 1024
+	FUTURE_BUFFER_PER_VALIDATOR = 128
+	FUTURE_HEIGHT_WATERMARK     = 10
+	FUTURE_VIEW_WATERMARK       = 3
+
+	// a missing block is requested again if no valid response
+	// arrives within this timeout
+	BLOCK_REQUEST_TIMEOUT = 5 * time.Second
+
+	// the primary may propose up to this many blocks ahead of the
+	// latest committed one, 1 disables pipelining
+	PIPELINE_DEPTH = 4
+
+	// signature verification workers, 0 runs one per CPU, and the
+	// number of verified signatures remembered
+	SIG_VERIFY_WORKERS = 0
+	SIG_CACHE_SIZE     = 16384
+
+	// committed blocks keep their PREPARE votes for this many blocks,
+	// 0 keeps them forever. COMMIT votes are always kept.
+	VOTE_RETENTION = 128
+
+	// state versions kept for queries at past heights, 0 keeps them
+	// forever. The latest version is always kept.
+	STATE_VERSIONS = 1024
+
+	// blocks of another chain are rejected, and so are blocks
+	// timestamped further than this ahead of the local clock, block
+	// timestamps are unix nanoseconds strictly above the parent's
+	CHAIN_ID        = "pbft-devnet"
+	MAX_CLOCK_DRIFT = 10 * time.Second
+
+	// proposer election strategy, one of "round-robin", "weighted",
+	// "beacon" and "reputation", see election.go
+	PROPOSER_ELECTION = ElectionRoundRobin
+
+	// number of blocks the reputation election scores validators over
+	REPUTATION_WINDOW = 16
+	// one window in REPUTATION_EXPLORE is given to any validator by the
+	// reputation election, whatever its score
+	REPUTATION_EXPLORE = 4
+
+	// validator set changes take effect at epoch boundaries, an epoch
+	// must be a multiple of PIPELINE_DEPTH heights
+	EPOCH_LENGTH = 16
+
+	// bounds on voting powers, they keep the total power of a set and
+	// its quorum from overflowing
+	MAX_VALIDATOR_POWER = 1 << 32
+	MAX_TOTAL_POWER     = 1 << 48
+
+	// environment variable holding the hex seed of the node's private
+	// key, when no key file is given
+	PRIVATE_KEY_ENV = "PBFT_PRIVATE_KEY"
+
+	// environment variable holding the passphrase of the node's
+	// keystore, when no passphrase file is given
+	KEYSTORE_PASSPHRASE_ENV = "PBFT_KEYSTORE_PASSPHRASE"
+
+	// PBKDF2 iterations deriving the key of a new keystore, it makes
+	// guessing a passphrase slow
+	KEYSTORE_KDF_ITERATIONS = 600000
+
+	// a remote signer remembers the votes it signed at this many of the
+	// latest heights and refuses to sign below them
+	SIGNER_STATE_HEIGHTS = 1024
+	// time to wait for a remote signer's response
+	SIGNER_TIMEOUT = 5 * time.Second
 )
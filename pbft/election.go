@@ -0,0 +1,243 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/binary"
+	"log"
+	"sort"
+	"strings"
+)
+
+/**
+ProposerElection elects the proposer of a window of heights, see
+pipeline.go. Every strategy is deterministic, so all honest nodes
+elect the same proposer, and none depends on the content of a block,
+so a proposer cannot grind its block to pick the next leader.
+The strategy is selected by PROPOSER_ELECTION:
+- "round-robin": validators take turns in list order, shifted by the
+  window and the view
+- "weighted": like round robin, but each validator takes as many
+  turns as its voting power, a view change passes the turn to the
+  next validator rather than to the next turn
+- "beacon": the turn is drawn from the anchor's random beacon, shifted
+  by the view. The beacon of a block hashes the parent's beacon with
+  the sorted signatures of the COMMITs in the block's last commit, see
+  BeaconFrom. The proposer does not sign anything for it: it can only
+  choose which of the COMMITs it received to include, and only valid
+  COMMITs of distinct validators may be included. P-256 signatures are
+  randomized, a P-256 validator could sign its COMMIT again and again
+  until the beacon suits it, so only COMMITs of ed25519 keys, whose
+  signatures are deterministic, feed the beacon. The beacon is not a
+  VRF output, a proposer colluding with voters can still pick among a
+  few beacons.
+- "reputation": validators are scored over the last REPUTATION_WINDOW
+  blocks up to the anchor, one point per block proposed and one per
+  COMMIT vote in the blocks' last commits. The best scored validators
+  holding a quorum of the power take turns, like round robin, so a
+  validator that is slow to vote or fails to propose loses its turns.
+  Last commits are part of the blocks, so every node gets the same
+  scores. One window in REPUTATION_EXPLORE goes round robin over the
+  whole set: a validator left out, e.g. whose COMMITs a proposer keeps
+  out of its last commit, still gets turns to propose and score.
+It features the following methods:
+1. NewProposerElection
+2. ElectProposer
+3. Elect
+4. BeaconFrom
+5. VerifyBeacon
+6. HistoryLen
+*/
+
+const (
+	ElectionRoundRobin = "round-robin"
+	ElectionWeighted   = "weighted"
+	ElectionBeacon     = "beacon"
+	ElectionReputation = "reputation"
+)
+
+// ElectionRound is what a proposer is elected from
+type ElectionRound struct {
+	Window uint64      // index of the window of heights
+	View   uint64      // current view
+	Anchor BlockHeader // header of the block just before the window
+	// the latest blocks up to the anchor, newest first, for strategies
+	// implementing historyElection
+	History []Block
+}
+
+type ProposerElection interface {
+	Elect(vs Validators, round ElectionRound) PublicKey
+}
+
+// historyElection is implemented by strategies electing from the
+// blocks before the window
+type historyElection interface {
+	HistoryLen() uint64
+}
+
+type roundRobinElection struct{}
+
+type weightedElection struct{}
+
+type beaconElection struct{}
+
+type reputationElection struct {
+	window  uint64 // number of blocks scored
+	explore uint64 // one window in explore is open to every validator
+}
+
+// NewProposerElection returns the election strategy with given name
+func NewProposerElection(name string) (ProposerElection, bool) {
+	switch name {
+	case ElectionRoundRobin:
+		return roundRobinElection{}, true
+	case ElectionWeighted:
+		return weightedElection{}, true
+	case ElectionBeacon:
+		return beaconElection{}, true
+	case ElectionReputation:
+		return reputationElection{window: REPUTATION_WINDOW, explore: REPUTATION_EXPLORE}, true
+	default:
+		log.Printf("Unknown proposer election [%s]\n", name)
+		return nil, false
+	}
+}
+
+// ElectProposer elects the proposer of the block at given height in
+// given view, from the blocks before it. blockAt returns the block at
+// a lower height on the block's branch, only its header and last
+// commit are used, so a light client can elect from the signed
+// headers it verified. See pipeline.go for the windows.
+func ElectProposer(election ProposerElection, vs Validators, depth, height, view uint64, blockAt func(uint64) (Block, bool)) (PublicKey, bool) {
+	parentHeight := height - 1
+	anchorHeight := parentHeight - parentHeight%depth
+	anchor, ok := blockAt(anchorHeight)
+	if !ok {
+		return nil, false
+	}
+	round := ElectionRound{
+		Window: anchorHeight / depth,
+		View:   view,
+		Anchor: anchor.BlockHeader,
+	}
+	if he, ok := election.(historyElection); ok {
+		// the genesis block is not scored
+		for h := anchorHeight; h > 0 && uint64(len(round.History)) < he.HistoryLen(); h-- {
+			block, ok := blockAt(h)
+			if !ok {
+				break
+			}
+			round.History = append(round.History, block)
+		}
+	}
+	return election.Elect(vs, round), true
+}
+
+// Elect gives the turn to the next validator in list order
+func (roundRobinElection) Elect(vs Validators, round ElectionRound) PublicKey {
+	return vs.list[(round.Window+round.View)%uint64(len(vs.list))]
+}
+
+// Elect gives each validator as many consecutive turns as its power,
+// each view change passes the turn to the next validator with power
+func (weightedElection) Elect(vs Validators, round ElectionRound) PublicKey {
+	total := vs.TotalPower()
+	if total == 0 {
+		return roundRobinElection{}.Elect(vs, round)
+	}
+	slot := round.Window % total
+	elected := 0
+	for i, power := range vs.powers {
+		if slot < power {
+			elected = i
+			break
+		}
+		slot -= power
+	}
+	weighted := 0
+	for _, power := range vs.powers {
+		if power > 0 {
+			weighted++
+		}
+	}
+	for skip := round.View % uint64(weighted); skip > 0; skip-- {
+		elected = (elected + 1) % len(vs.list)
+		for vs.powers[elected] == 0 {
+			elected = (elected + 1) % len(vs.list)
+		}
+	}
+	return vs.list[elected]
+}
+
+// Elect draws the turn from the anchor's beacon
+func (beaconElection) Elect(vs Validators, round ElectionRound) PublicKey {
+	seed := binary.BigEndian.Uint64(chain_util.Hash(chain_util.BytesToHex(round.Anchor.Beacon)))
+	return vs.list[(seed%uint64(len(vs.list))+round.View)%uint64(len(vs.list))]
+}
+
+// Elect gives the turn to the next of the best scored validators,
+// except in exploration windows which are open to every validator
+func (re reputationElection) Elect(vs Validators, round ElectionRound) PublicKey {
+	if len(round.History) == 0 {
+		return roundRobinElection{}.Elect(vs, round)
+	}
+	if re.explore > 0 && round.Window%re.explore == 0 {
+		return roundRobinElection{}.Elect(vs, ElectionRound{Window: round.Window / re.explore, View: round.View})
+	}
+	scores := make(map[chain_util.Key]int, len(vs.list))
+	for _, block := range round.History {
+		scores[chain_util.KeyOf(block.Proposer)]++
+		voters := make(map[chain_util.Key]bool, len(block.LastCommit))
+		for _, msg := range block.LastCommit {
+			voter := chain_util.KeyOf(msg.PublicKey)
+			if !voters[voter] {
+				voters[voter] = true
+				scores[voter]++
+			}
+		}
+	}
+	ranked := make([]int, len(vs.list))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(a, b int) bool {
+		return scores[chain_util.KeyOf(vs.list[ranked[a]])] > scores[chain_util.KeyOf(vs.list[ranked[b]])]
+	})
+	// the best scored validators holding a quorum of the power
+	var candidates []int
+	power := uint64(0)
+	for _, i := range ranked {
+		if power >= vs.QuorumPower() {
+			break
+		}
+		candidates = append(candidates, i)
+		power += vs.powers[i]
+	}
+	sort.Ints(candidates)
+	return vs.list[candidates[(round.Window+round.View)%uint64(len(candidates))]]
+}
+
+// HistoryLen returns the number of blocks scored
+func (re reputationElection) HistoryLen() uint64 {
+	return re.window
+}
+
+// BeaconFrom returns the beacon of a block chaining on a parent with
+// given beacon and carrying given last commit, only the COMMITs of keys
+// with unique signatures feed it
+func BeaconFrom(parentBeacon []byte, lastCommit []Message) []byte {
+	signatures := make([]string, 0, len(lastCommit))
+	for _, msg := range lastCommit {
+		if scheme, ok := chain_util.SchemeOf(msg.PublicKey.Type()); ok && scheme.UniqueSignatures() {
+			signatures = append(signatures, chain_util.BytesToHex(msg.Signature))
+		}
+	}
+	sort.Strings(signatures)
+	return chain_util.Hash("BEACON/" + chain_util.BytesToHex(parentBeacon) + "/" + strings.Join(signatures, "/"))
+}
+
+// VerifyBeacon checks that a block's beacon derives from its parent's
+// beacon and its last commit
+func VerifyBeacon(block Block, parent BlockHeader) bool {
+	return chain_util.Equal(block.Beacon, BeaconFrom(parent.Beacon, block.LastCommit))
+}
@@ -0,0 +1,191 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"testing"
+)
+
+func TestProposerElection_RoundRobin(t *testing.T) {
+	vs := NewValidators(5)
+	election, _ := NewProposerElection(ElectionRoundRobin)
+	turns := make(map[string]int)
+	for window := range uint64(10) {
+		turns[string(election.Elect(*vs, ElectionRound{Window: window}))]++
+	}
+	for _, pubKey := range vs.list {
+		if turns[string(pubKey)] != 2 {
+			t.Errorf("round robin should give every validator 2 turns, got %d", turns[string(pubKey)])
+		}
+	}
+	round := ElectionRound{Window: 3}
+	next := ElectionRound{Window: 3, View: 1}
+	if chain_util.Equal(election.Elect(*vs, round), election.Elect(*vs, next)) {
+		t.Errorf("a view change should elect another proposer")
+	}
+}
+
+func TestProposerElection_Weighted(t *testing.T) {
+	vs := NewWeightedValidators(NewValidators(3).list, []uint64{1, 3, 0})
+	election, _ := NewProposerElection(ElectionWeighted)
+	turns := make(map[string]int)
+	for window := range uint64(8) {
+		turns[string(election.Elect(*vs, ElectionRound{Window: window}))]++
+	}
+	for i, pubKey := range vs.list {
+		if turns[string(pubKey)] != 2*int(vs.Power(i)) {
+			t.Errorf("validator %d should take turns by power, got %d", i, turns[string(pubKey)])
+		}
+	}
+	// a view change elects another validator, even one with many turns
+	for window := range uint64(4) {
+		first := election.Elect(*vs, ElectionRound{Window: window})
+		next := election.Elect(*vs, ElectionRound{Window: window, View: 1})
+		if chain_util.Equal(first, next) || vs.PowerOf(next) == 0 {
+			t.Errorf("a view change should elect the next validator with power, window %d", window)
+		}
+		if again := election.Elect(*vs, ElectionRound{Window: window, View: 2}); !chain_util.Equal(first, again) {
+			t.Errorf("two view changes should cycle back with 2 validators with power, window %d", window)
+		}
+	}
+}
+
+func TestProposerElection_Beacon(t *testing.T) {
+	if _, ok := NewProposerElection("unknown"); ok {
+		t.Errorf("NewProposerElection should reject an unknown strategy")
+	}
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	election, _ := NewProposerElection(ElectionBeacon)
+	bc.SetElection(election)
+	bc.depth = 1
+	for range 4 {
+		block := bc.CreateBlock(proposerWallet(bc), nil)
+		if !VerifyBeacon(*block, bc.chain[bc.Height()].BlockHeader) {
+			t.Fatalf("VerifyBeacon should accept the block's beacon")
+		}
+		forged := *block
+		forged.Beacon = BeaconFrom([]byte("other"), block.LastCommit)
+		if VerifyBeacon(forged, bc.chain[bc.Height()].BlockHeader) {
+			t.Errorf("VerifyBeacon should reject a beacon over another parent")
+		}
+		blockPool, preparePool, commitPool := NewBlockPool(), NewMsgPool(), NewMsgPool()
+		blockPool.AddBlock2Pool(*block)
+		for i := range NUM_OF_NODES {
+			commitPool.AddMsg2Pool(*NewWallet("NODE-"+strconv.Itoa(i)).CreateMsg(MsgCommit, block.Hash, block.Height, 0))
+		}
+		if _, ok := bc.AddUpdatedBlock2Chain(block.Hash, *blockPool, *preparePool, *commitPool); !ok {
+			t.Fatal("AddUpdatedBlock2Chain failed")
+		}
+	}
+	// the beacon depends on the last commit, neither on the block
+	// content nor on the proposer
+	w := proposerWallet(bc)
+	first := bc.CreateBlock(w, nil)
+	bc.inflight = make(map[chain_util.Key]*inflightBlock)
+	second := bc.CreateBlock(w, []Transaction{*w.CreateTx("data")})
+	if chain_util.Equal(first.Hash, second.Hash) || !chain_util.Equal(first.Beacon, second.Beacon) {
+		t.Errorf("the beacon should only depend on the parent and the last commit")
+	}
+	if chain_util.Equal(BeaconFrom(first.Beacon, first.LastCommit), BeaconFrom(first.Beacon, first.LastCommit[1:])) {
+		t.Errorf("the beacon should depend on the COMMITs carried")
+	}
+	reversed := make([]Message, len(first.LastCommit))
+	for i, msg := range first.LastCommit {
+		reversed[len(reversed)-1-i] = msg
+	}
+	if !chain_util.Equal(first.Beacon, BeaconFrom(bc.chain[bc.Height()].Beacon, reversed)) {
+		t.Errorf("the beacon should not depend on the order of the COMMITs")
+	}
+}
+
+func TestProposerElection_Reputation(t *testing.T) {
+	vs := NewValidators(4)
+	election, _ := NewProposerElection(ElectionReputation)
+	if election.(historyElection).HistoryLen() != REPUTATION_WINDOW {
+		t.Errorf("the reputation election should score REPUTATION_WINDOW blocks")
+	}
+	// validator 3 votes but never proposes, validator 2 proposes once
+	// but its votes are left out of the last commits
+	history := make([]Block, 0, 3)
+	for proposer := range 3 {
+		block := Block{}
+		block.Proposer = vs.list[proposer]
+		for _, i := range []int{0, 1, 3} {
+			block.LastCommit = append(block.LastCommit, *NewWallet("NODE-"+strconv.Itoa(i)).CreateMsg(MsgCommit, []byte("hash"), 1, 0))
+		}
+		history = append(history, block)
+	}
+	elected := make(map[string]bool)
+	for window := range uint64(8) {
+		if window%REPUTATION_EXPLORE == 0 {
+			continue
+		}
+		elected[string(election.Elect(*vs, ElectionRound{Window: window, History: history}))] = true
+	}
+	if len(elected) != 3 || elected[string(vs.list[2])] {
+		t.Errorf("only the best scored validators should be elected, got %d", len(elected))
+	}
+	// exploration windows give every validator a turn eventually
+	elected = make(map[string]bool)
+	for window := range uint64(len(vs.list)) * REPUTATION_EXPLORE {
+		elected[string(election.Elect(*vs, ElectionRound{Window: window, History: history}))] = true
+	}
+	if len(elected) != len(vs.list) {
+		t.Errorf("every validator should eventually be elected, got %d", len(elected))
+	}
+	// the candidates hold a quorum of the power, not of the validators
+	weighted := NewWeightedValidators(vs.list, []uint64{10, 1, 1, 1})
+	elected = make(map[string]bool)
+	for window := range uint64(8) {
+		if window%REPUTATION_EXPLORE == 0 {
+			continue
+		}
+		elected[string(election.Elect(*weighted, ElectionRound{Window: window, History: history[:1]}))] = true
+	}
+	if len(elected) != 1 || !elected[string(vs.list[0])] {
+		t.Errorf("the heavy validator alone holds a quorum of the power, got %d elected", len(elected))
+	}
+	elected = make(map[string]bool)
+	for window := range uint64(4) {
+		elected[string(election.Elect(*vs, ElectionRound{Window: window}))] = true
+	}
+	if len(elected) != 4 {
+		t.Errorf("every validator should be elected without history, got %d", len(elected))
+	}
+}
+
+func TestBlockchain_LastCommit(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	bc.depth = 1
+	w := proposerWallet(bc)
+	block := bc.CreateBlock(w, nil)
+	if len(block.LastCommit) != 0 || !bc.verifyLastCommit(*block) {
+		t.Errorf("the first block should carry no last commit")
+	}
+	blockPool, preparePool, commitPool := NewBlockPool(), NewMsgPool(), NewMsgPool()
+	blockPool.AddBlock2Pool(*block)
+	for i := range NUM_OF_NODES {
+		commitPool.AddMsg2Pool(*NewWallet("NODE-"+strconv.Itoa(i)).CreateMsg(MsgCommit, block.Hash, 1, 0))
+	}
+	bc.AddUpdatedBlock2Chain(block.Hash, *blockPool, *preparePool, *commitPool)
+
+	next := bc.CreateBlock(proposerWallet(bc), nil)
+	if len(next.LastCommit) != NUM_OF_NODES || !bc.VerifyBlock(*next) {
+		t.Fatalf("the next block should carry the parent's commit quorum")
+	}
+	forged := *next
+	forged.LastCommit = forged.LastCommit[:bc.ValidatorsAt(1).Quorum()-1]
+	if bc.verifyLastCommit(forged) {
+		t.Errorf("verifyLastCommit should reject a last commit without quorum")
+	}
+	if VerifyBlock(forged) {
+		t.Errorf("VerifyBlock should reject a last commit not matching its hash")
+	}
+	// anything but distinct valid COMMITs would let the proposer grind
+	// the beacon
+	padded := *next
+	padded.LastCommit = append(append([]Message(nil), next.LastCommit...), next.LastCommit[0])
+	if bc.verifyLastCommit(padded) {
+		t.Errorf("verifyLastCommit should reject a repeated COMMIT")
+	}
+}
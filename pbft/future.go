@@ -0,0 +1,152 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"log"
+)
+
+/**
+FutureBuffer holds PREPARE and COMMIT votes that arrived before they
+can be counted: their block has not reached the block pool yet, or
+they belong to a later height or view than the node is at. Votes are
+kept by height and replayed once the node catches up, votes of a
+committed height or an abandoned view are dropped.
+
+The buffer is bounded in total and per validator, and the node drops
+votes beyond its high watermark before they reach the buffer, so a
+faulty validator cannot fill it with votes for far future heights.
+It features the following methods:
+1. NewFutureBuffer
+2. AddMsg2Buffer
+3. TakeReady
+4. Voters
+5. Prune
+6. Len
+*/
+
+// bufferedMsg keeps the raw message to replay it as received
+type bufferedMsg struct {
+	msg Message
+	raw []byte
+}
+
+type FutureBuffer struct {
+	mapPool      map[uint64][]bufferedMsg // height -> buffered votes
+	perSender    map[chain_util.Key]int
+	size         int
+	maxSize      int
+	maxPerSender int
+}
+
+// NewFutureBuffer creates a future-message buffer bounded by config.go
+func NewFutureBuffer() *FutureBuffer {
+	return &FutureBuffer{
+		mapPool:      make(map[uint64][]bufferedMsg),
+		perSender:    make(map[chain_util.Key]int),
+		maxSize:      FUTURE_BUFFER_SIZE,
+		maxPerSender: FUTURE_BUFFER_PER_VALIDATOR,
+	}
+}
+
+// AddMsg2Buffer buffers a vote, it returns false if the vote is
+// already buffered or the buffer is full
+func (fb *FutureBuffer) AddMsg2Buffer(raw []byte, msg Message) bool {
+	sender := chain_util.KeyOf(msg.PublicKey)
+	for _, b := range fb.mapPool[msg.Height] {
+		if b.msg.MsgType == msg.MsgType &&
+			b.msg.View == msg.View &&
+			chain_util.Equal(b.msg.BlockHash, msg.BlockHash) &&
+			chain_util.Equal(b.msg.PublicKey, msg.PublicKey) {
+			return false
+		}
+	}
+	if fb.size >= fb.maxSize || fb.perSender[sender] >= fb.maxPerSender {
+		log.Printf("Future buffer full, dropped %s from [%s]\n", msg.MsgType, chain_util.BytesToHex(msg.PublicKey)[:6])
+		return false
+	}
+	fb.mapPool[msg.Height] = append(fb.mapPool[msg.Height], bufferedMsg{msg: msg, raw: raw})
+	fb.perSender[sender]++
+	fb.size++
+	log.Printf("Buffered %s for height %d view %d from [%s]\n", msg.MsgType, msg.Height, msg.View, chain_util.BytesToHex(msg.PublicKey)[:6])
+	return true
+}
+
+// TakeReady removes the buffered votes of given height that are ready
+// to be counted and returns them as received
+func (fb *FutureBuffer) TakeReady(height uint64, ready func(Message) bool) [][]byte {
+	var taken [][]byte
+	kept := fb.mapPool[height][:0]
+	for _, b := range fb.mapPool[height] {
+		if ready(b.msg) {
+			taken = append(taken, b.raw)
+			fb.release(b.msg)
+			continue
+		}
+		kept = append(kept, b)
+	}
+	if len(kept) == 0 {
+		delete(fb.mapPool, height)
+	} else {
+		fb.mapPool[height] = kept
+	}
+	return taken
+}
+
+// Voters returns the senders of the buffered votes of the same phase,
+// height, view and block as the given one
+func (fb *FutureBuffer) Voters(msg Message) []PublicKey {
+	var voters []PublicKey
+	for _, b := range fb.mapPool[msg.Height] {
+		if b.msg.MsgType == msg.MsgType &&
+			b.msg.View == msg.View &&
+			chain_util.Equal(b.msg.BlockHash, msg.BlockHash) {
+			voters = append(voters, b.msg.PublicKey)
+		}
+	}
+	return voters
+}
+
+// Prune drops the votes of committed heights and of views before
+// the current one, it returns the number of dropped votes
+func (fb *FutureBuffer) Prune(height uint64, view uint64) int {
+	pruned := 0
+	for h, msgs := range fb.mapPool {
+		kept := msgs[:0]
+		for _, b := range msgs {
+			if h <= height || b.msg.View < view {
+				fb.release(b.msg)
+				pruned++
+				continue
+			}
+			kept = append(kept, b)
+		}
+		if len(kept) == 0 {
+			delete(fb.mapPool, h)
+		} else {
+			fb.mapPool[h] = kept
+		}
+	}
+	return pruned
+}
+
+// release updates the bounds after a vote leaves the buffer
+func (fb *FutureBuffer) release(msg Message) {
+	sender := chain_util.KeyOf(msg.PublicKey)
+	fb.perSender[sender]--
+	if fb.perSender[sender] <= 0 {
+		delete(fb.perSender, sender)
+	}
+	fb.size--
+}
+
+// Len returns the number of buffered votes
+func (fb *FutureBuffer) Len() int {
+	return fb.size
+}
+
+// Clear clears the content of the buffer
+func (fb *FutureBuffer) Clear() {
+	fb.mapPool = make(map[uint64][]bufferedMsg)
+	fb.perSender = make(map[chain_util.Key]int)
+	fb.size = 0
+}
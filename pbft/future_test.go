@@ -0,0 +1,75 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"testing"
+)
+
+func TestFutureBuffer_TakeReady(t *testing.T) {
+	fb := NewFutureBuffer()
+	w := NewWallet("NODE-0")
+	hash := []byte("block")
+	prepare := *w.CreateMsg(MsgPrepare, hash, 1, 0)
+	if !fb.AddMsg2Buffer([]byte("prepare"), prepare) {
+		t.Errorf("AddMsg2Buffer should buffer a new vote")
+	}
+	if fb.AddMsg2Buffer([]byte("prepare"), prepare) {
+		t.Errorf("AddMsg2Buffer should skip a buffered vote")
+	}
+	fb.AddMsg2Buffer([]byte("commit"), *w.CreateMsg(MsgCommit, hash, 1, 1))
+	fb.AddMsg2Buffer([]byte("later"), *w.CreateMsg(MsgPrepare, hash, 2, 0))
+
+	ready := fb.TakeReady(1, func(msg Message) bool { return msg.View == 0 })
+	if len(ready) != 1 || string(ready[0]) != "prepare" || fb.Len() != 2 {
+		t.Errorf("TakeReady should only take the ready vote, got %d, %d left", len(ready), fb.Len())
+	}
+	// height 1 committed, view 1 reached
+	if pruned := fb.Prune(1, 1); pruned != 2 || fb.Len() != 0 {
+		t.Errorf("Prune should drop stale votes, dropped %d, %d left", pruned, fb.Len())
+	}
+}
+
+func TestFutureBuffer_Bounds(t *testing.T) {
+	fb := NewFutureBuffer()
+	w := NewWallet("NODE-0")
+	for i := range FUTURE_BUFFER_PER_VALIDATOR {
+		fb.AddMsg2Buffer(nil, *w.CreateMsg(MsgPrepare, []byte("block-"+strconv.Itoa(i)), 1, 0))
+	}
+	if fb.AddMsg2Buffer(nil, *w.CreateMsg(MsgPrepare, []byte("one more"), 1, 0)) {
+		t.Errorf("AddMsg2Buffer should enforce the per validator bound")
+	}
+	other := NewWallet("NODE-1")
+	if !fb.AddMsg2Buffer(nil, *other.CreateMsg(MsgPrepare, []byte("block"), 1, 0)) {
+		t.Errorf("AddMsg2Buffer should accept votes of another validator")
+	}
+}
+
+func TestVerifyMsg(t *testing.T) {
+	w := NewWallet("NODE-0")
+	msg := *w.CreateMsg(MsgPrepare, []byte("block"), 1, 0)
+	if !VerifyMsg(msg) {
+		t.Errorf("VerifyMsg failed")
+	}
+	replayed := msg
+	replayed.MsgType = MsgCommit
+	if VerifyMsg(replayed) {
+		t.Errorf("VerifyMsg should fail for a vote replayed as another phase")
+	}
+	replayed = msg
+	replayed.Height = 2
+	if VerifyMsg(replayed) {
+		t.Errorf("VerifyMsg should fail for a vote replayed at another height")
+	}
+}
+
+func TestHashMsg_Separated(t *testing.T) {
+	// votes are buffered and counted by their digest, fields must not
+	// run into each other
+	if chain_util.Equal(HashMsg(MsgCommit, []byte{0x01}, 1, 23), HashMsg(MsgCommit, []byte{0x01}, 12, 3)) {
+		t.Errorf("votes of different heights and views share a digest")
+	}
+	if chain_util.Equal(HashMsg(MsgPrepare, []byte{0x01}, 23, 45), HashMsg(MsgPrepare, []byte{0x01, 0x23}, 4, 5)) {
+		t.Errorf("votes of different blocks share a digest")
+	}
+}
@@ -0,0 +1,170 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+/**
+Governance txs reconfigure the validator set on chain. A tx whose data
+reads `validator/{hex public key}={power}` is a validator's vote to
+give the key that power: a new key joins the set and a power of 0
+removes it. Powers are bounded by MAX_VALIDATOR_POWER per validator
+and MAX_TOTAL_POWER per set, so quorums never overflow. Pending votes live in the state, under `governance/`, so
+the app hash covers them and they survive restarts and block sync.
+Votes are weighed by the voter's power and dropped at each epoch
+boundary. Once validators holding a quorum of the power voted for the
+same change within an epoch, the change is adopted and scheduled at
+the first epoch boundary at least PIPELINE_DEPTH heights ahead, so
+that it never applies to a block that may already be in flight.
+Epochs are EPOCH_LENGTH heights long, a multiple of PIPELINE_DEPTH so
+that a proposer window never spans two sets. The set of a height
+gives the quorum of its votes, its proposer and the validator hashes
+of its header, see blockchain.go.
+It features the following methods:
+1. GovernanceData
+2. parseGovernance
+3. voteGovernance
+4. ValidatorsAt
+5. applyGovernance
+6. scheduleChange
+*/
+
+const (
+	governancePrefix = "validator/"
+	govStatePrefix   = "governance/"
+	govPendingKey    = govStatePrefix + "pending"
+)
+
+// pendingChange is a validator change voted for in the current epoch
+// that did not reach a quorum yet
+type pendingChange struct {
+	Validator PublicKey   `json:"validator"`
+	Power     uint64      `json:"power"`
+	Voters    []PublicKey `json:"voters"`
+}
+
+// epoch is the validator set of the heights above its start, it is
+// never modified once created
+type epoch struct {
+	start      uint64
+	validators Validators
+	hash       []byte
+}
+
+// GovernanceData returns the data of a tx voting to give a validator
+// given power
+func GovernanceData(validator PublicKey, power uint64) string {
+	return governancePrefix + chain_util.BytesToHex(validator) + "=" + strconv.FormatUint(power, 10)
+}
+
+// parseGovernance parses the data of a governance tx, it returns false
+// if the data is malformed
+func parseGovernance(data string) (PublicKey, uint64, bool) {
+	key, value, found := strings.Cut(strings.TrimPrefix(data, governancePrefix), "=")
+	if !found {
+		return nil, 0, false
+	}
+	validator, err := chain_util.HexToBytes(key)
+	if err != nil || !PublicKey(validator).Valid() {
+		return nil, 0, false
+	}
+	power, err := strconv.ParseUint(value, 10, 64)
+	if err != nil || power > MAX_VALIDATOR_POWER {
+		return nil, 0, false
+	}
+	return validator, power, true
+}
+
+// voteGovernance records a validator's vote for the change of a
+// governance tx in the pending votes of the state. A change is keyed
+// by its validator and power, it is adopted, and its votes dropped,
+// once its voters hold a quorum of the env's voting power.
+func voteGovernance(tree *chain_util.SparseMerkleTree, env BlockEnv, tx Transaction) string {
+	if env.Validators == nil || !env.Validators.ValidatorExists(tx.From) {
+		return TxResultNotValidator
+	}
+	validator, power, _ := parseGovernance(tx.Event.Data)
+	// the change must keep the total power within its bound
+	if env.Validators.TotalPower()-env.Validators.PowerOf(validator)+power > MAX_TOTAL_POWER {
+		return TxResultBadGovernance
+	}
+	var pending []pendingChange
+	if raw, ok := tree.Get([]byte(govPendingKey)); ok {
+		if err := json.Unmarshal(raw, &pending); err != nil {
+			log.Printf("Pending governance votes are corrupted, %s, dropping them", err)
+			pending = nil
+		}
+	}
+	i := slices.IndexFunc(pending, func(change pendingChange) bool {
+		return chain_util.KeyOf(change.Validator) == chain_util.KeyOf(validator) && change.Power == power
+	})
+	if i < 0 {
+		pending = append(pending, pendingChange{Validator: validator, Power: power})
+		i = len(pending) - 1
+	}
+	if !slices.ContainsFunc(pending[i].Voters, func(voter PublicKey) bool { return chain_util.Equal(voter, tx.From) }) {
+		pending[i].Voters = append(pending[i].Voters, tx.From)
+	}
+	result := TxResultGovernance
+	if env.Validators.HasQuorum(pending[i].Voters) {
+		pending = slices.Delete(pending, i, i+1)
+		result = TxResultAdopted
+	}
+	if len(pending) == 0 {
+		tree.Delete([]byte(govPendingKey))
+		return result
+	}
+	raw, _ := json.Marshal(pending)
+	tree.Set([]byte(govPendingKey), raw)
+	return result
+}
+
+// ValidatorsAt returns the validator set of given height
+func (bc *Blockchain) ValidatorsAt(height uint64) *Validators {
+	return &bc.epochAt(height).validators
+}
+
+// epochAt returns the epoch of given height
+func (bc *Blockchain) epochAt(height uint64) *epoch {
+	for i := len(bc.epochs) - 1; i > 0; i-- {
+		if bc.epochs[i].start < height {
+			return bc.epochs[i]
+		}
+	}
+	return bc.epochs[0]
+}
+
+// applyGovernance schedules the changes adopted by a committed block
+func (bc *Blockchain) applyGovernance(block Block, results []string) {
+	for i, tx := range block.Data {
+		if results[i] != TxResultAdopted {
+			continue
+		}
+		validator, power, _ := parseGovernance(tx.Event.Data)
+		bc.scheduleChange(block.Height, validator, power)
+	}
+}
+
+// scheduleChange applies a change committed at given height to the set
+// of the first epoch starting at least depth heights later
+func (bc *Blockchain) scheduleChange(height uint64, validator PublicKey, power uint64) {
+	start := (height + bc.depth + bc.epochLength - 1) / bc.epochLength * bc.epochLength
+	last := bc.epochs[len(bc.epochs)-1]
+	next, ok := last.validators.WithPower(validator, power)
+	if !ok {
+		log.Printf("Validator change of [%s] REJECTED, the set would be empty or out of power bounds", chain_util.BytesToHex(validator)[:6])
+		return
+	}
+	scheduled := &epoch{start: start, validators: *next, hash: next.Hash()}
+	if last.start == start {
+		bc.epochs[len(bc.epochs)-1] = scheduled
+	} else {
+		bc.epochs = append(bc.epochs, scheduled)
+	}
+	log.Printf("Validator [%s] gets power %d after height %d", chain_util.BytesToHex(validator)[:6], power, start)
+}
@@ -0,0 +1,192 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// commitBlock creates a block with given txs and commits it
+func commitBlock(t *testing.T, bc *Blockchain, txs []Transaction) (*Block, []string) {
+	block := bc.CreateBlock(proposerWallet(bc), txs)
+	blockPool, preparePool, commitPool := NewBlockPool(), NewMsgPool(), NewMsgPool()
+	blockPool.AddBlock2Pool(*block)
+	results, ok := bc.AddUpdatedBlock2Chain(block.Hash, *blockPool, *preparePool, *commitPool)
+	if !ok {
+		t.Fatalf("AddUpdatedBlock2Chain failed at height %d", bc.Height()+1)
+	}
+	return block, results
+}
+
+func TestBlockchain_Governance(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(3))
+	bc.depth, bc.epochLength = 1, 2
+	wallets := make([]*Wallet, 4)
+	for i := range wallets {
+		wallets[i] = NewWallet("NODE-" + strconv.Itoa(i))
+	}
+	newcomer := wallets[3].publicKey
+	vote := GovernanceData(newcomer, 2)
+
+	_, results := commitBlock(t, bc, []Transaction{
+		*wallets[0].CreateTx(vote),
+		*wallets[1].CreateTx(vote),
+		*NewWallet("outsider").CreateTx(vote),
+		*wallets[2].CreateTx("validator/nothex=1"),
+	})
+	if results[0] != TxResultGovernance || results[2] != TxResultNotValidator || results[3] != TxResultBadGovernance {
+		t.Errorf("governance txs should be executed apart, got %v", results)
+	}
+	if len(bc.epochs) != 1 {
+		t.Fatalf("a change should wait for a quorum of validators")
+	}
+	if _, ok := bc.state.Latest().Get([]byte(govPendingKey)); !ok {
+		t.Fatalf("pending votes should be kept in the state")
+	}
+
+	// the same change spelled in upper-case hex is the same vote
+	upper := governancePrefix + strings.ToUpper(chain_util.BytesToHex(newcomer)) + "=2"
+	_, results = commitBlock(t, bc, []Transaction{*wallets[2].CreateTx(upper)})
+	if results[0] != TxResultAdopted {
+		t.Errorf("the last vote should adopt the change, got %v", results)
+	}
+	if _, ok := bc.state.Latest().Get([]byte(govPendingKey)); ok {
+		t.Errorf("an adopted change should leave the pending votes")
+	}
+	current, next := bc.ValidatorsAt(4), bc.ValidatorsAt(5)
+	if current.ValidatorExists(newcomer) || !next.ValidatorExists(newcomer) || next.Power(3) != 2 {
+		t.Fatalf("the change should apply after the next epoch boundary")
+	}
+
+	commitBlock(t, bc, nil)
+	block, _ := commitBlock(t, bc, nil)
+	if !chain_util.Equal(block.ValidatorsHash, current.Hash()) ||
+		!chain_util.Equal(block.NextValidatorsHash, next.Hash()) {
+		t.Errorf("the last block of an epoch should commit to the next set")
+	}
+	block, _ = commitBlock(t, bc, nil)
+	if !chain_util.Equal(block.ValidatorsHash, next.Hash()) {
+		t.Errorf("the first block of an epoch should commit to its set")
+	}
+
+	// removing a validator votes with the new quorum
+	removal := GovernanceData(wallets[0].publicKey, 0)
+	txs := make([]Transaction, 0, 3)
+	for _, w := range wallets[1:] {
+		txs = append(txs, *w.CreateTx(removal))
+	}
+	commitBlock(t, bc, txs)
+	if vs := bc.ValidatorsAt(9); vs.ValidatorExists(wallets[0].publicKey) || len(vs.list) != 3 {
+		t.Errorf("a validator should be removed by a power of 0")
+	}
+}
+
+func TestBlockchain_GovernanceExpiry(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(4))
+	bc.depth, bc.epochLength = 1, 2
+	wallets := make([]*Wallet, 4)
+	for i := range wallets {
+		wallets[i] = NewWallet("NODE-" + strconv.Itoa(i))
+	}
+	vote := GovernanceData(NewWallet("newcomer").publicKey, 1)
+
+	commitBlock(t, bc, []Transaction{*wallets[0].CreateTx(vote), *wallets[1].CreateTx(vote)})
+	commitBlock(t, bc, nil)
+	// height 3 starts a new epoch, the votes of the last one are dropped
+	block, results := commitBlock(t, bc, []Transaction{*wallets[2].CreateTx(vote)})
+	if results[0] != TxResultGovernance || len(bc.epochs) != 1 {
+		t.Errorf("votes should not carry over an epoch boundary, got %v", results)
+	}
+	if !chain_util.Equal(block.AppHash, bc.state.AppHash()) {
+		t.Errorf("the app hash should cover the pending votes")
+	}
+}
+
+func TestValidators_JSON(t *testing.T) {
+	vs := NewWeightedValidators(NewValidators(3).list, []uint64{1, 2, 3})
+	if _, ok := vs.WithPower(vs.list[0], 0); !ok {
+		t.Errorf("WithPower should remove a validator")
+	}
+	single := NewValidatorsFromKeys(vs.list[:1])
+	if _, ok := single.WithPower(vs.list[0], 0); ok {
+		t.Errorf("WithPower should not empty the set")
+	}
+	raw, err := vs.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Validators
+	if err := decoded.UnmarshalJSON(raw); err != nil || !chain_util.Equal(decoded.Hash(), vs.Hash()) {
+		t.Errorf("Validators should survive a JSON round trip, %v", err)
+	}
+}
+
+func TestValidators_Quorum(t *testing.T) {
+	tests := []struct {
+		n      int
+		quorum int
+	}{
+		{4, 3}, {5, 4}, {6, 5}, {7, 5}, {8, 6}, {9, 7}, {10, 7},
+	}
+	for _, tt := range tests {
+		vs := NewValidators(tt.n)
+		if got := vs.Quorum(); got != tt.quorum {
+			t.Errorf("Quorum of %d validators is %d, want %d", tt.n, got, tt.quorum)
+		}
+		if got := vs.QuorumPower(); got != uint64(tt.quorum) {
+			t.Errorf("QuorumPower of %d validators is %d, want %d", tt.n, got, tt.quorum)
+		}
+		if vs.HasQuorum(vs.list[:tt.quorum-1]) || !vs.HasQuorum(vs.list[:tt.quorum]) {
+			t.Errorf("HasQuorum of %d validators should need %d voters", tt.n, tt.quorum)
+		}
+		// repeated voters are counted once
+		repeated := append(append([]PublicKey(nil), vs.list[:tt.quorum-1]...), vs.list[0])
+		if vs.HasQuorum(repeated) {
+			t.Errorf("HasQuorum of %d validators counted a voter twice", tt.n)
+		}
+	}
+
+	// 4 validators with powers 1, 1, 1, 3: the heavy one and any other
+	// hold 4 of 6, short of the 5 needed
+	vs := NewWeightedValidators(NewValidators(4).list, []uint64{1, 1, 1, 3})
+	if vs.QuorumPower() != 5 || vs.HonestPower() != 3 {
+		t.Errorf("QuorumPower / HonestPower mismatch, got %d and %d", vs.QuorumPower(), vs.HonestPower())
+	}
+	if vs.HasQuorum([]PublicKey{vs.list[3], vs.list[0]}) {
+		t.Errorf("HasQuorum should weigh voters by power")
+	}
+	if !vs.HasQuorum([]PublicKey{vs.list[3], vs.list[0], vs.list[1]}) {
+		t.Errorf("HasQuorum should accept more than 2/3 of the power")
+	}
+	if vs.HasQuorum(vs.list[:3]) {
+		t.Errorf("HasQuorum should not accept 3 of 6 power")
+	}
+}
+
+func TestValidators_PowerBounds(t *testing.T) {
+	keys := NewValidators(3).list
+	if _, _, ok := parseGovernance(GovernanceData(keys[0], MAX_VALIDATOR_POWER+1)); ok {
+		t.Errorf("parseGovernance should reject a power above MAX_VALIDATOR_POWER")
+	}
+	// a set at the total bound leaves no room for more power
+	heavy := NewWeightedValidators(keys, []uint64{MAX_VALIDATOR_POWER, MAX_VALIDATOR_POWER, MAX_TOTAL_POWER - 2*MAX_VALIDATOR_POWER})
+	if _, ok := heavy.WithPower(NewWallet("newcomer").publicKey, 1); ok {
+		t.Errorf("WithPower should not exceed MAX_TOTAL_POWER")
+	}
+	if heavy.QuorumPower() <= heavy.TotalPower()*2/3 {
+		t.Errorf("QuorumPower should not overflow within the bounds")
+	}
+	env := BlockEnv{Height: 1, Validators: heavy}
+	tree := chain_util.NewSparseMerkleTree()
+	tx := NewWallet("NODE-0").CreateTx(GovernanceData(NewWallet("newcomer").publicKey, 1))
+	if result := voteGovernance(tree, env, *tx); result != TxResultBadGovernance {
+		t.Errorf("a vote exceeding MAX_TOTAL_POWER should be rejected, got %s", result)
+	}
+	raw, _ := heavy.MarshalJSON()
+	tooHeavy := strings.Replace(string(raw), `"power":4294967296`, `"power":4294967297`, 1)
+	var decoded Validators
+	if err := decoded.UnmarshalJSON([]byte(tooHeavy)); err == nil {
+		t.Errorf("UnmarshalJSON should reject a power above MAX_VALIDATOR_POWER")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -14,9 +15,11 @@ import (
 func (node *Node) queryNodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
 	str := fmt.Sprintf("Node[%s] Info:\n", chain_util.BytesToHex(node.Wallet.publicKey)[:6])
+	mutex.Lock()
 	// validators
 	str += "\n[Validators]\n"
-	for i, pubKey := range node.Validators.list {
+	validators := node.Blockchain.ValidatorsAt(node.Blockchain.Height() + 1)
+	for i, pubKey := range validators.list {
 		str += fmt.Sprintf("%d: %s\n", i, chain_util.BytesToHex(pubKey)[:6])
 	}
 	// blockchain
@@ -47,28 +50,29 @@ func (node *Node) queryNodeInfoHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	// PreparePool
 	str += "\n[PreparePool]\n"
-	for bh, msgs := range node.PreparePool.mapPool {
-		str += fmt.Sprintf("--> %s\n", bh[:5])
+	for _, msgs := range node.PreparePool.mapPool {
+		str += fmt.Sprintf("--> %s\n", chain_util.BytesToHex(msgs[0].BlockHash)[:5])
 		for i, msg := range msgs {
 			str += fmt.Sprintf("%d: %s\n", i, chain_util.BytesToHex(msg.PublicKey)[:6])
 		}
 	}
 	// CommitPool
 	str += "\n[CommitPool]\n"
-	for bh, msgs := range node.CommitPool.mapPool {
-		str += fmt.Sprintf("--> %s\n", bh[:5])
+	for _, msgs := range node.CommitPool.mapPool {
+		str += fmt.Sprintf("--> %s\n", chain_util.BytesToHex(msgs[0].BlockHash)[:5])
 		for i, msg := range msgs {
 			str += fmt.Sprintf("%d: %s\n", i, chain_util.BytesToHex(msg.PublicKey)[:6])
 		}
 	}
 	// RCPool
 	str += "\n[RCPool]\n"
-	for bh, msgs := range node.RCPool.mapPool {
-		str += fmt.Sprintf("--> %s\n", bh[:6])
+	for _, msgs := range node.RCPool.mapPool {
+		str += fmt.Sprintf("--> %s\n", chain_util.BytesToHex(msgs[0].BlockHash)[:6])
 		for i, msg := range msgs {
 			str += fmt.Sprintf("%d: %s\n", i, chain_util.BytesToHex(msg.PublicKey)[:6])
 		}
 	}
+	mutex.Unlock()
 	_, err := w.Write([]byte(str))
 	if err != nil {
 		log.Printf("Write to HTTP client failed, [%v], skip this one!\n", err)
@@ -120,190 +124,378 @@ func (node *Node) wsServerHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		//log.Printf("recv: %s\n", msg)
 
-		// parse msg to different types and perform different ops
-		var data map[string]interface{}
-		if err := json.Unmarshal(msg, &data); err != nil {
-			log.Printf("Unmarshal msg failed, %s, skip this one!\n", err)
-			continue
-		}
+		node.handleMsg(msg, conn)
+	}
+}
+
+// handleMsg parses a message to different types and performs different ops,
+// origin is the connection the message arrived on (nil for replayed ones)
+func (node *Node) handleMsg(msg []byte, origin *websocket.Conn) {
+	var data map[string]interface{}
+	if err := json.Unmarshal(msg, &data); err != nil {
+		log.Printf("Unmarshal msg failed, %s, skip this one!\n", err)
+		return
+	}
 
-		if msgTypeRaw, ok := data["msgType"]; ok {
-			if msgType, ok2 := msgTypeRaw.(string); ok2 {
+	if msgTypeRaw, ok := data["msgType"]; ok {
+		if msgType, ok2 := msgTypeRaw.(string); ok2 {
 
-				switch msgType {
-				case MsgTx:
-					var tx Transaction
-					if err := json.Unmarshal(msg, &tx); err != nil {
-						log.Printf("Unmarshal msg->tx failed, %s, skip this one!\n", err)
-						continue
-					}
-					// check if tx is valid
-					if !node.TxPool.TxExists(tx) &&
-						node.TxPool.VerifyTx(tx) &&
-						node.Validators.ValidatorExists(tx.From) {
-						// add tx to tx pool
-						mutex.Lock()
-						poolCopy, success := node.TxPool.AddTx2Pool(tx)
-						mutex.Unlock()
-						if !success {
-							continue
-						}
-						// broadcast
-						node.broadcast(string(msg))
-
-						if poolCopy != nil {
-							log.Println("THRESHOLD REACHED!")
-							if chain_util.BytesToHex(node.Blockchain.GetProposer()) == chain_util.BytesToHex(node.Wallet.publicKey) {
-								log.Println("PROPOSING A NEW BLOCK!")
-								block := node.Blockchain.CreateBlock(node.Wallet, poolCopy)
-
-								newMsg, err := json.Marshal(block)
-								if err != nil {
-									log.Printf("Marshal block failed, %s, msg won't be sent, skip this one!\n", err)
-									continue
-								}
-								node.broadcast(string(newMsg))
-							}
-						}
+			switch msgType {
+			case MsgTx:
+				var tx Transaction
+				if err := json.Unmarshal(msg, &tx); err != nil {
+					log.Printf("Unmarshal msg->tx failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if tx is valid, the pools are only read under the mutex
+				if node.TxPool.VerifyTx(tx) &&
+					node.Clients.ClientAllowed(tx.From) {
+					// add tx to tx pool
+					mutex.Lock()
+					success := !node.TxPool.TxExists(tx) && node.TxPool.AddTx2Pool(tx)
+					mutex.Unlock()
+					if !success {
+						return
 					}
-				case MsgPrePrepare:
-					var block Block
-					if err := json.Unmarshal(msg, &block); err != nil {
-						log.Printf("Unmarshal msg->block failed, %s, skip this one!\n", err)
-						continue
+					// broadcast, i.e. forward the request to the primary
+					// (and keep it at every backup for later views)
+					node.broadcast(string(msg))
+
+					// only the primary batches requests, backups start
+					// a timer to detect the primary censoring them
+					mutex.Lock()
+					poolCopy := node.cutReadyBatch()
+					node.RequestTimers.Start(tx.Id, time.Now())
+					mutex.Unlock()
+					if poolCopy != nil {
+						node.proposeBlock(poolCopy)
 					}
-					// check if block is valid
-					if exists, _ := node.BlockPool.BlockExists(block.Hash); !exists && node.Blockchain.VerifyBlock(block) {
-						// add block to block pool
+				}
+			case MsgPrePrepare:
+				var block Block
+				if err := json.Unmarshal(msg, &block); err != nil {
+					log.Printf("Unmarshal msg->block failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if block is valid and add it to block pool
+				mutex.Lock()
+				exists, _ := node.BlockPool.BlockExists(block.Hash)
+				valid := !exists && node.Blockchain.VerifyBlock(block)
+				success := valid && node.BlockPool.AddBlock2Pool(block) && node.Blockchain.AddInflight(block)
+				if valid {
+					node.BlockRequests.Done(block.Hash)
+				}
+				mutex.Unlock()
+				if !success {
+					return
+				}
+				// broadcast
+				node.broadcast(string(msg))
+
+				// create prepareMsg and broadcast it
+				node.prepareBlock(block)
+			case MsgPrepare:
+				var prepareMsg Message
+				if err := json.Unmarshal(msg, &prepareMsg); err != nil {
+					log.Printf("Unmarshal msg->prepareMsg failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if prepareMsg is valid and add it to prepare pool
+				if node.PreparePool.VerifyMsg(prepareMsg) &&
+					node.addVote(&node.PreparePool, msg, prepareMsg) {
+					// broadcast
+					node.broadcast(string(msg))
+
+					// PBFT MINIMUM VOTING REQUIREMENT
+					if node.hasQuorum(&node.PreparePool, prepareMsg) {
+						// keep the prepared certificate for view changes
 						mutex.Lock()
-						success := node.BlockPool.AddBlock2Pool(block)
+						cert := node.Blockchain.SetPrepared(prepareMsg.BlockHash, prepareMsg.View, node.PreparePool.Msgs(prepareMsg.BlockHash))
 						mutex.Unlock()
-						if !success {
-							continue
+						// create commitMsg, justified by the certificate, and broadcast it
+						commitMsg := node.Wallet.CreateCommit(cert, prepareMsg.Height, prepareMsg.View)
+						if commitMsg == nil {
+							return
 						}
-						// broadcast
-						node.broadcast(string(msg))
-
-						// create prepareMsg and broadcast it
-						prepareMsg := node.Wallet.CreateMsg(MsgPrepare, block.Hash)
-						newMsg, err := json.Marshal(prepareMsg)
+						newMsg, err := json.Marshal(commitMsg)
 						if err != nil {
-							log.Printf("Marshal prepareMsg failed, %s, msg won't be sent, skip this one!\n", err)
-							continue
+							log.Printf("Marshal commitMsg failed, %s, msg won't be sent, skip this one!\n", err)
+							return
 						}
 						node.broadcast(string(newMsg))
 					}
-				case MsgPrepare:
-					var prepareMsg Message
-					if err := json.Unmarshal(msg, &prepareMsg); err != nil {
-						log.Printf("Unmarshal msg->prepareMsg failed, %s, skip this one!\n", err)
-						continue
-					}
-					// check if prepareMsg is valid
-					if !node.PreparePool.MsgExists(prepareMsg) &&
-						node.PreparePool.VerifyMsg(prepareMsg) &&
-						node.Validators.ValidatorExists(prepareMsg.PublicKey) {
-						// add prepareMsg to prepare pool
-						mutex.Lock()
-						success := node.PreparePool.AddMsg2Pool(prepareMsg)
-						mutex.Unlock()
-						if !success {
-							continue
-						}
-						// broadcast
-						node.broadcast(string(msg))
-
-						// PBFT MINIMUM VOTING REQUIREMENT
-						if len(node.PreparePool.mapPool[chain_util.BytesToHex(prepareMsg.BlockHash)]) >= MIN_APPROVALS {
-							// create commitMsg and broadcast it
-							commitMsg := node.Wallet.CreateMsg(MsgCommit, prepareMsg.BlockHash)
-							newMsg, err := json.Marshal(commitMsg)
-							if err != nil {
-								log.Printf("Marshal commitMsg failed, %s, msg won't be sent, skip this one!\n", err)
-								continue
-							}
-							node.broadcast(string(newMsg))
-						}
+				}
+			case MsgCommit:
+				var commitMsg Message
+				if err := json.Unmarshal(msg, &commitMsg); err != nil {
+					log.Printf("Unmarshal msg->commitMsg failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if commitMsg is valid and add it to commit pool
+				if node.CommitPool.VerifyMsg(commitMsg) &&
+					node.addVote(&node.CommitPool, msg, commitMsg) {
+					// broadcast
+					node.broadcast(string(msg))
+
+					// PBFT MINIMUM VOTING REQUIREMENT
+					if node.hasQuorum(&node.CommitPool, commitMsg) {
+						// add the block and any waiting descendant to the chain
+						node.commitReady()
 					}
-				case MsgCommit:
-					var commitMsg Message
-					if err := json.Unmarshal(msg, &commitMsg); err != nil {
-						log.Printf("Unmarshal msg->commitMsg failed, %s, skip this one!\n", err)
-						continue
+					// create rcMsg and broadcast it
+					rcMsg := node.Wallet.CreateMsg(MsgRC, commitMsg.BlockHash, commitMsg.Height, commitMsg.View)
+					if rcMsg == nil {
+						return
 					}
-					// check if commitMsg is valid
-					if !node.CommitPool.MsgExists(commitMsg) &&
-						node.CommitPool.VerifyMsg(commitMsg) &&
-						node.Validators.ValidatorExists(commitMsg.PublicKey) {
-						// add commitMsg to commit pool
-						mutex.Lock()
-						success := node.CommitPool.AddMsg2Pool(commitMsg)
-						mutex.Unlock()
-						if !success {
-							continue
-						}
-						// broadcast
-						node.broadcast(string(msg))
-
-						// PBFT MINIMUM VOTING REQUIREMENT
-						if len(node.CommitPool.mapPool[chain_util.BytesToHex(commitMsg.BlockHash)]) >= MIN_APPROVALS {
-							// add block to the chain
-							mutex.Lock()
-							node.Blockchain.AddUpdatedBlock2Chain(commitMsg.BlockHash, node.BlockPool, node.PreparePool, node.CommitPool)
-							mutex.Unlock()
-						}
-						// create rcMsg and broadcast it
-						rcMsg := node.Wallet.CreateMsg(MsgRC, commitMsg.BlockHash)
-						newMsg, err := json.Marshal(rcMsg)
-						if err != nil {
-							log.Printf("Marshal rcMsg failed, %s, msg won't be sent, skip this one!\n", err)
-							continue
-						}
-						node.broadcast(string(newMsg))
+					newMsg, err := json.Marshal(rcMsg)
+					if err != nil {
+						log.Printf("Marshal rcMsg failed, %s, msg won't be sent, skip this one!\n", err)
+						return
 					}
-				case MsgRC:
-					var rcMsg Message
-					if err := json.Unmarshal(msg, &rcMsg); err != nil {
-						log.Printf("Unmarshal msg->rcMsg failed, %s, skip this one!\n", err)
-						continue
+					node.broadcast(string(newMsg))
+				}
+			case MsgRC:
+				var rcMsg Message
+				if err := json.Unmarshal(msg, &rcMsg); err != nil {
+					log.Printf("Unmarshal msg->rcMsg failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if rcMsg is valid
+				if node.RCPool.VerifyMsg(rcMsg) {
+					// add rcMsg to rc pool
+					mutex.Lock()
+					success := !node.RCPool.MsgExists(rcMsg) &&
+						node.Blockchain.ValidatorsAt(rcMsg.Height).ValidatorExists(rcMsg.PublicKey) &&
+						node.RCPool.AddMsg2Pool(rcMsg)
+					mutex.Unlock()
+					if !success {
+						return
 					}
-					// check if rcMsg is valid
-					if !node.RCPool.MsgExists(rcMsg) &&
-						node.RCPool.VerifyMsg(rcMsg) &&
-						node.Validators.ValidatorExists(rcMsg.PublicKey) {
-						// add rcMsg to rc pool
-						mutex.Lock()
-						success := node.RCPool.AddMsg2Pool(rcMsg)
-						mutex.Unlock()
-						if !success {
-							continue
-						}
-						// broadcast
-						node.broadcast(string(msg))
-
-						// PBFT MINIMUM VOTING REQUIREMENT
-						if len(node.RCPool.mapPool[chain_util.BytesToHex(rcMsg.BlockHash)]) >= MIN_APPROVALS {
-							// TODO: implement clean mechanism
-							log.Println("[REACHED RC!!!!!]")
-							mutex.Lock()
-							success := node.TxPool.TransferInProgressToCommitted(node.BlockPool.GetBlock(rcMsg.BlockHash).Data)
-							mutex.Unlock()
-							if success {
-								log.Println("[TRANSFERRED IN-PROGRESS TO COMMITTED SUCCESSFULLY!!!]")
-							} else {
-								log.Println("[TRANSFERRED IN-PROGRESS TO COMMITTED FAILED!!!]")
-							}
-						}
+					// broadcast
+					node.broadcast(string(msg))
+
+					// PBFT MINIMUM VOTING REQUIREMENT
+					if node.hasQuorum(&node.RCPool, rcMsg) {
+						log.Println("[REACHED RC!!!!!]")
 					}
-				default:
-					log.Println("[default] unknown msgType!")
 				}
-			} else {
-				log.Println("[inner] unknown msgType!")
+			case MsgBlockRequest:
+				var request Message
+				if err := json.Unmarshal(msg, &request); err != nil {
+					log.Printf("Unmarshal msg->blockRequest failed, %s, skip this one!\n", err)
+					return
+				}
+				// only validators may ask for proposed blocks
+				if request.MsgType == MsgBlockRequest &&
+					VerifyMsg(request) &&
+					node.validatorsAt(request.Height).ValidatorExists(request.PublicKey) {
+					node.respondBlock(request, origin)
+				}
+			case MsgBlockResponse:
+				var response BlockResponse
+				if err := json.Unmarshal(msg, &response); err != nil {
+					log.Printf("Unmarshal msg->blockResponse failed, %s, skip this one!\n", err)
+					return
+				}
+				if node.acceptFetchedBlock(response.Block) {
+					log.Printf("Fetched missing block [%s]\n", chain_util.BytesToHex(response.Block.Hash)[:6])
+					node.prepareBlock(response.Block)
+				}
+			case MsgViewChange:
+				var vc ViewChange
+				if err := json.Unmarshal(msg, &vc); err != nil {
+					log.Printf("Unmarshal msg->viewChange failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if view change is valid and for a future view, then
+				// add it to view change pool
+				mutex.Lock()
+				success := vc.View > node.Blockchain.View() &&
+					!node.ViewChangePool.ViewChangeExists(vc) &&
+					node.Blockchain.ValidatorsAt(node.Blockchain.Height()+1).ValidatorExists(vc.PublicKey) &&
+					node.Blockchain.VerifyViewChange(vc) &&
+					node.ViewChangePool.AddViewChange2Pool(vc)
+				mutex.Unlock()
+				if !success {
+					return
+				}
+				// broadcast
+				node.broadcast(string(msg))
+				node.handleViewChange(vc.View)
+			case MsgNewView:
+				var nv NewView
+				if err := json.Unmarshal(msg, &nv); err != nil {
+					log.Printf("Unmarshal msg->newView failed, %s, skip this one!\n", err)
+					return
+				}
+				// check if new view is valid, then move to its view
+				if node.handleNewView(nv) {
+					// broadcast
+					node.broadcast(string(msg))
+				}
+			default:
+				log.Println("[default] unknown msgType!")
 			}
 		} else {
-			log.Println("[outer] unknown msgType!")
+			log.Println("[inner] unknown msgType!")
 		}
+	} else {
+		log.Println("[outer] unknown msgType!")
+	}
+}
+
+// validatorsAt returns the validator set of given height
+func (node *Node) validatorsAt(height uint64) *Validators {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return node.Blockchain.ValidatorsAt(height)
+}
+
+// addVote adds a PREPARE or COMMIT with a valid signature to given
+// pool if it is new, from a validator and countable now
+func (node *Node) addVote(pool *MsgPool, raw []byte, msg Message) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return !pool.MsgExists(msg) &&
+		node.Blockchain.ValidatorsAt(msg.Height).ValidatorExists(msg.PublicKey) &&
+		node.voteReady(raw, msg) &&
+		pool.AddMsg2Pool(msg)
+}
+
+// hasQuorum checks if the votes of given pool for a message's block
+// reach the quorum of the validators at its height
+func (node *Node) hasQuorum(pool *MsgPool, msg Message) bool {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return node.Blockchain.ValidatorsAt(msg.Height).HasQuorum(pool.Voters(msg.BlockHash))
+}
+
+// voteReady tells whether a PREPARE or COMMIT can be counted now.
+// Votes for a block that has not arrived yet, or for a later height or
+// view, are buffered to be replayed later; votes of a committed height
+// or an old view, and votes beyond the high watermark are dropped.
+// The caller must hold the mutex.
+func (node *Node) voteReady(raw []byte, msg Message) bool {
+	height, view := node.Blockchain.Height(), node.Blockchain.View()
+	if msg.Height <= height || msg.View < view {
+		return false
+	}
+	if node.voteCountable(msg) {
+		return true
+	}
+	if msg.Height > height+FUTURE_HEIGHT_WATERMARK || msg.View > view+FUTURE_VIEW_WATERMARK {
+		log.Printf("%s for height %d view %d is beyond the watermark, skip this one!\n", msg.MsgType, msg.Height, msg.View)
+		return false
+	}
+	if !node.FutureBuffer.AddMsg2Buffer(raw, msg) {
+		return false
+	}
+	// PREPAREs holding more than 1/3 of the power for a block this node
+	// never received mean at least one honest validator holds it, so
+	// ask peers for it
+	validators := node.Blockchain.ValidatorsAt(msg.Height)
+	if msg.MsgType == MsgPrepare && msg.Height <= height+node.Blockchain.depth && msg.View == view &&
+		validators.VotingPower(node.FutureBuffer.Voters(msg)) >= validators.HonestPower() &&
+		node.BlockRequests.Request(msg.BlockHash, time.Now()) {
+		go node.requestBlock(msg.BlockHash, msg.Height, msg.View)
+	}
+	return false
+}
+
+// voteCountable checks if a vote is for a block of the block pool
+// that is in flight at the vote's height, in the current view
+func (node *Node) voteCountable(msg Message) bool {
+	exists, _ := node.BlockPool.BlockExists(msg.BlockHash)
+	height, inflight := node.Blockchain.InflightHeight(msg.BlockHash)
+	return exists && inflight && msg.Height == height && msg.View == node.Blockchain.View()
+}
+
+// replayFuture drops the buffered votes that became stale and handles
+// again the ones that became ready
+func (node *Node) replayFuture() {
+	mutex.Lock()
+	height, view := node.Blockchain.Height(), node.Blockchain.View()
+	node.FutureBuffer.Prune(height, view)
+	var ready [][]byte
+	for h := height + 1; h <= height+node.Blockchain.depth; h++ {
+		ready = append(ready, node.FutureBuffer.TakeReady(h, node.voteCountable)...)
+	}
+	mutex.Unlock()
+	for _, raw := range ready {
+		node.handleMsg(raw, nil)
+	}
+}
+
+// commitReady commits, in height order, every pooled block chaining
+// on the tip that reached its COMMIT quorum, a block committed before
+// its parent waits for it here
+func (node *Node) commitReady() {
+	mutex.Lock()
+	committed := 0
+	var replies []committedBlock
+	for {
+		tip, _ := node.Blockchain.GetBlock(node.Blockchain.Height())
+		var next *Block
+		for _, block := range node.BlockPool.pool {
+			if chain_util.Equal(block.LastHash, tip.Hash) &&
+				node.Blockchain.ValidatorsAt(block.Height).HasQuorum(node.CommitPool.Voters(block.Hash)) {
+				next = &block
+				break
+			}
+		}
+		if next == nil {
+			break
+		}
+		results, ok := node.Blockchain.AddUpdatedBlock2Chain(next.Hash, node.BlockPool, node.PreparePool, node.CommitPool)
+		if !ok {
+			break
+		}
+		replies = append(replies, committedBlock{block: *next, height: node.Blockchain.Height(), results: results})
+		node.lastBlockAt = time.Now()
+		node.RequestTimers.Stop(next.Data)
+		node.TxPool.ReconcileBlock(next.Data, results)
+		committed++
+	}
+	var batch []Transaction
+	if committed > 0 {
+		// the pipeline has room again
+		batch = node.cutReadyBatch()
+	}
+	mutex.Unlock()
+	if committed == 0 {
+		return
+	}
+	node.createReplies(replies)
+	// votes for the next heights may be waiting
+	go node.replayFuture()
+	if batch != nil {
+		node.proposeBlock(batch)
+	}
+}
+
+// committedBlock is a block committed by commitReady with the result
+// of each of its txs
+type committedBlock struct {
+	block   Block
+	height  uint64
+	results []string
+}
+
+// createReplies signs a reply for each tx of the committed blocks, the
+// replies are signed without holding the mutex
+func (node *Node) createReplies(blocks []committedBlock) {
+	var replies []Reply
+	for _, committed := range blocks {
+		for i, tx := range committed.block.Data {
+			if reply := node.Wallet.CreateReply(tx.Id, committed.height, committed.results[i]); reply != nil {
+				replies = append(replies, *reply)
+			}
+		}
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, reply := range replies {
+		node.ReplyPool.AddReply2Pool(reply)
 	}
 }
 
@@ -331,27 +523,83 @@ func (node *Node) makeTestCallHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// makeTxHandler makes a tx on current node
+// makeTxHandler makes a test tx signed by current node's wallet,
+// the tx data can be given by `?data=`
+// NOTE: the node's wallet must be allowed as a client for the tx to
+// be accepted, use `POST /tx` to submit client-signed txs instead
 func (node *Node) makeTxHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/plain")
-	tx := node.Wallet.CreateTx(time.Now().String() + " " + "this is a test message")
+	data := r.URL.Query().Get("data")
+	if data == "" {
+		data = time.Now().String() + " " + "this is a test message"
+	}
+	tx := node.Wallet.CreateTx(data)
+	if tx == nil {
+		http.Error(w, "sign tx failed", http.StatusInternalServerError)
+		return
+	}
 	msg, err := json.Marshal(tx)
 	if err != nil {
 		log.Printf("Marshal tx failed, [%s]\n", err)
 		return
 	}
+	// Write to web page
+	w.Write([]byte(msg))
+	node.relayMsg(msg)
+}
 
-	// write message
+// submitTxHandler accepts a tx signed by a client and injects it into
+// the PBFT workflow
+func (node *Node) submitTxHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	var tx Transaction
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, MAX_TX_BYTES)).Decode(&tx); err != nil {
+		http.Error(w, fmt.Sprintf("invalid tx, %v", err), http.StatusBadRequest)
+		return
+	}
+	if !node.TxPool.VerifyTx(tx) {
+		http.Error(w, "invalid tx signature", http.StatusBadRequest)
+		return
+	}
+	if !node.Clients.ClientAllowed(tx.From) {
+		http.Error(w, "client not allowed", http.StatusForbidden)
+		return
+	}
+	mutex.Lock()
+	reason := node.TxPool.CheckTx(tx)
+	mutex.Unlock()
+	switch reason {
+	case "":
+	case RejectDuplicate:
+		http.Error(w, fmt.Sprintf("tx [%s] already submitted", tx.Id), http.StatusConflict)
+		return
+	case RejectTooLarge:
+		http.Error(w, fmt.Sprintf("tx [%s] rejected, %s", tx.Id, reason), http.StatusRequestEntityTooLarge)
+		return
+	default:
+		http.Error(w, fmt.Sprintf("tx [%s] rejected, %s", tx.Id, reason), http.StatusTooManyRequests)
+		return
+	}
+	msg, err := json.Marshal(tx)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("marshal tx failed, %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(msg)
+	node.relayMsg(msg)
+}
+
+// relayMsg writes a message to WsClient(Relay) once it is online
+func (node *Node) relayMsg(msg []byte) {
 	for {
 		if node.Relay != nil {
 			break
 		}
+		time.Sleep(100 * time.Millisecond)
 	}
-	// Write to web page
-	w.Write([]byte(msg))
-	// Write to WsClient(Relay)
 	mutex.Lock()
-	err = node.Relay.WriteMessage(websocket.TextMessage, []byte(msg))
+	err := node.Relay.WriteMessage(websocket.TextMessage, msg)
 	mutex.Unlock()
 	if err != nil {
 		log.Printf("Write message failed, [%s]\n", err)
@@ -375,10 +623,15 @@ type TxPoolItem struct {
 	PubKey string `json:"pubKey"`
 }
 
+type AccountNonce struct {
+	PubKey string `json:"pubKey"`
+	Nonce  uint64 `json:"nonce"`
+}
+
 type TxPoolInfo struct {
-	Waiting    []TxPoolItem `json:"waiting"`
-	InProgress []TxPoolItem `json:"inProgress"`
-	Committed  []TxPoolItem `json:"committed"`
+	Waiting    []TxPoolItem   `json:"waiting"`
+	InProgress []TxPoolItem   `json:"inProgress"`
+	Committed  []AccountNonce `json:"committed"`
 }
 
 type BlockPoolItem struct {
@@ -395,6 +648,7 @@ type MsgPoolItem struct {
 type Data struct {
 	NodeAddress string          `json:"nodeAddress"`
 	NodeHash    string          `json:"nodeHash"`
+	View        uint64          `json:"view"`
 	BlockChain  []BlockInfo     `json:"blockchain"`
 	Sockets     []string        `json:"sockets"`
 	TxPool      TxPoolInfo      `json:"txPool"`
@@ -408,6 +662,7 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 	w.Header().Set("Content-Type", "application/json")
 	nodeAddress := fmt.Sprintf("http://%s:%d", node.Host, node.Port)
 	nodeHash := chain_util.BytesToHex(node.Wallet.publicKey)[:6]
+	mutex.Lock()
 	blockChain := make([]BlockInfo, 0, len(node.Blockchain.chain))
 	for _, block := range node.Blockchain.chain {
 		blockChain = append(blockChain, BlockInfo{
@@ -423,7 +678,7 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 	txPool := TxPoolInfo{
 		Waiting:    make([]TxPoolItem, len(node.TxPool.pool)),
 		InProgress: make([]TxPoolItem, 0, len(node.TxPool.inProgress)),
-		Committed:  make([]TxPoolItem, 0, len(node.TxPool.committed)),
+		Committed:  make([]AccountNonce, 0, len(node.TxPool.nonces)),
 	}
 	for i, transaction := range node.TxPool.pool {
 		txPool.Waiting[i] = TxPoolItem{
@@ -437,10 +692,10 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 			PubKey: chain_util.BytesToHex(transaction.From)[:6],
 		})
 	}
-	for _, transaction := range node.TxPool.committed {
-		txPool.Committed = append(txPool.Committed, TxPoolItem{
-			Hash:   chain_util.BytesToHex(transaction.Hash)[:6],
-			PubKey: chain_util.BytesToHex(transaction.From)[:6],
+	for from, nonce := range node.TxPool.nonces {
+		txPool.Committed = append(txPool.Committed, AccountNonce{
+			PubKey: from.Hex()[:6],
+			Nonce:  nonce,
 		})
 	}
 
@@ -452,35 +707,35 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 		})
 	}
 	preparePool := make([]MsgPoolItem, 0, len(node.PreparePool.mapPool))
-	for blockHash, msgs := range node.PreparePool.mapPool {
+	for _, msgs := range node.PreparePool.mapPool {
 		fromWhos := make([]string, 0, len(msgs))
 		for _, msg := range msgs {
 			fromWhos = append(fromWhos, chain_util.BytesToHex(msg.PublicKey)[:6])
 		}
 		preparePool = append(preparePool, MsgPoolItem{
-			BlockHash: blockHash[:6],
+			BlockHash: chain_util.BytesToHex(msgs[0].BlockHash)[:6],
 			FromWhos:  fromWhos,
 		})
 	}
 	commitPool := make([]MsgPoolItem, 0, len(node.CommitPool.mapPool))
-	for blockHash, msgs := range node.CommitPool.mapPool {
+	for _, msgs := range node.CommitPool.mapPool {
 		fromWhos := make([]string, 0, len(msgs))
 		for _, msg := range msgs {
 			fromWhos = append(fromWhos, chain_util.BytesToHex(msg.PublicKey)[:6])
 		}
 		commitPool = append(commitPool, MsgPoolItem{
-			BlockHash: blockHash[:6],
+			BlockHash: chain_util.BytesToHex(msgs[0].BlockHash)[:6],
 			FromWhos:  fromWhos,
 		})
 	}
 	rcPool := make([]MsgPoolItem, 0, len(node.RCPool.mapPool))
-	for blockHash, msgs := range node.RCPool.mapPool {
+	for _, msgs := range node.RCPool.mapPool {
 		fromWhos := make([]string, 0, len(msgs))
 		for _, msg := range msgs {
 			fromWhos = append(fromWhos, chain_util.BytesToHex(msg.PublicKey)[:6])
 		}
 		rcPool = append(rcPool, MsgPoolItem{
-			BlockHash: blockHash[:6],
+			BlockHash: chain_util.BytesToHex(msgs[0].BlockHash)[:6],
 			FromWhos:  fromWhos,
 		})
 	}
@@ -488,6 +743,7 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 	data := Data{
 		NodeAddress: nodeAddress,
 		NodeHash:    nodeHash,
+		View:        node.Blockchain.View(),
 		BlockChain:  blockChain,
 		Sockets:     sockets,
 		TxPool:      txPool,
@@ -496,6 +752,7 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 		CommitPool:  commitPool,
 		RCPool:      rcPool,
 	}
+	mutex.Unlock()
 
 	err := json.NewEncoder(w).Encode(data)
 	if err != nil {
@@ -503,12 +760,171 @@ func (node *Node) queryNodeInfo2Handler(w http.ResponseWriter, r *http.Request)
 	}
 }
 
+// queryTxProofHandler returns the Merkle inclusion proof of a committed
+// tx, given by its hash
+func (node *Node) queryTxProofHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	txHash, err := chain_util.HexToBytes(r.PathValue("hash"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid tx hash, %v", err), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	block, _, found := node.Blockchain.FindTx(txHash)
+	mutex.Unlock()
+	if !found {
+		http.Error(w, fmt.Sprintf("tx [%s] not committed", r.PathValue("hash")), http.StatusNotFound)
+		return
+	}
+	proof := NewTxProof(*block, txHash)
+	err = json.NewEncoder(w).Encode(proof)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// queryStateHandler returns the value of a state key with its Merkle
+// proof, at the latest height or at the height given by `?height=`
+func (node *Node) queryStateHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	key := r.PathValue("key")
+	mutex.Lock()
+	defer mutex.Unlock()
+	height := node.Blockchain.Height()
+	if raw := r.URL.Query().Get("height"); raw != "" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid height [%s]", raw), http.StatusBadRequest)
+			return
+		}
+		height = parsed
+	}
+	sp, _, ok := node.Blockchain.QueryState(key, height)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no state at height [%d]", height), http.StatusNotFound)
+		return
+	}
+	err := json.NewEncoder(w).Encode(sp)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// queryHeaderHandler returns the signed header of the committed block
+// at given height, `latest` selects the tip of the chain
+func (node *Node) queryHeaderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	raw := r.PathValue("height")
+	mutex.Lock()
+	height := node.Blockchain.Height()
+	if raw != "latest" {
+		parsed, err := strconv.ParseUint(raw, 10, 64)
+		if err != nil {
+			mutex.Unlock()
+			http.Error(w, fmt.Sprintf("invalid height [%s]", raw), http.StatusBadRequest)
+			return
+		}
+		height = parsed
+	}
+	block, ok := node.Blockchain.GetBlock(height)
+	mutex.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no block at height [%d]", height), http.StatusNotFound)
+		return
+	}
+	err := json.NewEncoder(w).Encode(NewSignedHeader(*block))
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// queryValidatorsHandler returns the validator set of given height,
+// which is known up to the heights the pipeline may reach
+func (node *Node) queryValidatorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	raw := r.PathValue("height")
+	height, err := strconv.ParseUint(raw, 10, 64)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid height [%s]", raw), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	known := height <= node.Blockchain.Height()+node.Blockchain.depth+1
+	validators := node.Blockchain.ValidatorsAt(height)
+	mutex.Unlock()
+	if !known {
+		http.Error(w, fmt.Sprintf("validators at height [%d] not known yet", height), http.StatusNotFound)
+		return
+	}
+	err = json.NewEncoder(w).Encode(validators)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// queryReplyHandler returns this replica's signed reply for a tx
+func (node *Node) queryReplyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	txId := r.PathValue("id")
+	mutex.Lock()
+	reply, ok := node.ReplyPool.GetReply(txId)
+	mutex.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("no reply for tx [%s]", txId), http.StatusNotFound)
+		return
+	}
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// queryNonceHandler returns the last nonce executed for a sender, so a
+// client knows which nonce to use next
+func (node *Node) queryNonceHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	from, err := chain_util.HexToBytes(r.PathValue("from"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid public key, %v", err), http.StatusBadRequest)
+		return
+	}
+	mutex.Lock()
+	nonce := node.Blockchain.Nonce(from)
+	mutex.Unlock()
+	err = json.NewEncoder(w).Encode(AccountNonce{
+		PubKey: chain_util.BytesToHex(from),
+		Nonce:  nonce,
+	})
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// queryMempoolMetricsHandler returns the tx pool's admission metrics
+func (node *Node) queryMempoolMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	mutex.Lock()
+	metrics := node.TxPool.Metrics()
+	mutex.Unlock()
+	err := json.NewEncoder(w).Encode(metrics)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (node *Node) resetHandler(w http.ResponseWriter, r *http.Request) {
+	mutex.Lock()
+	defer mutex.Unlock()
 	node.Blockchain.Clear()
 	node.TxPool.Clear()
 	node.BlockPool.Clear()
 	node.PreparePool.Clear()
 	node.CommitPool.Clear()
 	node.RCPool.Clear()
+	node.ReplyPool.Clear()
+	node.ViewChangePool.Clear()
+	node.FutureBuffer.Clear()
+	node.BlockRequests.Clear()
+	node.RequestTimers.Clear()
 	log.Println("NODE RESET!!!")
 }
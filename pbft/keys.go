@@ -0,0 +1,261 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/**
+Keys of a real deployment. Each node loads its private key from an
+encrypted keystore, see keystore.go, or from a plain key file created
+by the `keygen` command, or from the PRIVATE_KEY_ENV environment
+variable, and every node loads the same genesis file
+listing the validators' public keys and powers. The `NODE-{i}` keys of
+NewValidators are derived from public strings and must only be used
+for demos and tests, a node refuses them unless started with
+-INSECURE_DEMO.
+Keys are of any signature scheme, see chain_util/crypto.go, a private
+key is given by its scheme's name and its serialized form, ed25519 if
+no scheme is given. Files written before keys were tagged with their
+scheme, with bare 32-byte ed25519 public keys, are still accepted.
+It features the following methods:
+1. NewRandomWallet
+2. NewWalletFromKey
+3. SaveKeyFile
+4. LoadKeyFile
+5. LoadWalletFromEnv
+6. SaveGenesisFile
+7. LoadGenesisFile
+*/
+
+// KeyFile is the JSON form of a node's keypair, the private key is
+// the hex of its serialized form
+type KeyFile struct {
+	Type       string `json:"type,omitempty"` // scheme name
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey"`
+}
+
+// GenesisFile lists the validators of the chain at genesis
+type GenesisFile struct {
+	Validators Validators `json:"validators"`
+}
+
+// NewRandomWallet creates a wallet with a keypair of given scheme from
+// secure randomness
+func NewRandomWallet(scheme chain_util.Scheme) (*Wallet, error) {
+	privateKey, err := scheme.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	return NewSignerWallet(NewLocalSigner(privateKey)), nil
+}
+
+// NewWalletFromKey creates a wallet from the hex of a private key of
+// given scheme
+func NewWalletFromKey(schemeName string, keyHex string) (*Wallet, error) {
+	scheme, err := schemeByName(schemeName)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := chain_util.HexToBytes(strings.TrimSpace(keyHex))
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key, %v", err)
+	}
+	privateKey, err := scheme.PrivateKeyFromBytes(raw)
+	if err != nil {
+		return nil, err
+	}
+	return NewSignerWallet(NewLocalSigner(privateKey)), nil
+}
+
+// schemeByName returns the scheme with given name, ed25519 if empty
+func schemeByName(name string) (chain_util.Scheme, error) {
+	if name == "" {
+		scheme, _ := chain_util.SchemeOf(chain_util.KeyTypeEd25519)
+		return scheme, nil
+	}
+	scheme, ok := chain_util.SchemeByName(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown key type [%s]", name)
+	}
+	return scheme, nil
+}
+
+// serializeKey returns the scheme name and serialized private key of a
+// wallet holding its key
+func serializeKey(w Wallet) (string, []byte, error) {
+	privateKey, ok := w.privateKey()
+	if !ok {
+		return "", nil, fmt.Errorf("wallet has no local key")
+	}
+	scheme, ok := chain_util.SchemeOf(w.publicKey.Type())
+	if !ok {
+		return "", nil, fmt.Errorf("wallet has a key of unknown type")
+	}
+	return scheme.Name(), privateKey.Bytes(), nil
+}
+
+// SaveKeyFile writes the wallet's keypair to a file only its owner
+// can read, it never overwrites an existing file
+func SaveKeyFile(path string, w Wallet) error {
+	schemeName, key, err := serializeKey(w)
+	if err != nil {
+		return err
+	}
+	keyFile := KeyFile{
+		Type:       schemeName,
+		PublicKey:  chain_util.BytesToHex(w.publicKey),
+		PrivateKey: chain_util.BytesToHex(key),
+	}
+	return writeNewFile(path, keyFile, 0600)
+}
+
+// LoadKeyFile reads a wallet from a key file, the public key must
+// match the private one
+func LoadKeyFile(path string) (*Wallet, error) {
+	var keyFile KeyFile
+	if err := readJSONFile(path, &keyFile); err != nil {
+		return nil, err
+	}
+	w, err := NewWalletFromKey(keyFile.Type, keyFile.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("key file %s: %v", path, err)
+	}
+	if keyFile.PublicKey != "" && !matchesKey(keyFile.PublicKey, w.publicKey) {
+		return nil, fmt.Errorf("key file %s: public key does not match the private key", path)
+	}
+	return w, nil
+}
+
+// matchesKey checks that the hex of a public key, tagged or a legacy
+// untagged ed25519 key, is the given key
+func matchesKey(keyHex string, pubKey PublicKey) bool {
+	pk, err := chain_util.ParsePublicKey(keyHex)
+	return err == nil && chain_util.Equal(pk, pubKey)
+}
+
+// LoadWalletFromEnv reads a wallet from the `[{scheme}:]{hex}` private
+// key in PRIVATE_KEY_ENV, it returns false if the variable is not set
+func LoadWalletFromEnv() (*Wallet, bool, error) {
+	value, ok := os.LookupEnv(PRIVATE_KEY_ENV)
+	if !ok {
+		return nil, false, nil
+	}
+	schemeName, keyHex, found := strings.Cut(value, ":")
+	if !found {
+		schemeName, keyHex = "", value
+	}
+	w, err := NewWalletFromKey(schemeName, keyHex)
+	if err != nil {
+		return nil, true, fmt.Errorf("%s: %v", PRIVATE_KEY_ENV, err)
+	}
+	return w, true, nil
+}
+
+// SaveGenesisFile writes the validator set of genesis, it never
+// overwrites an existing file
+func SaveGenesisFile(path string, vs Validators) error {
+	return writeNewFile(path, GenesisFile{Validators: vs}, 0644)
+}
+
+// LoadGenesisFile reads the validator set of genesis, every validator
+// must be listed once with a valid key and a positive power
+func LoadGenesisFile(path string) (*GenesisFile, error) {
+	var genesis GenesisFile
+	if err := readJSONFile(path, &genesis); err != nil {
+		return nil, err
+	}
+	vs := genesis.Validators
+	if len(vs.list) == 0 {
+		return nil, fmt.Errorf("genesis file %s: no validators", path)
+	}
+	for i, pubKey := range vs.list {
+		switch {
+		case !pubKey.Valid():
+			return nil, fmt.Errorf("genesis file %s: validator %d has an invalid public key", path, i)
+		case vs.powers[i] == 0:
+			return nil, fmt.Errorf("genesis file %s: validator %d has no power", path, i)
+		}
+	}
+	if len(vs.index) != len(vs.list) {
+		return nil, fmt.Errorf("genesis file %s: duplicate validators", path)
+	}
+	return &genesis, nil
+}
+
+// readJSONFile decodes a JSON file
+func readJSONFile(path string, v any) error {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// writeNewFile encodes v as JSON into a file that must not exist yet
+func writeNewFile(path string, v any, perm os.FileMode) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(raw, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// replaceFile atomically replaces a file with v encoded as JSON, the
+// new content is synced to disk before it replaces the old one and
+// the directory is synced after
+func replaceFile(path string, v any, perm os.FileMode) error {
+	raw, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(raw, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// syncDir syncs a directory, so that a rename in it survives a crash
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
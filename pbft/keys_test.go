@@ -0,0 +1,234 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testScheme returns the scheme with given name
+func testScheme(name string) chain_util.Scheme {
+	scheme, _ := chain_util.SchemeByName(name)
+	return scheme
+}
+
+// testPrivateKey returns the serialized private key of a wallet
+func testPrivateKey(w *Wallet) []byte {
+	privateKey, _ := w.privateKey()
+	return privateKey.Bytes()
+}
+
+func TestKeyFileRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	w, err := NewRandomWallet(testScheme("ed25519"))
+	if err != nil {
+		t.Fatalf("NewRandomWallet failed, %v", err)
+	}
+	if err := SaveKeyFile(path, *w); err != nil {
+		t.Fatalf("SaveKeyFile failed, %v", err)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("key file mode is %v, want 0600", info.Mode().Perm())
+	}
+	loaded, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatalf("LoadKeyFile failed, %v", err)
+	}
+	if !chain_util.Equal(loaded.PublicKey(), w.PublicKey()) {
+		t.Errorf("loaded key does not match the saved one")
+	}
+	if err := SaveKeyFile(path, *w); err == nil {
+		t.Errorf("SaveKeyFile overwrote an existing key file")
+	}
+}
+
+func TestLoadKeyFileRejectsMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.key")
+	w, _ := NewRandomWallet(testScheme("ed25519"))
+	other, _ := NewRandomWallet(testScheme("ed25519"))
+	seed := testPrivateKey(w)
+	keyFile := KeyFile{
+		PublicKey:  chain_util.BytesToHex(other.PublicKey()),
+		PrivateKey: chain_util.BytesToHex(seed),
+	}
+	if err := writeNewFile(path, keyFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadKeyFile(path); err == nil {
+		t.Errorf("key file with a mismatching public key accepted")
+	}
+}
+
+func TestLoadWalletFromEnv(t *testing.T) {
+	w, _ := NewRandomWallet(testScheme("ed25519"))
+	seed := testPrivateKey(w)
+	t.Setenv(PRIVATE_KEY_ENV, chain_util.BytesToHex(seed))
+	loaded, found, err := LoadWalletFromEnv()
+	if err != nil || !found || !chain_util.Equal(loaded.PublicKey(), w.PublicKey()) {
+		t.Errorf("LoadWalletFromEnv = %v, %v, want the saved key", found, err)
+	}
+
+	t.Setenv(PRIVATE_KEY_ENV, "not hex")
+	if _, found, err := LoadWalletFromEnv(); !found || err == nil {
+		t.Errorf("invalid %s accepted", PRIVATE_KEY_ENV)
+	}
+
+	os.Unsetenv(PRIVATE_KEY_ENV)
+	if _, found, _ := LoadWalletFromEnv(); found {
+		t.Errorf("key found with %s unset", PRIVATE_KEY_ENV)
+	}
+}
+
+func TestGenesisFile(t *testing.T) {
+	dir := t.TempDir()
+	vs := NewWeightedValidators(NewValidators(3).list, []uint64{1, 2, 3})
+	path := filepath.Join(dir, "genesis.json")
+	if err := SaveGenesisFile(path, *vs); err != nil {
+		t.Fatalf("SaveGenesisFile failed, %v", err)
+	}
+	genesis, err := LoadGenesisFile(path)
+	if err != nil {
+		t.Fatalf("LoadGenesisFile failed, %v", err)
+	}
+	if !chain_util.Equal(genesis.Validators.Hash(), vs.Hash()) {
+		t.Errorf("loaded validators do not match the saved ones")
+	}
+
+	key := chain_util.BytesToHex(vs.list[0])
+	invalid := map[string]string{
+		"empty":     `{"validators": []}`,
+		"short key": `{"validators": [{"publicKey": "abcd", "power": 1}]}`,
+		"no power":  `{"validators": [{"publicKey": "` + key + `", "power": 0}]}`,
+		"duplicate": `{"validators": [{"publicKey": "` + key + `", "power": 1}, {"publicKey": "` + key + `", "power": 1}]}`,
+	}
+	for name, content := range invalid {
+		path := filepath.Join(dir, name+".json")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadGenesisFile(path); err == nil {
+			t.Errorf("%s genesis file accepted", name)
+		}
+	}
+}
+
+func TestP256Keys(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewRandomWallet(testScheme("p256"))
+	if err != nil {
+		t.Fatalf("NewRandomWallet failed, %v", err)
+	}
+	path := filepath.Join(dir, "node.key")
+	if err := SaveKeyFile(path, *w); err != nil {
+		t.Fatalf("SaveKeyFile failed, %v", err)
+	}
+	if loaded, err := LoadKeyFile(path); err != nil || !chain_util.Equal(loaded.PublicKey(), w.PublicKey()) {
+		t.Errorf("LoadKeyFile of a p256 key failed, %v", err)
+	}
+
+	ks, _ := encryptWallet(*w, []byte("passphrase"), 1000)
+	if decrypted, err := DecryptWallet(*ks, []byte("passphrase")); err != nil || !chain_util.Equal(decrypted.PublicKey(), w.PublicKey()) {
+		t.Errorf("DecryptWallet of a p256 key failed, %v", err)
+	}
+
+	t.Setenv(PRIVATE_KEY_ENV, "p256:"+chain_util.BytesToHex(testPrivateKey(w)))
+	if loaded, _, err := LoadWalletFromEnv(); err != nil || !chain_util.Equal(loaded.PublicKey(), w.PublicKey()) {
+		t.Errorf("LoadWalletFromEnv of a p256 key failed, %v", err)
+	}
+
+	if validator, _, ok := parseGovernance(GovernanceData(w.PublicKey(), 1)); !ok || !chain_util.Equal(validator, w.PublicKey()) {
+		t.Errorf("governance tx of a p256 key rejected")
+	}
+}
+
+func TestMixedValidators(t *testing.T) {
+	wallets := make([]*Wallet, 4)
+	keys := make([]PublicKey, len(wallets))
+	for i := range wallets {
+		wallets[i], _ = NewRandomWallet(testScheme([]string{"ed25519", "p256"}[i%2]))
+		keys[i] = wallets[i].PublicKey()
+	}
+	vs := NewValidatorsFromKeys(keys)
+	primary, backup := NewBlockchain(*vs), NewBlockchain(*vs)
+	primary.depth, backup.depth = 1, 1
+
+	for height := uint64(1); height <= 4; height++ {
+		var proposer *Wallet
+		for _, w := range wallets {
+			if chain_util.Equal(w.PublicKey(), primary.GetProposer()) {
+				proposer = w
+			}
+		}
+		block := primary.CreateBlock(*proposer, []Transaction{*wallets[0].CreateTx("data")})
+		if !backup.VerifyBlock(*block) {
+			t.Fatalf("block of a %d key rejected at height %d", proposer.PublicKey().Type(), height)
+		}
+		commitPool := NewMsgPool()
+		for _, w := range wallets[1:] {
+			commitPool.AddMsg2Pool(*w.CreateMsg(MsgCommit, block.Hash, height, 0))
+		}
+		for _, bc := range []*Blockchain{primary, backup} {
+			blockPool := NewBlockPool()
+			blockPool.AddBlock2Pool(*block)
+			if _, ok := bc.AddUpdatedBlock2Chain(block.Hash, *blockPool, *NewMsgPool(), *commitPool); !ok {
+				t.Fatalf("AddUpdatedBlock2Chain failed at height %d", height)
+			}
+		}
+		committed, _ := backup.GetBlock(height)
+		if !NewSignedHeader(*committed).VerifyCommits(*vs) {
+			t.Errorf("mixed commit quorum rejected at height %d", height)
+		}
+	}
+}
+
+func TestBeaconIgnoresRandomizedSignatures(t *testing.T) {
+	ed, _ := NewRandomWallet(testScheme("ed25519"))
+	p256, _ := NewRandomWallet(testScheme("p256"))
+	hash, parent := []byte("block"), []byte("parent")
+	edCommit := *ed.CreateMsg(MsgCommit, hash, 1, 0)
+	first := []Message{edCommit, *p256.CreateMsg(MsgCommit, hash, 1, 0)}
+	// a p256 key signs the same COMMIT again with another signature
+	second := []Message{edCommit, *p256.CreateMsg(MsgCommit, hash, 1, 0)}
+	if chain_util.Equal(first[1].Signature, second[1].Signature) {
+		t.Fatalf("p256 signatures should be randomized")
+	}
+	if !chain_util.Equal(BeaconFrom(parent, first), BeaconFrom(parent, second)) {
+		t.Errorf("a re-signed p256 COMMIT should not change the beacon")
+	}
+	if chain_util.Equal(BeaconFrom(parent, first), BeaconFrom(parent, first[1:])) {
+		t.Errorf("ed25519 COMMITs should feed the beacon")
+	}
+}
+
+func TestLegacyUntaggedKeys(t *testing.T) {
+	dir := t.TempDir()
+	w, _ := NewRandomWallet(testScheme("ed25519"))
+	// files written before keys were tagged hold bare ed25519 keys
+	untagged := chain_util.BytesToHex(w.PublicKey()[1:])
+
+	path := filepath.Join(dir, "genesis.json")
+	content := `{"validators": [{"publicKey": "` + untagged + `", "power": 1}]}`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	genesis, err := LoadGenesisFile(path)
+	if err != nil || !genesis.Validators.ValidatorExists(w.PublicKey()) {
+		t.Errorf("genesis file with an untagged key not loaded, %v", err)
+	}
+
+	path = filepath.Join(dir, "node.key")
+	keyFile := KeyFile{PublicKey: untagged, PrivateKey: chain_util.BytesToHex(testPrivateKey(w))}
+	if err := writeNewFile(path, keyFile, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadKeyFile(path); err != nil || !chain_util.Equal(loaded.PublicKey(), w.PublicKey()) {
+		t.Errorf("key file with an untagged key not loaded, %v", err)
+	}
+
+	ks, _ := encryptWallet(*w, []byte("passphrase"), 1000)
+	ks.PublicKey = untagged
+	if _, err := DecryptWallet(*ks, []byte("passphrase")); err != nil {
+		t.Errorf("keystore with an untagged key not decrypted, %v", err)
+	}
+}
@@ -0,0 +1,179 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"fmt"
+)
+
+/**
+A Keystore holds a private key encrypted under a passphrase, so a key
+at rest is useless without it. The key encrypting the private key is
+derived from the passphrase and a random salt with PBKDF2-HMAC-SHA256,
+and the private key is sealed with AES-256-GCM, which also detects a
+wrong passphrase or a tampered file. The public key is stored in
+clear, so it can be read without the passphrase.
+It features the following methods:
+1. EncryptWallet
+2. DecryptWallet
+3. SaveKeystore
+4. LoadKeystore
+5. UnlockKeystore
+6. ChangePassphrase
+*/
+
+const (
+	keystoreVersion = 1
+	keystoreCipher  = "aes-256-gcm"
+	keystoreKDF     = "pbkdf2-sha256"
+	keystoreKeyLen  = 32
+	keystoreSaltLen = 32
+)
+
+type Keystore struct {
+	Version   int            `json:"version"`
+	KeyType   string         `json:"keyType,omitempty"` // scheme name, ed25519 if empty
+	PublicKey string         `json:"publicKey"`
+	Crypto    KeystoreCrypto `json:"crypto"`
+}
+
+type KeystoreCrypto struct {
+	Cipher     string    `json:"cipher"`
+	Nonce      string    `json:"nonce"`
+	Ciphertext string    `json:"ciphertext"` // the encrypted private key
+	KDF        string    `json:"kdf"`
+	KDFParams  KDFParams `json:"kdfParams"`
+}
+
+type KDFParams struct {
+	Iterations int    `json:"iterations"`
+	Salt       string `json:"salt"`
+	KeyLen     int    `json:"keyLen"`
+}
+
+// EncryptWallet encrypts the wallet's private key under given passphrase
+func EncryptWallet(w Wallet, passphrase []byte) (*Keystore, error) {
+	return encryptWallet(w, passphrase, KEYSTORE_KDF_ITERATIONS)
+}
+
+// encryptWallet encrypts the wallet's private key with given KDF cost
+func encryptWallet(w Wallet, passphrase []byte, iterations int) (*Keystore, error) {
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("empty passphrase")
+	}
+	salt, err := chain_util.RandomBytes(keystoreSaltLen)
+	if err != nil {
+		return nil, err
+	}
+	schemeName, privateKey, err := serializeKey(w)
+	if err != nil {
+		return nil, err
+	}
+	key := chain_util.PBKDF2(passphrase, salt, iterations, keystoreKeyLen)
+	nonce, ciphertext, err := chain_util.Seal(key, privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return &Keystore{
+		Version:   keystoreVersion,
+		KeyType:   schemeName,
+		PublicKey: chain_util.BytesToHex(w.publicKey),
+		Crypto: KeystoreCrypto{
+			Cipher:     keystoreCipher,
+			Nonce:      chain_util.BytesToHex(nonce),
+			Ciphertext: chain_util.BytesToHex(ciphertext),
+			KDF:        keystoreKDF,
+			KDFParams: KDFParams{
+				Iterations: iterations,
+				Salt:       chain_util.BytesToHex(salt),
+				KeyLen:     keystoreKeyLen,
+			},
+		},
+	}, nil
+}
+
+// DecryptWallet decrypts the private key of a keystore, it fails on a
+// wrong passphrase
+func DecryptWallet(ks Keystore, passphrase []byte) (*Wallet, error) {
+	c := ks.Crypto
+	switch {
+	case ks.Version != keystoreVersion:
+		return nil, fmt.Errorf("unsupported keystore version %d", ks.Version)
+	case c.Cipher != keystoreCipher:
+		return nil, fmt.Errorf("unsupported cipher [%s]", c.Cipher)
+	case c.KDF != keystoreKDF:
+		return nil, fmt.Errorf("unsupported kdf [%s]", c.KDF)
+	case c.KDFParams.Iterations < 1 || c.KDFParams.KeyLen != keystoreKeyLen:
+		return nil, fmt.Errorf("invalid kdf params")
+	}
+	salt, err := chain_util.HexToBytes(c.KDFParams.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt, %v", err)
+	}
+	nonce, err := chain_util.HexToBytes(c.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("invalid nonce, %v", err)
+	}
+	ciphertext, err := chain_util.HexToBytes(c.Ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ciphertext, %v", err)
+	}
+	key := chain_util.PBKDF2(passphrase, salt, c.KDFParams.Iterations, c.KDFParams.KeyLen)
+	raw, err := chain_util.Open(key, nonce, ciphertext)
+	if err != nil {
+		return nil, fmt.Errorf("wrong passphrase or corrupted keystore")
+	}
+	w, err := NewWalletFromKey(ks.KeyType, chain_util.BytesToHex(raw))
+	if err != nil {
+		return nil, err
+	}
+	if !matchesKey(ks.PublicKey, w.publicKey) {
+		return nil, fmt.Errorf("public key does not match the private key")
+	}
+	return w, nil
+}
+
+// SaveKeystore encrypts the wallet's private key into a file only its
+// owner can read, it never overwrites an existing file
+func SaveKeystore(path string, w Wallet, passphrase []byte) error {
+	ks, err := EncryptWallet(w, passphrase)
+	if err != nil {
+		return err
+	}
+	return writeNewFile(path, ks, 0600)
+}
+
+// LoadKeystore reads a keystore without decrypting it
+func LoadKeystore(path string) (*Keystore, error) {
+	var ks Keystore
+	if err := readJSONFile(path, &ks); err != nil {
+		return nil, err
+	}
+	return &ks, nil
+}
+
+// UnlockKeystore reads a wallet from a keystore with given passphrase
+func UnlockKeystore(path string, passphrase []byte) (*Wallet, error) {
+	ks, err := LoadKeystore(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := DecryptWallet(*ks, passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("keystore %s: %v", path, err)
+	}
+	return w, nil
+}
+
+// ChangePassphrase re-encrypts a keystore under a new passphrase and a
+// new salt, the file is replaced atomically so the key is never lost
+func ChangePassphrase(path string, oldPassphrase []byte, newPassphrase []byte) error {
+	w, err := UnlockKeystore(path, oldPassphrase)
+	if err != nil {
+		return err
+	}
+	ks, err := EncryptWallet(*w, newPassphrase)
+	if err != nil {
+		return err
+	}
+	return replaceFile(path, ks, 0600)
+}
@@ -0,0 +1,76 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeystoreRoundTrip(t *testing.T) {
+	w, _ := NewRandomWallet(testScheme("ed25519"))
+	ks, err := encryptWallet(*w, []byte("passphrase"), 1000)
+	if err != nil {
+		t.Fatalf("encryptWallet failed, %v", err)
+	}
+	if ks.PublicKey != chain_util.BytesToHex(w.PublicKey()) {
+		t.Errorf("keystore public key is %s, want %s", ks.PublicKey, chain_util.BytesToHex(w.PublicKey()))
+	}
+	decrypted, err := DecryptWallet(*ks, []byte("passphrase"))
+	if err != nil || !chain_util.Equal(decrypted.PublicKey(), w.PublicKey()) {
+		t.Errorf("DecryptWallet failed, %v", err)
+	}
+	if _, err := DecryptWallet(*ks, []byte("wrong")); err == nil {
+		t.Errorf("keystore decrypted with a wrong passphrase")
+	}
+	if _, err := encryptWallet(*w, nil, 1000); err == nil {
+		t.Errorf("keystore encrypted with an empty passphrase")
+	}
+}
+
+func TestKeystoreRejectsTampering(t *testing.T) {
+	w, _ := NewRandomWallet(testScheme("ed25519"))
+	other, _ := NewRandomWallet(testScheme("ed25519"))
+	ks, _ := encryptWallet(*w, []byte("passphrase"), 1000)
+
+	swapped := *ks
+	swapped.PublicKey = chain_util.BytesToHex(other.PublicKey())
+	if _, err := DecryptWallet(swapped, []byte("passphrase")); err == nil {
+		t.Errorf("keystore with a swapped public key accepted")
+	}
+
+	weakened := *ks
+	weakened.Crypto.KDFParams.Iterations = 0
+	if _, err := DecryptWallet(weakened, []byte("passphrase")); err == nil {
+		t.Errorf("keystore without kdf iterations accepted")
+	}
+
+	tampered := *ks
+	ciphertext, _ := chain_util.HexToBytes(ks.Crypto.Ciphertext)
+	ciphertext[0] ^= 1
+	tampered.Crypto.Ciphertext = chain_util.BytesToHex(ciphertext)
+	if _, err := DecryptWallet(tampered, []byte("passphrase")); err == nil {
+		t.Errorf("keystore with a tampered ciphertext accepted")
+	}
+}
+
+func TestChangePassphrase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.json")
+	w, _ := NewRandomWallet(testScheme("ed25519"))
+	ks, _ := encryptWallet(*w, []byte("old"), 1000)
+	if err := writeNewFile(path, ks, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ChangePassphrase(path, []byte("wrong"), []byte("new")); err == nil {
+		t.Errorf("passphrase changed with a wrong passphrase")
+	}
+	if err := ChangePassphrase(path, []byte("old"), []byte("new")); err != nil {
+		t.Fatalf("ChangePassphrase failed, %v", err)
+	}
+	if _, err := UnlockKeystore(path, []byte("old")); err == nil {
+		t.Errorf("keystore unlocked with the old passphrase")
+	}
+	unlocked, err := UnlockKeystore(path, []byte("new"))
+	if err != nil || !chain_util.Equal(unlocked.PublicKey(), w.PublicKey()) {
+		t.Errorf("UnlockKeystore with the new passphrase failed, %v", err)
+	}
+}
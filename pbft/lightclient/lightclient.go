@@ -0,0 +1,227 @@
+package lightclient
+
+import (
+	"consensus-algorithms-with-golang/pbft"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+/**
+LightClient follows the chain without trusting the node it talks to.
+It starts from a trusted genesis hash and validator set, downloads
+signed headers from any node, and only accepts a header if it extends
+the last verified one, commits to the trusted validator set, is
+signed by the proposer the chain's election rule elects for its
+height and view, and carries COMMIT signatures from a quorum (2f+1)
+of distinct validators. The election runs on the verified headers, so
+the client must use the same strategy as the nodes, see SetElection.
+Tx and state queries are answered by nodes with Merkle proofs, which
+are checked against the verified headers.
+
+NOTE:
+The client starts from the validator set of genesis. Every header
+commits to the set of the next block, so when it changes, the client
+downloads the new set from a node and only trusts it if it matches
+the hash certified by the current set.
+
+It features the following methods:
+1. NewLightClient
+2. SetElection
+3. Height
+4. Header
+5. VerifyHeader
+6. Sync
+7. QueryTx
+8. QueryState
+*/
+
+type LightClient struct {
+	nodes      []string // http addresses, e.g. "http://localhost:18080"
+	validators pbft.Validators
+	election   pbft.ProposerElection
+	headers    []pbft.SignedHeader // verified headers, indexed by height
+	client     *http.Client
+}
+
+// NewLightClient creates a light client that trusts the given genesis
+// hash and validator set
+func NewLightClient(genesisHash []byte, validators pbft.Validators, nodes []string) *LightClient {
+	// the genesis beacon seeds the beacon election
+	genesis := pbft.SignedHeader{BlockHeader: pbft.Genesis().BlockHeader}
+	genesis.Hash = genesisHash
+	election, _ := pbft.NewProposerElection(pbft.PROPOSER_ELECTION)
+	return &LightClient{
+		nodes:      nodes,
+		validators: validators,
+		election:   election,
+		headers:    []pbft.SignedHeader{genesis},
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// SetElection sets the proposer election strategy, it must be the one
+// of the chain's nodes
+func (lc *LightClient) SetElection(election pbft.ProposerElection) {
+	lc.election = election
+}
+
+// Height returns the height of the latest verified header
+func (lc *LightClient) Height() uint64 {
+	return uint64(len(lc.headers) - 1)
+}
+
+// Header returns the verified header at given height
+func (lc *LightClient) Header(height uint64) (*pbft.SignedHeader, bool) {
+	if height >= uint64(len(lc.headers)) {
+		return nil, false
+	}
+	header := lc.headers[height]
+	return &header, true
+}
+
+// VerifyHeader checks that a header extends the latest verified one
+// and is proposed by the elected proposer and certified by the
+// validator set
+func (lc *LightClient) VerifyHeader(sh pbft.SignedHeader) error {
+	last := lc.headers[len(lc.headers)-1]
+	proposer, _ := pbft.ElectProposer(lc.election, lc.validators, pbft.PIPELINE_DEPTH, sh.Height, sh.View, lc.blockAt)
+	switch {
+	case sh.Height != last.Height+1:
+		return fmt.Errorf("header height %d does not follow %d", sh.Height, last.Height)
+	case !chain_util.Equal(sh.LastHash, last.Hash):
+		return fmt.Errorf("header [%d] last hash does not match the verified chain", sh.Height)
+	case !chain_util.Equal(sh.ValidatorsHash, lc.validators.Hash()):
+		return fmt.Errorf("header [%d] commits to another validator set", sh.Height)
+	case !chain_util.Equal(sh.Proposer, proposer):
+		return fmt.Errorf("header [%d] proposer was not elected for view %d", sh.Height, sh.View)
+	case !sh.VerifyHash():
+		return fmt.Errorf("header [%d] hash or proposer signature is invalid", sh.Height)
+	case !sh.VerifyLastCommit():
+		return fmt.Errorf("header [%d] last commit does not match its hash", sh.Height)
+	case !sh.VerifyCommits(lc.validators):
+		return fmt.Errorf("header [%d] lacks a quorum of commit signatures", sh.Height)
+	}
+	return nil
+}
+
+// blockAt returns the header and last commit verified at given height,
+// for the proposer election
+func (lc *LightClient) blockAt(height uint64) (pbft.Block, bool) {
+	header, ok := lc.Header(height)
+	if !ok {
+		return pbft.Block{}, false
+	}
+	return pbft.Block{BlockHeader: header.BlockHeader, BlockBody: pbft.BlockBody{LastCommit: header.LastCommit}}, true
+}
+
+// Sync downloads and verifies all headers up to the latest one known
+// by the nodes
+func (lc *LightClient) Sync() error {
+	var latest pbft.SignedHeader
+	if err := lc.get("/header/latest", &latest); err != nil {
+		return err
+	}
+	return lc.syncTo(latest.Height)
+}
+
+// syncTo downloads and verifies headers up to given height
+func (lc *LightClient) syncTo(height uint64) error {
+	for lc.Height() < height {
+		var sh pbft.SignedHeader
+		if err := lc.get(fmt.Sprintf("/header/%d", lc.Height()+1), &sh); err != nil {
+			return err
+		}
+		if err := lc.VerifyHeader(sh); err != nil {
+			return err
+		}
+		if err := lc.followValidators(sh); err != nil {
+			return err
+		}
+		lc.headers = append(lc.headers, sh)
+	}
+	return nil
+}
+
+// followValidators moves to the validator set of the block after a
+// verified header, if it changes
+func (lc *LightClient) followValidators(sh pbft.SignedHeader) error {
+	if chain_util.Equal(sh.NextValidatorsHash, lc.validators.Hash()) {
+		return nil
+	}
+	var next pbft.Validators
+	if err := lc.get(fmt.Sprintf("/validators/%d", sh.Height+1), &next); err != nil {
+		return err
+	}
+	if !chain_util.Equal(next.Hash(), sh.NextValidatorsHash) {
+		return fmt.Errorf("validators at height %d do not match header [%d]", sh.Height+1, sh.Height)
+	}
+	lc.validators = next
+	return nil
+}
+
+// QueryTx fetches the inclusion proof of the committed tx with given
+// hash and checks it against the verified header of its block
+func (lc *LightClient) QueryTx(txHash []byte) (*pbft.TxProof, error) {
+	var proof pbft.TxProof
+	if err := lc.get("/tx/"+chain_util.BytesToHex(txHash)+"/proof", &proof); err != nil {
+		return nil, err
+	}
+	if err := lc.syncTo(proof.Header.Height); err != nil {
+		return nil, err
+	}
+	header := lc.headers[proof.Header.Height]
+	if !chain_util.Equal(proof.Tx.Hash, txHash) || !pbft.VerifyTxProof(proof, header.Hash) {
+		return nil, fmt.Errorf("tx [%s] proof does not match header [%d]", chain_util.BytesToHex(txHash), proof.Header.Height)
+	}
+	return &proof, nil
+}
+
+// QueryState fetches a state key at given height and checks the proof
+// against the app hash of the verified header at that height
+func (lc *LightClient) QueryState(key string, height uint64) (*pbft.StateProof, error) {
+	if err := lc.syncTo(height); err != nil {
+		return nil, err
+	}
+	var sp pbft.StateProof
+	path := fmt.Sprintf("/state/%s?height=%d", url.PathEscape(key), height)
+	if err := lc.get(path, &sp); err != nil {
+		return nil, err
+	}
+	header := lc.headers[height]
+	if sp.Key != key || sp.Height != height || !pbft.VerifyStateProof(sp, header.AppHash) {
+		return nil, fmt.Errorf("state [%s] proof does not match header [%d]", key, height)
+	}
+	return &sp, nil
+}
+
+// get fetches a JSON resource from the first node that answers
+func (lc *LightClient) get(path string, v any) error {
+	var lastErr error
+	for _, node := range lc.nodes {
+		resp, err := lc.client.Get(node + path)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			lastErr = fmt.Errorf("node [%s] answered %s for [%s]", node, resp.Status, path)
+			continue
+		}
+		err = json.NewDecoder(resp.Body).Decode(v)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no node to query")
+	}
+	return lastErr
+}
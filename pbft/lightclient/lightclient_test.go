@@ -0,0 +1,251 @@
+package lightclient
+
+import (
+	"consensus-algorithms-with-golang/pbft"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newTestChain commits `n` blocks of one tx each, signed by all validators
+func newTestChain(t *testing.T, n int, forgeCommits bool) (*pbft.Blockchain, []pbft.Transaction) {
+	validators := pbft.NewValidators(pbft.NUM_OF_NODES)
+	bc := pbft.NewBlockchain(*validators)
+	wallets := make([]*pbft.Wallet, pbft.NUM_OF_NODES)
+	for i := range wallets {
+		wallets[i] = pbft.NewWallet("NODE-" + strconv.Itoa(i))
+	}
+	if forgeCommits {
+		wallets = []*pbft.Wallet{pbft.NewWallet("outsider")}
+	}
+	txs := make([]pbft.Transaction, 0, n)
+	for i := range n {
+		tx := wallets[0].CreateTx("key-" + strconv.Itoa(i) + "=value")
+		txs = append(txs, *tx)
+		commitTestBlock(bc, []pbft.Transaction{*tx}, wallets)
+	}
+	if bc.Height() != uint64(n) {
+		t.Fatalf("test chain should have height %d, got %d", n, bc.Height())
+	}
+	return bc, txs
+}
+
+// commitTestBlock commits a block with given txs, signed by the given
+// wallets and proposed by the elected one among them, if any
+func commitTestBlock(bc *pbft.Blockchain, txs []pbft.Transaction, signers []*pbft.Wallet) {
+	proposer := signers[0]
+	for _, w := range signers {
+		if chain_util.Equal(w.PublicKey(), bc.GetProposer()) {
+			proposer = w
+		}
+	}
+	commitTestBlockBy(bc, txs, proposer, signers)
+}
+
+// commitTestBlockBy commits a block with given txs, proposed by the
+// given wallet and signed by the given wallets
+func commitTestBlockBy(bc *pbft.Blockchain, txs []pbft.Transaction, proposer *pbft.Wallet, signers []*pbft.Wallet) {
+	block := bc.CreateBlock(*proposer, txs)
+	blockPool, preparePool, commitPool := pbft.NewBlockPool(), pbft.NewMsgPool(), pbft.NewMsgPool()
+	blockPool.AddBlock2Pool(*block)
+	for _, w := range signers {
+		commitPool.AddMsg2Pool(*w.CreateMsg(pbft.MsgCommit, block.Hash, block.Height, 0))
+	}
+	bc.AddUpdatedBlock2Chain(block.Hash, *blockPool, *preparePool, *commitPool)
+}
+
+// newTestServer serves the light client endpoints of a node
+func newTestServer(bc *pbft.Blockchain) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /header/{height}", func(w http.ResponseWriter, r *http.Request) {
+		height := bc.Height()
+		if raw := r.PathValue("height"); raw != "latest" {
+			height, _ = strconv.ParseUint(raw, 10, 64)
+		}
+		block, ok := bc.GetBlock(height)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(pbft.NewSignedHeader(*block))
+	})
+	mux.HandleFunc("GET /tx/{hash}/proof", func(w http.ResponseWriter, r *http.Request) {
+		txHash, _ := chain_util.HexToBytes(r.PathValue("hash"))
+		block, _, ok := bc.FindTx(txHash)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(pbft.NewTxProof(*block, txHash))
+	})
+	mux.HandleFunc("GET /validators/{height}", func(w http.ResponseWriter, r *http.Request) {
+		height, _ := strconv.ParseUint(r.PathValue("height"), 10, 64)
+		json.NewEncoder(w).Encode(bc.ValidatorsAt(height))
+	})
+	mux.HandleFunc("GET /state/{key}", func(w http.ResponseWriter, r *http.Request) {
+		height, _ := strconv.ParseUint(r.URL.Query().Get("height"), 10, 64)
+		sp, _, ok := bc.QueryState(r.PathValue("key"), height)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(sp)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestLightClient_Sync(t *testing.T) {
+	bc, txs := newTestChain(t, 3, false)
+	server := newTestServer(bc)
+	defer server.Close()
+
+	genesis, _ := bc.GetBlock(0)
+	lc := NewLightClient(genesis.Hash, *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	if err := lc.Sync(); err != nil {
+		t.Fatalf("Sync failed, %v", err)
+	}
+	if lc.Height() != 3 {
+		t.Errorf("Sync should reach height 3, got %d", lc.Height())
+	}
+
+	proof, err := lc.QueryTx(txs[1].Hash)
+	if err != nil || proof.Header.Height != 2 {
+		t.Errorf("QueryTx failed, %v", err)
+	}
+	sp, err := lc.QueryState("key-1", 2)
+	if err != nil || !sp.Exists || sp.Value != "value" {
+		t.Errorf("QueryState failed, %v", err)
+	}
+	sp, err = lc.QueryState("key-2", 1)
+	if err != nil || sp.Exists {
+		t.Errorf("QueryState should prove key-2 absent at height 1, %v", err)
+	}
+}
+
+func TestLightClient_RejectsForgedCommits(t *testing.T) {
+	bc, _ := newTestChain(t, 1, true)
+	server := newTestServer(bc)
+	defer server.Close()
+
+	genesis, _ := bc.GetBlock(0)
+	lc := NewLightClient(genesis.Hash, *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	if err := lc.Sync(); err == nil {
+		t.Errorf("Sync should reject headers committed by non-validators")
+	}
+	if lc.Height() != 0 {
+		t.Errorf("Sync should not accept forged headers, got height %d", lc.Height())
+	}
+
+	lc = NewLightClient([]byte("other genesis"), *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	if err := lc.Sync(); err == nil {
+		t.Errorf("Sync should reject a chain with another genesis")
+	}
+}
+
+func TestLightClient_RejectsProofOfAnotherTx(t *testing.T) {
+	bc, txs := newTestChain(t, 2, false)
+	honest := newTestServer(bc)
+	defer honest.Close()
+	// the node answers every tx query with the proof of the first tx
+	block, _, _ := bc.FindTx(txs[0].Hash)
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /tx/{hash}/proof", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(pbft.NewTxProof(*block, txs[0].Hash))
+	})
+	mux.Handle("/", honest.Config.Handler)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	genesis, _ := bc.GetBlock(0)
+	lc := NewLightClient(genesis.Hash, *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	if _, err := lc.QueryTx(txs[0].Hash); err != nil {
+		t.Errorf("QueryTx failed, %v", err)
+	}
+	if _, err := lc.QueryTx(txs[1].Hash); err == nil {
+		t.Errorf("QueryTx should reject the proof of another tx")
+	}
+}
+
+func TestLightClient_RejectsUnelectedProposer(t *testing.T) {
+	bc := pbft.NewBlockchain(*pbft.NewValidators(pbft.NUM_OF_NODES))
+	wallets := make([]*pbft.Wallet, pbft.NUM_OF_NODES)
+	for i := range wallets {
+		wallets[i] = pbft.NewWallet("NODE-" + strconv.Itoa(i))
+	}
+	// NODE-1 is a validator but NODE-0 is elected for height 1
+	commitTestBlockBy(bc, nil, wallets[1], wallets)
+	if bc.Height() != 1 {
+		t.Fatalf("test chain should have height 1, got %d", bc.Height())
+	}
+	server := newTestServer(bc)
+	defer server.Close()
+
+	genesis, _ := bc.GetBlock(0)
+	lc := NewLightClient(genesis.Hash, *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	if err := lc.Sync(); err == nil || lc.Height() != 0 {
+		t.Errorf("Sync should reject a header from a validator that was not elected")
+	}
+}
+
+func TestLightClient_ReputationElection(t *testing.T) {
+	election, _ := pbft.NewProposerElection(pbft.ElectionReputation)
+	bc := pbft.NewBlockchain(*pbft.NewValidators(pbft.NUM_OF_NODES))
+	bc.SetElection(election)
+	wallets := make([]*pbft.Wallet, pbft.NUM_OF_NODES)
+	for i := range wallets {
+		wallets[i] = pbft.NewWallet("NODE-" + strconv.Itoa(i))
+	}
+	// the last commits scored by the election start after PIPELINE_DEPTH heights
+	for range 4 * pbft.PIPELINE_DEPTH {
+		commitTestBlock(bc, nil, wallets)
+	}
+	server := newTestServer(bc)
+	defer server.Close()
+
+	genesis, _ := bc.GetBlock(0)
+	lc := NewLightClient(genesis.Hash, *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	lc.SetElection(election)
+	if err := lc.Sync(); err != nil || lc.Height() != bc.Height() {
+		t.Errorf("Sync should elect proposers from the verified last commits, %v", err)
+	}
+}
+
+func TestLightClient_FollowsValidatorChanges(t *testing.T) {
+	bc := pbft.NewBlockchain(*pbft.NewValidators(pbft.NUM_OF_NODES))
+	wallets := make([]*pbft.Wallet, pbft.NUM_OF_NODES+1)
+	for i := range wallets {
+		wallets[i] = pbft.NewWallet("NODE-" + strconv.Itoa(i))
+	}
+	// NODE-3 replaces NODE-0 from the next epoch on
+	var votes []pbft.Transaction
+	for _, w := range wallets[:pbft.NUM_OF_NODES] {
+		votes = append(votes,
+			*w.CreateTx(pbft.GovernanceData(wallets[3].PublicKey(), 1)),
+			*w.CreateTx(pbft.GovernanceData(wallets[0].PublicKey(), 0)))
+	}
+	commitTestBlock(bc, votes, wallets[:pbft.NUM_OF_NODES])
+	for range pbft.EPOCH_LENGTH + 1 {
+		var signers []*pbft.Wallet
+		for _, w := range wallets {
+			if bc.ValidatorsAt(bc.Height() + 1).ValidatorExists(w.PublicKey()) {
+				signers = append(signers, w)
+			}
+		}
+		commitTestBlock(bc, nil, signers)
+	}
+	last := bc.Height()
+	if bc.ValidatorsAt(last).ValidatorExists(wallets[0].PublicKey()) {
+		t.Fatalf("NODE-0 should have left the set at height %d", last)
+	}
+	server := newTestServer(bc)
+	defer server.Close()
+
+	genesis, _ := bc.GetBlock(0)
+	lc := NewLightClient(genesis.Hash, *pbft.NewValidators(pbft.NUM_OF_NODES), []string{server.URL})
+	if err := lc.Sync(); err != nil || lc.Height() != last {
+		t.Errorf("Sync should follow the validator change, %v", err)
+	}
+}
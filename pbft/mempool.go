@@ -0,0 +1,383 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"log"
+	"sort"
+	"time"
+)
+
+/**
+MempoolConfig bounds the waiting txs of a TransactionPool:
+- MaxTxs / MaxBytes: capacity of the waiting pool
+- MaxPerSender: waiting txs a single sender may hold
+- TTL: waiting txs older than this are dropped
+- Eviction: what to do with a new tx when the pool is full
+- BatchMaxTxs / BatchMaxBytes / BatchMaxWait: a batch of waiting txs
+  is cut as soon as it reaches the max count, the max byte size, or
+  its oldest tx has waited for the max wait, whichever comes first
+
+Waiting txs are kept ordered by their client-provided priority
+(highest first), ties are kept in arrival order.
+
+Every node batches locally, so the txs a node holds "in progress"
+rarely match the block the primary proposed. On commit, ReconcileBlock
+removes exactly the block's txs from whichever sub-pool holds them,
+drops pending txs whose nonce got committed, and reports the txs this
+node did not hold as divergent. After a view change the old primary's
+batches may never commit, so RequeueInProgress puts the in-progress
+txs back in the waiting pool to be proposed again. RequeueBatch does
+the same for a single batch whose block was never proposed.
+
+MempoolMetrics counts admissions, rejections (by reason), evictions,
+expiries and reconciliation results, and is exposed on the
+`/mempool/metrics` endpoint.
+*/
+
+type EvictionPolicy string
+
+const (
+	// EvictLowestPriority drops the lowest priority tx if the new one
+	// has a higher priority, otherwise rejects the new one
+	EvictLowestPriority EvictionPolicy = "lowest-priority"
+	// EvictOldest drops the oldest waiting tx
+	EvictOldest EvictionPolicy = "oldest"
+	// EvictNone rejects the new tx
+	EvictNone EvictionPolicy = "none"
+)
+
+// Rejection reasons of AddTx2Pool/CheckTx
+const (
+	RejectDuplicate   = "duplicate"
+	RejectTooLarge    = "too large"
+	RejectSenderLimit = "sender limit"
+	RejectPoolFull    = "pool full"
+)
+
+type MempoolConfig struct {
+	MaxTxs       int            `json:"maxTxs"`
+	MaxBytes     int            `json:"maxBytes"`
+	MaxPerSender int            `json:"maxPerSender"`
+	TTL          time.Duration  `json:"ttl"`
+	Eviction     EvictionPolicy `json:"eviction"`
+
+	BatchMaxTxs   int           `json:"batchMaxTxs"`
+	BatchMaxBytes int           `json:"batchMaxBytes"`
+	BatchMaxWait  time.Duration `json:"batchMaxWait"`
+}
+
+type MempoolMetrics struct {
+	Admitted uint64            `json:"admitted"`
+	Rejected map[string]uint64 `json:"rejected"`
+	Evicted  uint64            `json:"evicted"`
+	Expired  uint64            `json:"expired"`
+	Size     int               `json:"size"`
+	Bytes    int               `json:"bytes"`
+
+	Committed uint64 `json:"committed"`
+	Divergent uint64 `json:"divergent"`
+	Stale     uint64 `json:"stale"`
+	Requeued  uint64 `json:"requeued"`
+}
+
+// Reconciliation reports where the txs of a committed block were found
+type Reconciliation struct {
+	FromWaiting    int `json:"fromWaiting"`
+	FromInProgress int `json:"fromInProgress"`
+	Divergent      int `json:"divergent"` // committed txs this node did not hold
+	Stale          int `json:"stale"`     // pending txs made invalid by committed nonces
+}
+
+// poolMeta is the bookkeeping of a waiting tx
+type poolMeta struct {
+	size    int
+	addedAt time.Time
+}
+
+// DefaultMempoolConfig returns the mempool config from config.go
+func DefaultMempoolConfig() MempoolConfig {
+	return MempoolConfig{
+		MaxTxs:       MEMPOOL_MAX_TXS,
+		MaxBytes:     MEMPOOL_MAX_BYTES,
+		MaxPerSender: MEMPOOL_MAX_PER_SENDER,
+		TTL:          MEMPOOL_TX_TTL,
+		Eviction:     MEMPOOL_EVICTION,
+
+		BatchMaxTxs:   TX_THRESHOLD,
+		BatchMaxBytes: BATCH_MAX_BYTES,
+		BatchMaxWait:  BATCH_MAX_WAIT,
+	}
+}
+
+// txSize returns the marshalled size of a tx
+func txSize(tx Transaction) int {
+	txInByte, err := json.Marshal(tx)
+	if err != nil {
+		return 0
+	}
+	return len(txInByte)
+}
+
+// CheckTx tells whether a tx can be admitted to the waiting pool, it
+// returns an empty string if so, or the rejection reason otherwise.
+// A full pool is not a rejection if the eviction policy makes room.
+func (tp *TransactionPool) CheckTx(tx Transaction) string {
+	if tp.TxExists(tx) {
+		return RejectDuplicate
+	}
+	size := txSize(tx)
+	if size > tp.config.MaxBytes {
+		return RejectTooLarge
+	}
+	if tp.waiting[chain_util.KeyOf(tx.From)] >= tp.config.MaxPerSender {
+		return RejectSenderLimit
+	}
+	if tp.isFull(size) && tp.victim(tx) < 0 {
+		return RejectPoolFull
+	}
+	return ""
+}
+
+// isFull checks if the waiting pool has no room for a tx of given size
+func (tp *TransactionPool) isFull(size int) bool {
+	return len(tp.pool) >= tp.config.MaxTxs || tp.bytes+size > tp.config.MaxBytes
+}
+
+// victim returns the index of the waiting tx to evict in favour of
+// the given tx, or -1 if none may be evicted
+func (tp *TransactionPool) victim(tx Transaction) int {
+	if len(tp.pool) == 0 {
+		return -1
+	}
+	switch tp.config.Eviction {
+	case EvictLowestPriority:
+		// the pool is ordered by priority, the last one is the lowest
+		last := len(tp.pool) - 1
+		if tp.pool[last].Priority < tx.Priority {
+			return last
+		}
+	case EvictOldest:
+		oldest := 0
+		for i, _tx := range tp.pool {
+			if tp.meta[_tx.Id].addedAt.Before(tp.meta[tp.pool[oldest].Id].addedAt) {
+				oldest = i
+			}
+		}
+		return oldest
+	}
+	return -1
+}
+
+// insertTx inserts a tx into the waiting pool keeping priority order
+func (tp *TransactionPool) insertTx(tx Transaction, now time.Time) {
+	idx := sort.Search(len(tp.pool), func(i int) bool {
+		return tp.pool[i].Priority < tx.Priority
+	})
+	tp.pool = append(tp.pool, Transaction{})
+	copy(tp.pool[idx+1:], tp.pool[idx:])
+	tp.pool[idx] = tx
+	size := txSize(tx)
+	tp.meta[tx.Id] = poolMeta{size: size, addedAt: now}
+	tp.bytes += size
+	tp.waiting[chain_util.KeyOf(tx.From)]++
+	tp.trackPending(tx)
+}
+
+// removeTx removes the waiting tx at given index
+func (tp *TransactionPool) removeTx(idx int) Transaction {
+	tx := tp.pool[idx]
+	tp.pool = append(tp.pool[:idx], tp.pool[idx+1:]...)
+	tp.bytes -= tp.meta[tx.Id].size
+	delete(tp.meta, tx.Id)
+	from := chain_util.KeyOf(tx.From)
+	if tp.waiting[from]--; tp.waiting[from] <= 0 {
+		delete(tp.waiting, from)
+	}
+	tp.untrackPending(tx)
+	return tx
+}
+
+// trackPending indexes the nonce of a waiting or in-progress tx
+func (tp *TransactionPool) trackPending(tx Transaction) {
+	from := chain_util.KeyOf(tx.From)
+	if tp.pending[from] == nil {
+		tp.pending[from] = make(map[uint64]struct{})
+	}
+	tp.pending[from][tx.Nonce] = struct{}{}
+}
+
+// untrackPending drops the nonce of a tx leaving the pending txs
+func (tp *TransactionPool) untrackPending(tx Transaction) {
+	from := chain_util.KeyOf(tx.From)
+	delete(tp.pending[from], tx.Nonce)
+	if len(tp.pending[from]) == 0 {
+		delete(tp.pending, from)
+	}
+}
+
+// ExpireTxs drops waiting txs older than the TTL
+func (tp *TransactionPool) ExpireTxs(now time.Time) int {
+	expired := 0
+	for i := 0; i < len(tp.pool); {
+		if now.Sub(tp.meta[tp.pool[i].Id].addedAt) > tp.config.TTL {
+			tx := tp.removeTx(i)
+			log.Printf("Tx [%s] expired from tx pool\n", chain_util.BytesToHex(tx.Hash)[:6])
+			expired++
+			continue
+		}
+		i++
+	}
+	tp.metrics.Expired += uint64(expired)
+	return expired
+}
+
+// reject records a rejection
+func (tp *TransactionPool) reject(tx Transaction, reason string) {
+	tp.metrics.Rejected[reason]++
+	log.Printf("Tx [%s] rejected from tx pool, %s\n", chain_util.BytesToHex(tx.Hash)[:6], reason)
+}
+
+// Metrics returns a snapshot of the mempool metrics
+func (tp *TransactionPool) Metrics() MempoolMetrics {
+	rejected := make(map[string]uint64, len(tp.metrics.Rejected))
+	for reason, count := range tp.metrics.Rejected {
+		rejected[reason] = count
+	}
+	metrics := tp.metrics
+	metrics.Rejected = rejected
+	metrics.Size = len(tp.pool)
+	metrics.Bytes = tp.bytes
+	return metrics
+}
+
+// batchReady checks if the waiting txs fill a batch by count or size
+func (tp *TransactionPool) batchReady() bool {
+	return len(tp.pool) >= tp.config.BatchMaxTxs || tp.bytes >= tp.config.BatchMaxBytes
+}
+
+// CutTimedBatch cuts a batch if the oldest waiting tx has waited for
+// longer than the batch max wait, it returns nil otherwise
+func (tp *TransactionPool) CutTimedBatch(now time.Time) []Transaction {
+	tp.ExpireTxs(now)
+	for _, tx := range tp.pool {
+		if now.Sub(tp.meta[tx.Id].addedAt) >= tp.config.BatchMaxWait {
+			log.Println("BATCH MAX WAIT REACHED!")
+			return tp.cutBatch()
+		}
+	}
+	return nil
+}
+
+// ReconcileBlock removes a committed block's txs from the waiting or
+// in-progress pool, records their senders' committed nonces and drops
+// any other pending tx whose nonce is now committed. A tx rejected for
+// its nonce, as given by the block's results, commits no nonce.
+func (tp *TransactionPool) ReconcileBlock(txs []Transaction, results []string) Reconciliation {
+	var rec Reconciliation
+	included := make(map[string]bool, len(txs))
+	for i, tx := range txs {
+		included[tx.Id] = true
+		from := chain_util.KeyOf(tx.From)
+		executed := i >= len(results) || results[i] != TxResultBadNonce
+		if executed && tx.Nonce > tp.nonces[from] {
+			tp.nonces[from] = tx.Nonce
+		}
+		if _, ok := tp.inProgress[tx.Id]; ok {
+			delete(tp.inProgress, tx.Id)
+			tp.untrackPending(tx)
+			rec.FromInProgress++
+		} else if _, ok := tp.meta[tx.Id]; ok {
+			rec.FromWaiting++
+		} else {
+			rec.Divergent++
+		}
+	}
+	for i := 0; i < len(tp.pool); {
+		tx := tp.pool[i]
+		if included[tx.Id] {
+			tp.removeTx(i)
+			continue
+		}
+		if tx.Nonce <= tp.nonces[chain_util.KeyOf(tx.From)] {
+			tp.removeTx(i)
+			rec.Stale++
+			continue
+		}
+		i++
+	}
+	for id, tx := range tp.inProgress {
+		if tx.Nonce <= tp.nonces[chain_util.KeyOf(tx.From)] {
+			delete(tp.inProgress, id)
+			tp.untrackPending(tx)
+			rec.Stale++
+		}
+	}
+	tp.metrics.Committed += uint64(len(txs))
+	tp.metrics.Divergent += uint64(rec.Divergent)
+	tp.metrics.Stale += uint64(rec.Stale)
+	if rec.Divergent > 0 || rec.Stale > 0 {
+		log.Printf("Tx pool diverged from committed block, %d txs not held, %d stale txs dropped\n", rec.Divergent, rec.Stale)
+	}
+	return rec
+}
+
+// AwaitedTxs returns the ids of the pending txs a primary can include
+// now: waiting or in progress, with every lower nonce of their sender
+// committed or pending. Request timers only run for these txs.
+func (tp *TransactionPool) AwaitedTxs() map[string]bool {
+	awaited := make(map[string]bool, len(tp.pool)+len(tp.inProgress))
+	check := func(tx Transaction) {
+		from := chain_util.KeyOf(tx.From)
+		committed := tp.nonces[from]
+		lower := uint64(0)
+		for nonce := range tp.pending[from] {
+			if nonce > committed && nonce < tx.Nonce {
+				lower++
+			}
+		}
+		if lower == tx.Nonce-committed-1 {
+			awaited[tx.Id] = true
+		}
+	}
+	for _, tx := range tp.pool {
+		check(tx)
+	}
+	for _, tx := range tp.inProgress {
+		check(tx)
+	}
+	return awaited
+}
+
+// RequeueInProgress moves in-progress txs back to the waiting pool,
+// it is called after a view change since their batch may never commit
+func (tp *TransactionPool) RequeueInProgress(now time.Time) int {
+	txs := make([]Transaction, 0, len(tp.inProgress))
+	for _, tx := range tp.inProgress {
+		txs = append(txs, tx)
+	}
+	return tp.RequeueBatch(txs, now)
+}
+
+// RequeueBatch moves the in-progress txs of a batch back to the
+// waiting pool, it is called when the batch's block was not proposed
+func (tp *TransactionPool) RequeueBatch(txs []Transaction, now time.Time) int {
+	requeued := 0
+	for _, tx := range txs {
+		if _, ok := tp.inProgress[tx.Id]; !ok {
+			continue
+		}
+		delete(tp.inProgress, tx.Id)
+		tp.untrackPending(tx)
+		if tx.Nonce <= tp.nonces[chain_util.KeyOf(tx.From)] {
+			continue
+		}
+		tp.insertTx(tx, now)
+		requeued++
+	}
+	tp.metrics.Requeued += uint64(requeued)
+	if requeued > 0 {
+		log.Printf("%d in-progress txs re-queued to tx pool\n", requeued)
+	}
+	return requeued
+}
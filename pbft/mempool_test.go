@@ -0,0 +1,236 @@
+package pbft
+
+import (
+	"bytes"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func testMempoolConfig() MempoolConfig {
+	config := DefaultMempoolConfig()
+	config.MaxTxs = TX_THRESHOLD + 1
+	config.MaxPerSender = TX_THRESHOLD + 1
+	config.TTL = time.Minute
+	config.Eviction = EvictLowestPriority
+	return config
+}
+
+func TestTransactionPool_PriorityOrder(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	priorities := []uint64{1, 5, 3}
+	var batch []Transaction
+	for i, priority := range priorities {
+		w := NewWallet("sender-" + strconv.Itoa(i))
+		tp.AddTx2Pool(*w.CreatePriorityTx("data", priority))
+		batch = tp.CutReadyBatch()
+	}
+	if len(batch) != TX_THRESHOLD {
+		t.Fatalf("CutReadyBatch should cut a batch, got %d txs", len(batch))
+	}
+	tp2 := NewTxPoolWithConfig(testMempoolConfig())
+	for i, priority := range priorities[:2] {
+		w := NewWallet("sender-" + strconv.Itoa(i))
+		tp2.AddTx2Pool(*w.CreatePriorityTx("data", priority))
+	}
+	if tp2.pool[0].Priority != 5 || tp2.pool[1].Priority != 1 {
+		t.Errorf("Waiting txs should be ordered by priority, got %d, %d", tp2.pool[0].Priority, tp2.pool[1].Priority)
+	}
+}
+
+func TestTransactionPool_Bounds(t *testing.T) {
+	config := testMempoolConfig()
+	config.MaxTxs = 2
+	config.MaxPerSender = 1
+	tp := NewTxPoolWithConfig(config)
+	w1, w2, w3, w4 := NewWallet("1"), NewWallet("2"), NewWallet("3"), NewWallet("4")
+
+	tp.AddTx2Pool(*w1.CreatePriorityTx("data", 2))
+	if tp.AddTx2Pool(*w1.CreatePriorityTx("data", 2)) {
+		t.Errorf("AddTx2Pool should enforce the per-sender limit")
+	}
+	tp.AddTx2Pool(*w2.CreatePriorityTx("data", 3))
+	if tp.AddTx2Pool(*w3.CreatePriorityTx("data", 1)) {
+		t.Errorf("AddTx2Pool should reject a lower priority tx when full")
+	}
+	if !tp.AddTx2Pool(*w4.CreatePriorityTx("data", 9)) {
+		t.Errorf("AddTx2Pool should evict the lowest priority tx when full")
+	}
+	if len(tp.pool) != 2 || tp.pool[0].Priority != 9 || tp.pool[1].Priority != 3 {
+		t.Errorf("Eviction should drop the lowest priority tx")
+	}
+	metrics := tp.Metrics()
+	if metrics.Admitted != 3 || metrics.Evicted != 1 ||
+		metrics.Rejected[RejectSenderLimit] != 1 || metrics.Rejected[RejectPoolFull] != 1 {
+		t.Errorf("Metrics mismatch, %+v", metrics)
+	}
+}
+
+func TestTransactionPool_ExpireTxs(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	w := NewWallet("test")
+	tp.AddTx2Pool(*w.CreateTx("data"))
+	if tp.ExpireTxs(time.Now()) != 0 {
+		t.Errorf("ExpireTxs should keep fresh txs")
+	}
+	if tp.ExpireTxs(time.Now().Add(2*time.Minute)) != 1 || len(tp.pool) != 0 || tp.bytes != 0 {
+		t.Errorf("ExpireTxs should drop stale txs")
+	}
+}
+
+func TestTransactionPool_CutTimedBatch(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	w := NewWallet("test")
+	tp.AddTx2Pool(*w.CreateTx("data"))
+	if tp.CutTimedBatch(time.Now()) != nil {
+		t.Errorf("CutTimedBatch should wait for the batch max wait")
+	}
+	batch := tp.CutTimedBatch(time.Now().Add(tp.config.BatchMaxWait))
+	if len(batch) != 1 || len(tp.pool) != 0 || len(tp.inProgress) != 1 {
+		t.Errorf("CutTimedBatch should cut the waiting tx once it waited long enough")
+	}
+}
+
+func TestTransactionPool_NonceOrder(t *testing.T) {
+	config := testMempoolConfig()
+	config.BatchMaxTxs = 1
+	tp := NewTxPoolWithConfig(config)
+	w, other := NewWallet("test"), NewWallet("other")
+	first := w.CreatePriorityTx("data", 0)
+	second := w.CreatePriorityTx("data", 10)
+	tp.AddTx2Pool(*first)
+	tp.AddTx2Pool(*second)
+	tp.AddTx2Pool(*other.CreatePriorityTx("data", 5))
+	// the higher priority tx of the sender waits for its lower nonce
+	var nonces []uint64
+	for len(tp.pool) > 0 {
+		batch := tp.CutTimedBatch(time.Now().Add(config.BatchMaxWait))
+		if len(batch) != 1 {
+			t.Fatalf("CutTimedBatch should cut a single tx, got %d txs", len(batch))
+		}
+		if bytes.Equal(batch[0].From, first.From) {
+			nonces = append(nonces, batch[0].Nonce)
+		}
+	}
+	if len(nonces) != 2 || nonces[0] != first.Nonce || nonces[1] != second.Nonce {
+		t.Errorf("Batches should keep a sender's nonce order, got %v", nonces)
+	}
+}
+
+func TestTransactionPool_NonceGap(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	w := NewWallet("test")
+	first, second, third := w.CreateTx("a=1"), w.CreateTx("a=2"), w.CreateTx("a=3")
+	// the third nonce arrives first, it waits for the gap to fill
+	tp.AddTx2Pool(*third)
+	if batch := tp.CutTimedBatch(time.Now().Add(tp.config.BatchMaxWait)); batch != nil {
+		t.Errorf("CutTimedBatch should not cut a tx after a nonce gap, got %d txs", len(batch))
+	}
+	tp.AddTx2Pool(*first)
+	batch := tp.CutTimedBatch(time.Now().Add(tp.config.BatchMaxWait))
+	if len(batch) != 1 || batch[0].Nonce != first.Nonce {
+		t.Fatalf("CutTimedBatch should only cut the tx before the gap, got %d txs", len(batch))
+	}
+	// the second nonce follows the in-progress first one
+	tp.AddTx2Pool(*second)
+	batch = tp.CutTimedBatch(time.Now().Add(tp.config.BatchMaxWait))
+	if len(batch) != 2 || batch[0].Nonce != second.Nonce || batch[1].Nonce != third.Nonce {
+		t.Errorf("CutTimedBatch should cut the txs once the gap is filled, got %d txs", len(batch))
+	}
+	// a tx committed after a gap is rejected and commits no nonce
+	tp.ReconcileBlock([]Transaction{*third}, []string{TxResultBadNonce})
+	if tp.CommittedNonce(w.publicKey) != 0 {
+		t.Errorf("ReconcileBlock should not commit the nonce of a rejected tx")
+	}
+}
+
+func TestTransactionPool_BatchMaxBytes(t *testing.T) {
+	config := testMempoolConfig()
+	w := NewWallet("test")
+	tx := w.CreateTx("data")
+	config.BatchMaxBytes = txSize(*tx) + 1
+	config.BatchMaxTxs = 10
+	tp := NewTxPoolWithConfig(config)
+	tp.AddTx2Pool(*tx)
+	if tp.CutReadyBatch() != nil {
+		t.Errorf("CutReadyBatch should not cut a batch below the max byte size")
+	}
+	// the batch is cut once the max byte size is reached, but a batch
+	// never exceeds it
+	tp.AddTx2Pool(*w.CreateTx("data"))
+	batch := tp.CutReadyBatch()
+	if len(batch) != 1 || len(tp.pool) != 1 {
+		t.Errorf("CutReadyBatch should cut a batch within the max byte size, got %d txs", len(batch))
+	}
+}
+
+func TestTransactionPool_ReconcileDivergent(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	w := NewWallet("sender")
+	other := NewWallet("other")
+	tx1 := w.CreateTx("data")
+	tx2 := w.CreateTx("data")
+	tx3 := other.CreateTx("data")
+	tp.AddTx2Pool(*tx1)
+	tp.AddTx2Pool(*tx3)
+	tp.cutBatch()
+	tp.AddTx2Pool(*tx2)
+
+	// the primary's block holds tx2 and a tx this node never saw,
+	// tx1 held in progress becomes stale once tx2's nonce commits
+	unseen := other.CreateTx("data")
+	rec := tp.ReconcileBlock([]Transaction{*tx2, *unseen}, nil)
+	if rec.FromWaiting != 1 || rec.FromInProgress != 0 || rec.Divergent != 1 || rec.Stale != 2 {
+		t.Errorf("ReconcileBlock reported %+v", rec)
+	}
+	if len(tp.pool) != 0 || len(tp.inProgress) != 0 {
+		t.Errorf("ReconcileBlock should leave no pending tx, got %d waiting, %d in progress", len(tp.pool), len(tp.inProgress))
+	}
+	if tp.Metrics().Divergent != 1 {
+		t.Errorf("Divergent txs should be counted")
+	}
+}
+
+func TestTransactionPool_RequeueInProgress(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	w := NewWallet("sender")
+	tx1 := w.CreateTx("data")
+	tx2 := w.CreateTx("data")
+	tp.AddTx2Pool(*tx1)
+	tp.AddTx2Pool(*tx2)
+	tp.cutBatch()
+	tp.ReconcileBlock([]Transaction{*tx1}, nil)
+	if requeued := tp.RequeueInProgress(time.Now()); requeued != 1 {
+		t.Errorf("RequeueInProgress should re-queue 1 tx, got %d", requeued)
+	}
+	if len(tp.pool) != 1 || tp.pool[0].Id != tx2.Id || len(tp.inProgress) != 0 {
+		t.Errorf("RequeueInProgress should move the unincluded tx back to the waiting pool")
+	}
+}
+
+func TestTransactionPool_AwaitedTxs(t *testing.T) {
+	tp := NewTxPoolWithConfig(testMempoolConfig())
+	timers := NewRequestTimers(REQUEST_TIMEOUT)
+	w := NewWallet("sender")
+	tx := w.CreateTx("a=1")
+	w.SetNonce(0)
+	conflicting := w.CreateTx("a=2")
+	gapped := NewTx(*w, "a=3", tx.Nonce+2, 0)
+	now := time.Now()
+	for _, pending := range []*Transaction{tx, gapped} {
+		tp.AddTx2Pool(*pending)
+		timers.Start(pending.Id, now)
+	}
+	// a tx behind a nonce gap is not awaited from the primary
+	awaited := tp.AwaitedTxs()
+	if !awaited[tx.Id] || awaited[gapped.Id] {
+		t.Errorf("AwaitedTxs should only hold the txs after no nonce gap, got %v", awaited)
+	}
+	// the primary commits a conflicting tx of the same nonce, the pending
+	// tx is dropped as stale and its timer must not ask for a view change
+	tp.ReconcileBlock([]Transaction{*conflicting}, nil)
+	timers.Retain(tp.AwaitedTxs())
+	if expired := timers.Expired(now.Add(2 * REQUEST_TIMEOUT)); expired != 0 {
+		t.Errorf("Timers of the txs no longer awaited should be stopped, got %d expired", expired)
+	}
+}
@@ -1,6 +1,9 @@
 package pbft
 
-import "consensus-algorithms-with-golang/pbft/chain_util"
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+)
 
 /**
 PBFT uses 3 phases to ensure consensus, pre-prepare, prepare, and commit.
@@ -26,52 +29,86 @@ const (
 	MsgPrepare    = "PREPARE"
 	MsgCommit     = "COMMIT"
 	MsgRC         = "RC"
+	MsgReply      = "REPLY"
+	MsgViewChange = "VIEW-CHANGE"
+	MsgNewView    = "NEW-VIEW"
+
+	MsgBlockRequest  = "BLOCK-REQUEST"
+	MsgBlockResponse = "BLOCK-RESPONSE"
 )
 
 /*
 *
-Message stores passed-in blockHash, publicKey and signature.
+Message stores passed-in blockHash, the height and view it votes in,
+publicKey and signature. The signature covers the message type, block
+hash, height and view, so a vote cannot be replayed as another phase,
+height or view.
 1. NewMsg
+2. HashMsg
+3. VerifyMsg
 */
 
 type Message struct {
 	MsgType   string    `json:"msgType"`
 	BlockHash []byte    `json:"blockHash"`
+	Height    uint64    `json:"height"`
+	View      uint64    `json:"view"`
 	PublicKey PublicKey `json:"publicKey"`
 	Signature []byte    `json:"signature"`
 }
 
 // NewMsg creates a new message that is used for phase transition in PBFT.
-func NewMsg(msgType string, blockHash []byte, publicKey PublicKey, signature []byte) *Message {
+func NewMsg(msgType string, blockHash []byte, height uint64, view uint64, publicKey PublicKey, signature []byte) *Message {
 	return &Message{
 		MsgType:   msgType,
 		BlockHash: blockHash,
+		Height:    height,
+		View:      view,
 		PublicKey: publicKey,
 		Signature: signature,
 	}
 }
 
+// HashMsg returns the digest signed by a message, the fields are
+// separated so that no two messages share a digest
+func HashMsg(msgType string, blockHash []byte, height uint64, view uint64) []byte {
+	return chain_util.Hash(
+		msgType + "/" + chain_util.BytesToHex(blockHash) + "/" +
+			strconv.FormatUint(height, 10) + "/" + strconv.FormatUint(view, 10),
+	)
+}
+
+// VerifyMsg verifies the message's signature over its digest
+func VerifyMsg(msg Message) bool {
+	return sigVerifier.Verify(msg.PublicKey, HashMsg(msg.MsgType, msg.BlockHash, msg.Height, msg.View), msg.Signature)
+}
+
 /**
 MessagePool stores a pool of messages with a specified message type.
 With the same block hash as map key, each element in the pool
-represents a message sent from a different node.
+represents a message sent from a different node. Block hashes and
+voters are indexed by fixed-size keys, so checking for a vote does
+not scan or allocate.
 It features the following methods:
 1. NewMsgPool
 2. AddMsg2Pool: pushes a message for a block hash into the map list
 3. MsgExists: check if a given message for a block hash already exists
 4. VerifyMsg: check if the message is valid or not
-5. CleanPool: remove the list with the specified block hash in the map pool
+5. Count / Msgs / Voters: the votes for a block hash
+6. CleanPool: remove the list with the specified block hash in the map pool
 */
 
 type MsgPool struct {
-	mapPool map[string][]Message
+	mapPool map[chain_util.Key][]Message                   // block hash -> messages
+	voters  map[chain_util.Key]map[chain_util.Key]struct{} // block hash -> voters
 }
 
 // NewMsgPool creates a message pool. It uses a map to store a list of
 // messages, whose key is the passed-in block hash.
 func NewMsgPool() *MsgPool {
 	return &MsgPool{
-		mapPool: make(map[string][]Message),
+		mapPool: make(map[chain_util.Key][]Message),
+		voters:  make(map[chain_util.Key]map[chain_util.Key]struct{}),
 	}
 }
 
@@ -84,36 +121,53 @@ func (mp *MsgPool) AddMsg2Pool(msg Message) bool {
 	if mp.MsgExists(msg) {
 		return false
 	}
-	hashHex := chain_util.BytesToHex(msg.BlockHash)
-	if mp.mapPool[hashHex] == nil {
-		mp.mapPool[hashHex] = []Message{}
+	hashKey := chain_util.KeyOf(msg.BlockHash)
+	if mp.voters[hashKey] == nil {
+		mp.voters[hashKey] = make(map[chain_util.Key]struct{})
 	}
-	mp.mapPool[hashHex] = append(mp.mapPool[hashHex], msg)
+	mp.voters[hashKey][chain_util.KeyOf(msg.PublicKey)] = struct{}{}
+	mp.mapPool[hashKey] = append(mp.mapPool[hashKey], msg)
 	return true
 }
 
 // MsgExists checks if a message for a block hash already exists or not
-// by comparing its publicKey.
+// by looking up its publicKey among the block's voters.
 func (mp *MsgPool) MsgExists(msg Message) bool {
-	hashHex := chain_util.BytesToHex(msg.BlockHash)
-	for _, m := range mp.mapPool[hashHex] {
-		if chain_util.BytesToHex(m.PublicKey) == chain_util.BytesToHex(msg.PublicKey) {
-			return true
-		}
-	}
-	return false
+	_, ok := mp.voters[chain_util.KeyOf(msg.BlockHash)][chain_util.KeyOf(msg.PublicKey)]
+	return ok
 }
 
 // VerifyMsg verifies the passed-in message
 func (mp *MsgPool) VerifyMsg(msg Message) bool {
-	return chain_util.Verify(msg.PublicKey, msg.BlockHash, msg.Signature)
+	return VerifyMsg(msg)
+}
+
+// Count returns the number of distinct voters for a block hash
+func (mp *MsgPool) Count(hash []byte) int {
+	return len(mp.voters[chain_util.KeyOf(hash)])
+}
+
+// Voters returns the public keys voting for a block hash
+func (mp *MsgPool) Voters(hash []byte) []PublicKey {
+	msgs := mp.mapPool[chain_util.KeyOf(hash)]
+	voters := make([]PublicKey, len(msgs))
+	for i, msg := range msgs {
+		voters[i] = msg.PublicKey
+	}
+	return voters
+}
+
+// Msgs returns the messages for a block hash in arrival order
+func (mp *MsgPool) Msgs(hash []byte) []Message {
+	return mp.mapPool[chain_util.KeyOf(hash)]
 }
 
 // CleanPool remove the list with specified block hash in map pool
 func (mp *MsgPool) CleanPool(hash []byte) bool {
-	hashHex := chain_util.BytesToHex(hash)
-	if mp.mapPool[hashHex] != nil {
-		delete(mp.mapPool, hashHex)
+	hashKey := chain_util.KeyOf(hash)
+	if mp.mapPool[hashKey] != nil {
+		delete(mp.mapPool, hashKey)
+		delete(mp.voters, hashKey)
 		return true
 	} else {
 		return false
@@ -122,5 +176,6 @@ func (mp *MsgPool) CleanPool(hash []byte) bool {
 
 // Clear clears the content of msg pool
 func (mp *MsgPool) Clear() {
-	mp.mapPool = make(map[string][]Message)
+	mp.mapPool = make(map[chain_util.Key][]Message)
+	mp.voters = make(map[chain_util.Key]map[chain_util.Key]struct{})
 }
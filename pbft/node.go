@@ -2,6 +2,7 @@ package pbft
 
 import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
 	"fmt"
 	"github.com/gorilla/websocket"
 	"log"
@@ -17,6 +18,9 @@ var upgrader = websocket.Upgrader{
 }
 var mutex = &sync.Mutex{}
 
+// sigVerifier verifies signatures concurrently and caches the valid ones
+var sigVerifier = chain_util.NewVerifier(SIG_VERIFY_WORKERS, SIG_CACHE_SIZE)
+
 /*
 *
 A Node represents a single node in a blockchain system.
@@ -25,7 +29,7 @@ It has the following properties:
 - WsPort: websocket port
 - Port: http server port
 - Sockets: the addresses of itself and all connected peers
-- Validators: system acknowledged public keys (wallet/node)
+- Clients: public keys allowed to submit txs
 - Blockchain: a copy of the blockchain
 - Wallet: node's wallet
 - TxPool: node's tx pool
@@ -33,6 +37,11 @@ It has the following properties:
 - PreparePool: node's prepare pool
 - CommitPool: node's commit pool
 - RCPool: node's round-change pool
+- ReplyPool: node's replies to clients
+- ViewChangePool: node's view-change pool
+- RequestTimers: node's timers of pending client requests
+- FutureBuffer: votes received ahead of their block, height or view
+- BlockRequests: missing blocks requested from peers
 
 It features the following methods:
 1. NewNode
@@ -48,41 +57,64 @@ It features the following methods:
 5. queryCommitPoolHandler
 6. queryRCPoolHandler
 7. queryBlockchainHandler
+8. queryTxProofHandler
+9. queryStateHandler
+10. queryHeaderHandler
+11. queryReplyHandler
+12. submitTxHandler
+13. queryNonceHandler
+14. queryMempoolMetricsHandler
+15. queryValidatorsHandler
 */
 
 type Node struct {
-	Host        string
-	WsPort      uint64
-	Port        uint64
-	Sockets     map[string]*websocket.Conn
-	Relay       *websocket.Conn
-	Validators  Validators
-	Blockchain  Blockchain
-	Wallet      Wallet
-	TxPool      TransactionPool
-	BlockPool   BlockPool
-	PreparePool MsgPool
-	CommitPool  MsgPool
-	RCPool      MsgPool
+	Host           string
+	WsPort         uint64
+	Port           uint64
+	Sockets        map[string]*websocket.Conn
+	Relay          *websocket.Conn
+	Clients        Clients
+	Blockchain     Blockchain
+	Wallet         Wallet
+	TxPool         TransactionPool
+	BlockPool      BlockPool
+	PreparePool    MsgPool
+	CommitPool     MsgPool
+	RCPool         MsgPool
+	ReplyPool      ReplyPool
+	ViewChangePool ViewChangePool
+	RequestTimers  *RequestTimers
+	FutureBuffer   FutureBuffer
+	BlockRequests  *BlockRequests
+	lastBlockAt    time.Time // when the latest block was proposed or committed
+	proposedHeight uint64    // height of the latest block proposed by this node
+	proposedView   uint64    // view of the latest block proposed by this node
 }
 
 // NewNode creates a new node with given info
-func NewNode(host string, wsPort uint64, vs Validators, bc Blockchain, w Wallet,
-	tp TransactionPool, bp BlockPool, pp MsgPool, cp MsgPool, rcp MsgPool) *Node {
+func NewNode(host string, wsPort uint64, cs Clients, bc Blockchain, w Wallet,
+	tp TransactionPool, bp BlockPool, pp MsgPool, cp MsgPool, rcp MsgPool, rp ReplyPool,
+	vcp ViewChangePool, fb FutureBuffer) *Node {
 	return &Node{
-		Host:        host,
-		WsPort:      wsPort,
-		Port:        wsPort + 10000,
-		Sockets:     make(map[string]*websocket.Conn),
-		Relay:       nil,
-		Validators:  vs,
-		Blockchain:  bc,
-		Wallet:      w,
-		TxPool:      tp,
-		BlockPool:   bp,
-		RCPool:      rcp,
-		PreparePool: pp,
-		CommitPool:  cp,
+		Host:           host,
+		WsPort:         wsPort,
+		Port:           wsPort + 10000,
+		Sockets:        make(map[string]*websocket.Conn),
+		Relay:          nil,
+		Clients:        cs,
+		Blockchain:     bc,
+		Wallet:         w,
+		TxPool:         tp,
+		BlockPool:      bp,
+		RCPool:         rcp,
+		PreparePool:    pp,
+		CommitPool:     cp,
+		ReplyPool:      rp,
+		ViewChangePool: vcp,
+		RequestTimers:  NewRequestTimers(REQUEST_TIMEOUT),
+		FutureBuffer:   fb,
+		BlockRequests:  NewBlockRequests(BLOCK_REQUEST_TIMEOUT),
+		lastBlockAt:    time.Now(),
 	}
 }
 
@@ -161,12 +193,20 @@ func (node *Node) launchPeer(peerUrl string) {
 			break
 		}
 	}
-	// relaying any received message to current node's WsClient(Relay)
+	// relaying any received message to current node's WsClient(Relay),
+	// except block requests which are answered on the peer's connection
 	for {
-		mt, msg, err = node.Sockets[peerUrl].ReadMessage()
+		mutex.Lock()
+		peerConn := node.Sockets[peerUrl]
+		mutex.Unlock()
+		mt, msg, err = peerConn.ReadMessage()
 		if err != nil {
 			log.Printf("Error reading from peer [%s], %v\n", peerUrl, err)
 		}
+		if isBlockRequest(msg) {
+			node.handleMsg(msg, peerConn)
+			continue
+		}
 		mutex.Lock()
 		err = node.Relay.WriteMessage(mt, msg)
 		mutex.Unlock()
@@ -176,6 +216,14 @@ func (node *Node) launchPeer(peerUrl string) {
 	}
 }
 
+// isBlockRequest tells whether a raw message is a BLOCK-REQUEST
+func isBlockRequest(msg []byte) bool {
+	var header struct {
+		MsgType string `json:"msgType"`
+	}
+	return json.Unmarshal(msg, &header) == nil && header.MsgType == MsgBlockRequest
+}
+
 // connectPeers connects current node's peers
 func (node *Node) connectPeers(peers []string) {
 	for _, peer := range peers {
@@ -220,7 +268,15 @@ func (node *Node) Listen(peers []string) {
 	mux.HandleFunc("/queryNodeInfo2", node.queryNodeInfo2Handler)
 	mux.HandleFunc("/queryNodeInfo", node.queryNodeInfoHandler)
 	mux.HandleFunc("/makeTx", node.makeTxHandler)
+	mux.HandleFunc("POST /tx", node.submitTxHandler)
+	mux.HandleFunc("GET /nonce/{from}", node.queryNonceHandler)
+	mux.HandleFunc("GET /mempool/metrics", node.queryMempoolMetricsHandler)
 	mux.HandleFunc("/reset", node.resetHandler)
+	mux.HandleFunc("GET /tx/{hash}/proof", node.queryTxProofHandler)
+	mux.HandleFunc("GET /state/{key}", node.queryStateHandler)
+	mux.HandleFunc("GET /header/{height}", node.queryHeaderHandler)
+	mux.HandleFunc("GET /validators/{height}", node.queryValidatorsHandler)
+	mux.HandleFunc("GET /reply/{id}", node.queryReplyHandler)
 	go node.launchHttpServer(mux)
 
 	// websocket server
@@ -230,6 +286,9 @@ func (node *Node) Listen(peers []string) {
 	// websocket client
 	go node.launchWsClient()
 
+	// proposer's batcher
+	go node.runBatcher()
+
 	// peers
 	node.connectPeers(peers)
 }
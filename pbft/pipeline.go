@@ -0,0 +1,172 @@
+package pbft
+
+import (
+	"bytes"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"sort"
+)
+
+/**
+Pipelining lets the primary propose heights n+1..n+k while earlier
+ones are still being prepared and committed, k being the pipeline
+depth. A block may chain on the committed tip or on a block still in
+flight: each accepted block is executed on its parent's speculative
+state, which gives the state its children are checked against.
+Blocks are still committed in height order, a block reaching its
+COMMIT quorum first waits for its parent.
+
+The proposer has to stay the same for all heights in flight, so it is
+elected once per window of k heights, from the window's index, the
+view and the block just before the window (the anchor), see
+election.go. With a depth of 1 every block gets its own election.
+It features the following methods:
+1. AddInflight
+2. InflightHeight
+3. CanPropose
+4. ProposerFor
+5. head
+6. parent
+7. parentBlock
+8. pruneInflight
+*/
+
+// inflightBlock is an accepted block that is not committed yet
+type inflightBlock struct {
+	block  Block
+	height uint64
+	state  *chain_util.SparseMerkleTree // state after executing the block
+	cert   *PreparedCert                // set once the block is prepared
+}
+
+// parent returns the height of and the state after the block with
+// given hash, which must be the committed tip or a block in flight
+func (bc *Blockchain) parent(hash []byte) (uint64, *chain_util.SparseMerkleTree, bool) {
+	if chain_util.Equal(hash, bc.chain[len(bc.chain)-1].Hash) {
+		return bc.Height(), bc.state.Latest(), true
+	}
+	if ib, ok := bc.inflight[chain_util.KeyOf(hash)]; ok {
+		return ib.height, ib.state, true
+	}
+	return 0, nil, false
+}
+
+// parentBlock returns the block with given hash, which must be the
+// committed tip or a block in flight
+func (bc *Blockchain) parentBlock(hash []byte) (Block, bool) {
+	if tip := bc.chain[len(bc.chain)-1]; chain_util.Equal(hash, tip.Hash) {
+		return tip, true
+	}
+	if ib, ok := bc.inflight[chain_util.KeyOf(hash)]; ok {
+		return ib.block, true
+	}
+	return Block{}, false
+}
+
+// head returns the block new proposals chain on: the highest block in
+// flight descending from the committed tip, or the tip itself
+func (bc *Blockchain) head() (Block, uint64, *chain_util.SparseMerkleTree) {
+	block, height, state := bc.chain[len(bc.chain)-1], bc.Height(), bc.state.Latest()
+	for {
+		var children []*inflightBlock
+		for _, ib := range bc.inflight {
+			if chain_util.Equal(ib.block.LastHash, block.Hash) {
+				children = append(children, ib)
+			}
+		}
+		if len(children) == 0 {
+			return block, height, state
+		}
+		// a faulty primary may fork, follow one branch deterministically
+		sort.Slice(children, func(i, j int) bool {
+			return bytes.Compare(children[i].block.Hash, children[j].block.Hash) < 0
+		})
+		block, height, state = children[0].block, children[0].height, children[0].state
+	}
+}
+
+// ancestorAt returns the block at given height on the branch ending
+// with the given block
+func (bc *Blockchain) ancestorAt(hash []byte, height uint64) (Block, bool) {
+	if height <= bc.Height() {
+		return bc.chain[height], true
+	}
+	for {
+		ib, ok := bc.inflight[chain_util.KeyOf(hash)]
+		if !ok {
+			return Block{}, false
+		}
+		if ib.height == height {
+			return ib.block, true
+		}
+		hash = ib.block.LastHash
+	}
+}
+
+// ProposerFor returns the proposer of the block chaining on given
+// parent, it returns false if the parent is unknown
+func (bc *Blockchain) ProposerFor(lastHash []byte) (PublicKey, bool) {
+	return bc.proposerFor(lastHash, bc.view)
+}
+
+// proposerFor returns the proposer of the block chaining on given
+// parent in given view
+func (bc *Blockchain) proposerFor(lastHash []byte, view uint64) (PublicKey, bool) {
+	parentHeight, _, ok := bc.parent(lastHash)
+	if !ok {
+		return nil, false
+	}
+	blockAt := func(height uint64) (Block, bool) {
+		return bc.ancestorAt(lastHash, height)
+	}
+	height := parentHeight + 1
+	return ElectProposer(bc.election, *bc.ValidatorsAt(height), bc.depth, height, view, blockAt)
+}
+
+// CanPropose checks if the current view is justified and the pipeline
+// has room for another block
+func (bc *Blockchain) CanPropose() bool {
+	_, height, _ := bc.head()
+	return bc.justified == bc.view && height < bc.Height()+bc.depth
+}
+
+// AddInflight executes an accepted block on its parent's state and
+// keeps it until it is committed
+func (bc *Blockchain) AddInflight(block Block) bool {
+	hashKey := chain_util.KeyOf(block.Hash)
+	if _, ok := bc.inflight[hashKey]; ok {
+		return true
+	}
+	parentHeight, parentState, ok := bc.parent(block.LastHash)
+	if !ok || parentHeight+1 > bc.Height()+bc.depth {
+		return false
+	}
+	bc.inflight[hashKey] = &inflightBlock{
+		block:  block,
+		height: parentHeight + 1,
+		state:  SimulateOn(parentState, bc.envAt(parentHeight+1), block.Data),
+	}
+	return true
+}
+
+// InflightHeight returns the height of a block in flight
+func (bc *Blockchain) InflightHeight(hash []byte) (uint64, bool) {
+	ib, ok := bc.inflight[chain_util.KeyOf(hash)]
+	if !ok {
+		return 0, false
+	}
+	return ib.height, true
+}
+
+// pruneInflight drops the blocks in flight that no longer chain on
+// the committed tip, i.e. the committed one and its conflicting forks
+func (bc *Blockchain) pruneInflight() {
+	for pruned := true; pruned; {
+		pruned = false
+		for hashKey, ib := range bc.inflight {
+			if _, _, ok := bc.parent(ib.block.LastHash); !ok || ib.height <= bc.Height() {
+				delete(bc.inflight, hashKey)
+				pruned = true
+			}
+		}
+	}
+}
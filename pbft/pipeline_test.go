@@ -0,0 +1,119 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"testing"
+)
+
+// proposerWallet returns the wallet of the next block's proposer,
+// among the `NODE-{i}` wallets including those joining the set
+func proposerWallet(bc *Blockchain) Wallet {
+	for i := range 2 * NUM_OF_NODES {
+		w := NewWallet("NODE-" + strconv.Itoa(i))
+		if chain_util.Equal(w.publicKey, bc.GetProposer()) {
+			return *w
+		}
+	}
+	panic("proposer not found")
+}
+
+func TestBlockchain_Pipeline(t *testing.T) {
+	primary := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	backup := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	primary.depth, backup.depth = 3, 3
+	sender := NewWallet("sender")
+
+	w := proposerWallet(primary)
+	blocks := make([]*Block, 0, 3)
+	for i := range 3 {
+		if !primary.CanPropose() {
+			t.Fatalf("CanPropose should leave room for block %d", i+1)
+		}
+		if proposer := proposerWallet(primary); !chain_util.Equal(proposer.publicKey, w.publicKey) {
+			t.Errorf("the proposer should not change within a window")
+		}
+		blocks = append(blocks, primary.CreateBlock(w, []Transaction{*sender.CreateTx("key=" + strconv.Itoa(i))}))
+	}
+	if primary.CanPropose() {
+		t.Errorf("CanPropose should be false once the pipeline is full")
+	}
+	for i, block := range blocks {
+		if block.Height != uint64(i+1) {
+			t.Errorf("block %d should chain on the previous block in flight", i+1)
+		}
+		if !backup.VerifyBlock(*block) || !backup.AddInflight(*block) {
+			t.Fatalf("backup should accept block %d in flight", i+1)
+		}
+	}
+
+	blockPool, preparePool, commitPool := NewBlockPool(), NewMsgPool(), NewMsgPool()
+	for _, block := range blocks {
+		blockPool.AddBlock2Pool(*block)
+	}
+	if _, ok := backup.AddUpdatedBlock2Chain(blocks[1].Hash, *blockPool, *preparePool, *commitPool); ok {
+		t.Errorf("AddUpdatedBlock2Chain should wait for the parent")
+	}
+	for _, block := range blocks {
+		if _, ok := backup.AddUpdatedBlock2Chain(block.Hash, *blockPool, *preparePool, *commitPool); !ok {
+			t.Fatalf("AddUpdatedBlock2Chain failed")
+		}
+	}
+	if backup.Height() != 3 || len(backup.inflight) != 0 {
+		t.Errorf("all blocks should be committed in order, height %d, %d in flight", backup.Height(), len(backup.inflight))
+	}
+	if value, _ := backup.state.Latest().Get([]byte("key")); string(value) != "2" {
+		t.Errorf("committed state should match the speculative one, got %s", value)
+	}
+}
+
+func TestBlockchain_ProposerForDepthOne(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	bc.depth = 1
+	bc.SetView(1)
+	tip := bc.chain[0].Hash
+	expected := bc.ValidatorsAt(1).list[1]
+	if proposer, ok := bc.ProposerFor(tip); !ok || !chain_util.Equal(proposer, expected) {
+		t.Errorf("a depth of 1 should elect the proposer from the parent")
+	}
+}
+
+func TestBlockchain_StaleProposal(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	w := proposerWallet(bc)
+	// the head moves on while the block is signed
+	header, body, state := bc.NextBlock(nil)
+	if bc.CreateBlock(w, nil) == nil {
+		t.Fatalf("CreateBlock should create a block")
+	}
+	stale := NewWallet("other").CreateBlock(header, body)
+	if bc.AddProposal(*stale, state) {
+		t.Errorf("AddProposal should refuse a block of a height already proposed")
+	}
+	// the view changes while the block is signed
+	header, body, state = bc.NextBlock(nil)
+	bc.SetView(1)
+	if bc.AddProposal(*w.CreateBlock(header, body), state) {
+		t.Errorf("AddProposal should refuse a block of a previous view")
+	}
+}
+
+func TestNode_CanProposeNext(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	node := &Node{Blockchain: *bc, Wallet: proposerWallet(bc)}
+	if !node.canProposeNext() {
+		t.Fatalf("canProposeNext should let the proposer propose height 1")
+	}
+	node.proposedHeight, node.proposedView = 1, 0
+	if node.canProposeNext() {
+		t.Errorf("canProposeNext should not propose height 1 twice in the same view")
+	}
+	node.Blockchain.CreateBlock(node.Wallet, nil)
+	if node.Blockchain.depth > 1 && !node.canProposeNext() {
+		t.Errorf("canProposeNext should let the proposer propose height 2")
+	}
+	other := &Node{Blockchain: *bc, Wallet: *NewWallet("outsider")}
+	if other.canProposeNext() {
+		t.Errorf("canProposeNext should be false for a node that is not the proposer")
+	}
+}
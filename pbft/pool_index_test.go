@@ -0,0 +1,97 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"testing"
+)
+
+// newIndexedPools fills the pools the way a busy node would
+func newIndexedPools(n int) (*Validators, *BlockPool, *MsgPool, *TransactionPool, *Block, *Message, *Transaction) {
+	vs := NewValidators(n)
+	bp := NewBlockPool()
+	mp := NewMsgPool()
+	tp := NewTxPool()
+	var block *Block
+	for i := range n {
+		w := NewWallet("NODE-" + strconv.Itoa(i))
+		block = w.CreateBlock(BlockHeader{Height: 1, LastHash: Genesis().Hash, AppHash: NewStateStore().AppHash()}, BlockBody{})
+		bp.AddBlock2Pool(*block)
+		tp.AddTx2Pool(*NewWallet("sender-" + strconv.Itoa(i)).CreateTx("data"))
+	}
+	var msg *Message
+	for i := range n {
+		msg = NewWallet("NODE-"+strconv.Itoa(i)).CreateMsg(MsgPrepare, block.Hash, 1, 0)
+		mp.AddMsg2Pool(*msg)
+	}
+	tx := NewWallet("sender-0").CreateTx("data")
+	return vs, bp, mp, tp, block, msg, tx
+}
+
+func TestPools_HotPathAllocs(t *testing.T) {
+	vs, bp, mp, tp, block, msg, tx := newIndexedPools(16)
+	if !vs.ValidatorExists(msg.PublicKey) || !mp.MsgExists(*msg) || mp.Count(block.Hash) != 16 || !tp.TxExists(*tx) {
+		t.Fatal("indexed pools should find what was added")
+	}
+	if exists, _ := bp.BlockExists(block.Hash); !exists {
+		t.Fatal("BlockExists should find the block")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		vs.ValidatorExists(msg.PublicKey)
+		bp.BlockExists(block.Hash)
+		mp.MsgExists(*msg)
+		mp.Count(block.Hash)
+		tp.TxExists(*tx)
+	})
+	if allocs != 0 {
+		t.Errorf("pool lookups should not allocate, got %v allocs", allocs)
+	}
+}
+
+func TestBlockPool_CleanPoolReindexes(t *testing.T) {
+	_, bp, _, _, block, _, _ := newIndexedPools(4)
+	first := bp.pool[0]
+	bp.CleanPool(first.Hash)
+	if exists, _ := bp.BlockExists(first.Hash); exists {
+		t.Errorf("CleanPool should remove the block")
+	}
+	if got := bp.GetBlock(block.Hash); got == nil || !chain_util.Equal(got.Hash, block.Hash) {
+		t.Errorf("GetBlock should still find the blocks after the removed one")
+	}
+}
+
+func BenchmarkValidators_ValidatorExists(b *testing.B) {
+	vs, _, _, _, _, msg, _ := newIndexedPools(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		vs.ValidatorExists(msg.PublicKey)
+	}
+}
+
+func BenchmarkBlockPool_BlockExists(b *testing.B) {
+	_, bp, _, _, block, _, _ := newIndexedPools(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		bp.BlockExists(block.Hash)
+	}
+}
+
+func BenchmarkMsgPool_MsgExists(b *testing.B) {
+	_, _, mp, _, _, msg, _ := newIndexedPools(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		mp.MsgExists(*msg)
+	}
+}
+
+func BenchmarkTransactionPool_TxExists(b *testing.B) {
+	_, _, _, tp, _, _, tx := newIndexedPools(64)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		tp.TxExists(*tx)
+	}
+}
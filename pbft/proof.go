@@ -0,0 +1,54 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+)
+
+/**
+TxProof proves that a tx is included in a block without shipping the
+block's data. It carries the block header to recompute the block
+hash, so a client holding a certified block hash can check the
+proof on its own. It features the following methods:
+1. NewTxProof
+2. VerifyTxProof
+*/
+
+type TxProof struct {
+	Tx     Transaction             `json:"tx"`
+	Index  int                     `json:"index"`
+	Header BlockHeader             `json:"header"`
+	Path   []chain_util.MerkleStep `json:"path"`
+}
+
+// NewTxProof creates the inclusion proof of the tx with given hash,
+// it returns nil if the block does not contain the tx
+func NewTxProof(block Block, txHash []byte) *TxProof {
+	for idx, tx := range block.Data {
+		if !chain_util.Equal(tx.Hash, txHash) {
+			continue
+		}
+		return &TxProof{
+			Tx:     tx,
+			Index:  idx,
+			Header: block.BlockHeader,
+			Path:   chain_util.MerkleProof(TxLeaves(block.Data), idx),
+		}
+	}
+	return nil
+}
+
+// VerifyTxProof checks the proof against a trusted block hash: the tx
+// must fold up to the tx root, and the header carrying that root must
+// hash to the given block hash
+func VerifyTxProof(proof TxProof, blockHash []byte) bool {
+	txInByte, err := json.Marshal(proof.Tx)
+	if err != nil {
+		return false
+	}
+	leaf := chain_util.MerkleLeafHash(txInByte)
+	if !chain_util.VerifyMerkleProof(leaf, proof.Path, proof.Header.TxRoot) {
+		return false
+	}
+	return chain_util.Equal(HashBlock(proof.Header), blockHash)
+}
@@ -0,0 +1,253 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+/**
+The proposer side of a node. Besides the size-triggered batches cut
+when txs arrive, a batcher loop cuts a batch once its oldest tx has
+waited for BATCH_MAX_WAIT, so a single tx never waits forever under
+low load. When HEARTBEAT_INTERVAL is set, the proposer also proposes
+an empty block after that long without any block. Every proposal
+path goes through canProposeNext, so a height is proposed at most once
+per view even when a heartbeat and a batch race for it.
+On backups, the same loop checks the request timers and asks for a
+view change when the primary fails to commit a request in time.
+It features the following methods:
+1. isProposer
+2. canProposeNext
+3. cutReadyBatch
+4. proposeBlock
+5. runBatcher
+6. requestViewChange
+7. handleViewChange
+8. handleNewView
+*/
+
+// isProposer checks if current node is the proposer of the next block
+func (node *Node) isProposer() bool {
+	return chain_util.Equal(node.Blockchain.GetProposer(), node.Wallet.publicKey)
+}
+
+// canProposeNext checks if current node is the proposer of the next
+// height, the pipeline has room for it and this node did not propose
+// it yet in the current view, the caller must hold the mutex
+func (node *Node) canProposeNext() bool {
+	if !node.isProposer() || !node.Blockchain.CanPropose() {
+		return false
+	}
+	_, height, _ := node.Blockchain.head()
+	return node.proposedView != node.Blockchain.View() || height+1 > node.proposedHeight
+}
+
+// cutReadyBatch cuts a size-triggered batch if current node can
+// propose the next height, the caller must hold the mutex
+func (node *Node) cutReadyBatch() []Transaction {
+	if !node.canProposeNext() {
+		return nil
+	}
+	return node.TxPool.CutReadyBatch()
+}
+
+// proposeBlock creates a block with given txs and broadcasts it
+func (node *Node) proposeBlock(txs []Transaction) {
+	log.Println("PROPOSING A NEW BLOCK!")
+	mutex.Lock()
+	if !node.canProposeNext() {
+		// another proposal took the height
+		node.TxPool.RequeueBatch(txs, time.Now())
+		mutex.Unlock()
+		return
+	}
+	header, body, state := node.Blockchain.NextBlock(txs)
+	node.proposedHeight, node.proposedView = header.Height, header.View
+	node.lastBlockAt = time.Now()
+	mutex.Unlock()
+	// a remote signer may be slow, sign without holding the mutex
+	block := node.Wallet.CreateBlock(header, body)
+	if block == nil {
+		log.Println("Block not signed, won't be sent, skip this one!")
+	}
+	// the pipeline may have moved on while the block was signed
+	mutex.Lock()
+	added := block != nil && node.Blockchain.AddProposal(*block, state)
+	if !added {
+		node.TxPool.RequeueBatch(txs, time.Now())
+		if node.proposedHeight == header.Height && node.proposedView == header.View {
+			// the height may be proposed again
+			node.proposedHeight = header.Height - 1
+		}
+	}
+	mutex.Unlock()
+	if !added {
+		return
+	}
+
+	newMsg, err := json.Marshal(block)
+	if err != nil {
+		log.Printf("Marshal block failed, %s, msg won't be sent, skip this one!\n", err)
+		return
+	}
+	node.broadcast(string(newMsg))
+}
+
+// runBatcher periodically cuts time-triggered batches and heartbeat
+// blocks
+func (node *Node) runBatcher() {
+	ticker := time.NewTicker(BATCH_TICK)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		mutex.Lock()
+		isProposer := node.isProposer()
+		canPropose := node.canProposeNext()
+		var batch []Transaction
+		if canPropose {
+			batch = node.TxPool.CutTimedBatch(now)
+		}
+		idle := canPropose && HEARTBEAT_INTERVAL > 0 && now.Sub(node.lastBlockAt) >= HEARTBEAT_INTERVAL
+		// only requests the primary can include now are timed
+		node.RequestTimers.Retain(node.TxPool.AwaitedTxs())
+		censored := !isProposer && node.RequestTimers.Expired(now) > 0
+		if censored {
+			// give the next primary a full timeout
+			node.RequestTimers.Restart(now)
+		}
+		nextView := node.Blockchain.View() + 1
+		mutex.Unlock()
+
+		if censored {
+			log.Println("REQUEST TIMER EXPIRED, SUSPECTING PRIMARY!")
+			node.requestViewChange(nextView)
+			continue
+		}
+		if !isProposer {
+			continue
+		}
+		if batch != nil {
+			node.proposeBlock(batch)
+		} else if idle {
+			log.Println("HEARTBEAT!")
+			node.proposeBlock(nil)
+		}
+	}
+}
+
+// requestViewChange broadcasts current node's view change for given
+// view, carrying its committed tip and prepared blocks
+func (node *Node) requestViewChange(view uint64) {
+	mutex.Lock()
+	unsigned := node.Blockchain.ViewChangeFor(view)
+	mutex.Unlock()
+	vc := node.Wallet.CreateViewChange(unsigned)
+	if vc == nil {
+		return
+	}
+	mutex.Lock()
+	// the view may have changed while the view change was signed
+	stale := view <= node.Blockchain.View() || node.ViewChangePool.ViewChangeExists(*vc)
+	mutex.Unlock()
+	if stale {
+		return
+	}
+	newMsg, err := json.Marshal(vc)
+	if err != nil {
+		log.Printf("Marshal viewChange failed, %s, msg won't be sent, skip this one!\n", err)
+		return
+	}
+	node.broadcast(string(newMsg))
+}
+
+// handleViewChange moves to the view once a quorum asked for it, and
+// joins a view change already backed by more than 1/3 of the power,
+// since at least one honest validator suspects the primary. The
+// primary of the new view then sends its NEW-VIEW.
+func (node *Node) handleViewChange(view uint64) {
+	mutex.Lock()
+	validators := node.Blockchain.ValidatorsAt(node.Blockchain.Height() + 1)
+	power := validators.VotingPower(node.ViewChangePool.Voters(view))
+	if view <= node.Blockchain.View() {
+		mutex.Unlock()
+		return
+	}
+	if power >= validators.QuorumPower() {
+		node.Blockchain.SetView(view)
+		node.ViewChangePool.CleanPool(view - 1)
+		// give the new primary a full timeout to send its NEW-VIEW
+		node.RequestTimers.Restart(time.Now())
+		isPrimary := chain_util.Equal(node.Blockchain.ViewPrimary(view), node.Wallet.publicKey)
+		vcs := node.ViewChangePool.ViewChanges(view)
+		mutex.Unlock()
+		log.Printf("[VIEW CHANGED TO %d!!!]\n", view)
+		if !isPrimary {
+			return
+		}
+		// the NEW-VIEW is checked again by handleNewView once signed
+		nv := node.Wallet.CreateNewView(view, vcs)
+		if nv == nil {
+			return
+		}
+		newMsg, err := json.Marshal(nv)
+		if err != nil {
+			log.Printf("Marshal newView failed, %s, msg won't be sent, skip this one!\n", err)
+			return
+		}
+		// backups get the NEW-VIEW before any proposal of the view
+		node.broadcast(string(newMsg))
+		node.handleNewView(*nv)
+		return
+	}
+	mutex.Unlock()
+	if power >= validators.HonestPower() {
+		node.requestViewChange(view)
+	}
+}
+
+// handleNewView applies a verified NEW-VIEW: the node moves to its
+// view and votes again on the blocks carried into it. A backup then
+// forwards its pending requests to the new primary, so that requests
+// the replaced primary held back do not wait for another timeout.
+func (node *Node) handleNewView(nv NewView) bool {
+	mutex.Lock()
+	if !node.Blockchain.VerifyNewView(nv) {
+		mutex.Unlock()
+		return false
+	}
+	carried := node.Blockchain.ApplyNewView(nv)
+	// votes of the previous views are not counted anymore
+	node.PreparePool.Clear()
+	node.CommitPool.Clear()
+	for _, block := range carried {
+		if exists, _ := node.BlockPool.BlockExists(block.Hash); !exists {
+			node.BlockPool.AddBlock2Pool(block)
+		}
+	}
+	node.ViewChangePool.CleanPool(nv.View)
+	now := time.Now()
+	node.RequestTimers.Restart(now)
+	node.TxPool.RequeueInProgress(now)
+	node.lastBlockAt = now
+	var pending []Transaction
+	if !node.isProposer() {
+		pending = append(pending, node.TxPool.pool...)
+	}
+	mutex.Unlock()
+	log.Printf("[NEW VIEW %d, %d BLOCKS CARRIED]\n", nv.View, len(carried))
+
+	for _, block := range carried {
+		go node.prepareBlock(block)
+	}
+	go node.replayFuture()
+	for _, tx := range pending {
+		newMsg, err := json.Marshal(tx)
+		if err != nil {
+			log.Printf("Marshal tx failed, %s, msg won't be sent, skip this one!\n", err)
+			continue
+		}
+		go node.broadcast(string(newMsg))
+	}
+	return true
+}
@@ -0,0 +1,169 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+/**
+A remote signer is a separate process holding the validator's key, the
+node talks to it over a Unix socket, so the key never enters the node
+process. Requests and responses are JSON values streamed over the
+connection, one response per request.
+It features the following methods:
+1. ServeSigner
+2. DialSigner
+3. PublicKey
+4. Sign
+*/
+
+const (
+	signerMethodPublicKey = "publicKey"
+	signerMethodSign      = "sign"
+)
+
+type signerRequest struct {
+	Method  string       `json:"method"`
+	Request *SignRequest `json:"request,omitempty"`
+}
+
+type signerResponse struct {
+	PublicKey PublicKey `json:"publicKey,omitempty"`
+	Signature []byte    `json:"signature,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// RemoteSigner signs through a signer process listening on a socket
+type RemoteSigner struct {
+	path      string
+	publicKey PublicKey
+	mu        sync.Mutex
+	conn      net.Conn
+	enc       *json.Encoder
+	dec       *json.Decoder
+}
+
+// ServeSigner answers the requests of the nodes connecting to given
+// listener with given signer, it returns when the listener is closed
+func ServeSigner(listener net.Listener, signer Signer) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go serveSignerConn(conn, signer)
+	}
+}
+
+// serveSignerConn answers the requests of a connection until it closes
+func serveSignerConn(conn net.Conn, signer Signer) {
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	enc := json.NewEncoder(conn)
+	for {
+		var request signerRequest
+		if err := dec.Decode(&request); err != nil {
+			return
+		}
+		var response signerResponse
+		switch {
+		case request.Method == signerMethodPublicKey:
+			response.PublicKey = signer.PublicKey()
+		case request.Method == signerMethodSign && request.Request != nil:
+			signature, err := signer.Sign(*request.Request)
+			if err != nil {
+				log.Printf("REFUSED to sign, %v\n", err)
+				response.Error = err.Error()
+			}
+			response.Signature = signature
+		default:
+			response.Error = "unknown method [" + request.Method + "]"
+		}
+		if err := enc.Encode(response); err != nil {
+			return
+		}
+	}
+}
+
+// DialSigner connects to the signer process listening at given socket
+// path and fetches its public key
+func DialSigner(path string) (*RemoteSigner, error) {
+	rs := &RemoteSigner{path: path}
+	response, err := rs.call(signerRequest{Method: signerMethodPublicKey})
+	if err != nil {
+		return nil, err
+	}
+	if len(response.PublicKey) == 0 {
+		return nil, fmt.Errorf("signer has no public key")
+	}
+	rs.publicKey = response.PublicKey
+	return rs, nil
+}
+
+// PublicKey returns the remote signer's public key
+func (rs *RemoteSigner) PublicKey() PublicKey {
+	return rs.publicKey
+}
+
+// Sign has the signer process sign a request, the signature is checked
+// against the signer's public key
+func (rs *RemoteSigner) Sign(req SignRequest) ([]byte, error) {
+	hash, ok := HashSignRequest(req)
+	if !ok {
+		return nil, fmt.Errorf("malformed %s sign request", req.Type)
+	}
+	response, err := rs.call(signerRequest{Method: signerMethodSign, Request: &req})
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("signer refused, %s", response.Error)
+	}
+	if !chain_util.Verify(rs.publicKey, hash, response.Signature) {
+		return nil, fmt.Errorf("signer returned an invalid signature")
+	}
+	return response.Signature, nil
+}
+
+// call sends a request and waits for its response, it reconnects once
+// if the connection is broken. Resending a sign request is safe, the
+// signer signs the same request again.
+func (rs *RemoteSigner) call(request signerRequest) (signerResponse, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	var response signerResponse
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if rs.conn == nil {
+			if err = rs.connect(); err != nil {
+				continue
+			}
+		}
+		rs.conn.SetDeadline(time.Now().Add(SIGNER_TIMEOUT))
+		if err = rs.enc.Encode(request); err == nil {
+			if err = rs.dec.Decode(&response); err == nil {
+				return response, nil
+			}
+		}
+		rs.conn.Close()
+		rs.conn = nil
+	}
+	return response, fmt.Errorf("signer at %s unreachable, %v", rs.path, err)
+}
+
+// connect opens a connection to the signer
+func (rs *RemoteSigner) connect() error {
+	conn, err := net.DialTimeout("unix", rs.path, SIGNER_TIMEOUT)
+	if err != nil {
+		return err
+	}
+	rs.conn = conn
+	rs.enc = json.NewEncoder(conn)
+	rs.dec = json.NewDecoder(conn)
+	return nil
+}
@@ -0,0 +1,102 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"log"
+	"strconv"
+)
+
+/**
+Reply is sent by every replica to the client once the client's tx is
+executed. A client accepts an outcome after collecting f+1 matching
+replies from distinct validators, at least one of which is honest.
+It features the following methods:
+1. NewReply
+2. HashReply
+3. VerifyReply
+*/
+
+type Reply struct {
+	MsgType   string    `json:"msgType"`
+	TxId      string    `json:"txId"`
+	Height    uint64    `json:"height"`
+	Result    string    `json:"result"`
+	PublicKey PublicKey `json:"publicKey"`
+	Signature []byte    `json:"signature"`
+}
+
+/**
+ReplyPool stores the replies created by this replica so that clients
+can fetch them. It keeps the latest REPLY_CACHE_SIZE replies only.
+It features the following methods:
+1. NewReplyPool
+2. AddReply2Pool
+3. GetReply
+*/
+
+type ReplyPool struct {
+	replies map[string]Reply
+	order   []string
+}
+
+// NewReply creates a reply with given execution outcome
+func NewReply(txId string, height uint64, result string, publicKey PublicKey, signature []byte) *Reply {
+	return &Reply{
+		MsgType:   MsgReply,
+		TxId:      txId,
+		Height:    height,
+		Result:    result,
+		PublicKey: publicKey,
+		Signature: signature,
+	}
+}
+
+// HashReply returns the hash of the reply's outcome, it is prefixed by
+// the message type so that no client-chosen tx id makes it the digest
+// of a vote. The tx id is derived from the tx hash, see TxId, so the
+// reply is bound to the sender, nonce and content of the tx
+func HashReply(txId string, height uint64, result string) []byte {
+	return chain_util.Hash(MsgReply + "/" + strconv.FormatUint(height, 10) + "/" + strconv.Quote(txId) + "/" + result)
+}
+
+// VerifyReply verifies the reply's signature over its outcome
+func VerifyReply(reply Reply) bool {
+	return reply.MsgType == MsgReply &&
+		sigVerifier.Verify(reply.PublicKey, HashReply(reply.TxId, reply.Height, reply.Result), reply.Signature)
+}
+
+// NewReplyPool creates an empty reply pool
+func NewReplyPool() *ReplyPool {
+	return &ReplyPool{
+		replies: make(map[string]Reply),
+		order:   make([]string, 0, REPLY_CACHE_SIZE),
+	}
+}
+
+// AddReply2Pool adds a reply, dropping the oldest one when full
+func (rp *ReplyPool) AddReply2Pool(reply Reply) {
+	if _, ok := rp.replies[reply.TxId]; !ok {
+		rp.order = append(rp.order, reply.TxId)
+	}
+	rp.replies[reply.TxId] = reply
+	if len(rp.order) > REPLY_CACHE_SIZE {
+		delete(rp.replies, rp.order[0])
+		rp.order = rp.order[1:]
+	}
+	log.Printf("Reply for tx [%s] added to reply pool\n", reply.TxId)
+}
+
+// GetReply returns the reply for given tx id
+func (rp *ReplyPool) GetReply(txId string) (*Reply, bool) {
+	reply, ok := rp.replies[txId]
+	if !ok {
+		return nil, false
+	}
+	return &reply, true
+}
+
+// Clear clears the content of reply pool
+func (rp *ReplyPool) Clear() {
+	rp.replies = make(map[string]Reply)
+	rp.order = rp.order[:0]
+}
@@ -0,0 +1,81 @@
+package pbft
+
+import "time"
+
+/**
+RequestTimers implements censorship detection on backups: a timer is
+started for every client request a backup forwards to the primary, and
+stopped once the request is committed. A request whose timer expires
+means the primary does not include it, so the backup asks for a view
+change. A request leaving the pool without being committed (stale,
+evicted or expired), or waiting behind a nonce gap, cannot be blamed
+on the primary, Retain stops its timer before expiries are checked.
+It features the following methods:
+1. NewRequestTimers
+2. Start
+3. Stop
+4. Retain
+5. Expired
+6. Restart
+7. Clear
+*/
+
+type RequestTimers struct {
+	deadlines map[string]time.Time // tx id -> deadline
+	timeout   time.Duration
+}
+
+// NewRequestTimers creates request timers with given timeout
+func NewRequestTimers(timeout time.Duration) *RequestTimers {
+	return &RequestTimers{
+		deadlines: make(map[string]time.Time),
+		timeout:   timeout,
+	}
+}
+
+// Start starts the timer of a request if not started yet
+func (rt *RequestTimers) Start(txId string, now time.Time) {
+	if _, ok := rt.deadlines[txId]; !ok {
+		rt.deadlines[txId] = now.Add(rt.timeout)
+	}
+}
+
+// Stop stops the timers of the given committed txs
+func (rt *RequestTimers) Stop(txs []Transaction) {
+	for _, tx := range txs {
+		delete(rt.deadlines, tx.Id)
+	}
+}
+
+// Retain stops the timers of the requests not in given set
+func (rt *RequestTimers) Retain(txIds map[string]bool) {
+	for txId := range rt.deadlines {
+		if !txIds[txId] {
+			delete(rt.deadlines, txId)
+		}
+	}
+}
+
+// Expired returns the number of requests whose timer expired
+func (rt *RequestTimers) Expired(now time.Time) int {
+	expired := 0
+	for _, deadline := range rt.deadlines {
+		if now.After(deadline) {
+			expired++
+		}
+	}
+	return expired
+}
+
+// Restart gives every pending request a fresh timeout, e.g. to give a
+// new primary a chance after a view change
+func (rt *RequestTimers) Restart(now time.Time) {
+	for txId := range rt.deadlines {
+		rt.deadlines[txId] = now.Add(rt.timeout)
+	}
+}
+
+// Clear stops all timers
+func (rt *RequestTimers) Clear() {
+	rt.deadlines = make(map[string]time.Time)
+}
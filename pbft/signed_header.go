@@ -0,0 +1,78 @@
+package pbft
+
+import "consensus-algorithms-with-golang/pbft/chain_util"
+
+/**
+SignedHeader is a committed block without its data: the block header,
+signed by the proposer, the COMMIT messages certifying it and the
+block's last commit, which the reputation election scores. It is
+what light clients download to follow the chain.
+It features the following methods:
+1. NewSignedHeader
+2. VerifyHash
+3. VerifyLastCommit
+4. VerifyCommits
+5. VerifyCommitQuorum / CommitSigners
+*/
+
+type SignedHeader struct {
+	BlockHeader `json:"header"`
+	LastCommit  []Message `json:"lastCommit,omitempty"`
+	CommitMsgs  []Message `json:"commitMsgs"`
+}
+
+// NewSignedHeader strips a committed block down to its signed header
+func NewSignedHeader(block Block) *SignedHeader {
+	return &SignedHeader{
+		BlockHeader: block.BlockHeader,
+		LastCommit:  block.LastCommit,
+		CommitMsgs:  block.Commits(),
+	}
+}
+
+// VerifyHash checks the header fields hash to the header's hash and
+// that the hash is signed by the proposer
+func (sh *SignedHeader) VerifyHash() bool {
+	return chain_util.Equal(HashBlock(sh.BlockHeader), sh.Hash) &&
+		sigVerifier.Verify(sh.Proposer, sh.Hash, sh.Signature)
+}
+
+// VerifyLastCommit checks the last commit against the header's last
+// commit hash
+func (sh *SignedHeader) VerifyLastCommit() bool {
+	return chain_util.Equal(HashCommits(sh.LastCommit), sh.LastCommitHash)
+}
+
+// VerifyCommits checks that a quorum of the voting power signed a
+// COMMIT for the header's hash at the header's height
+func (sh *SignedHeader) VerifyCommits(vs Validators) bool {
+	return VerifyCommitQuorum(sh.CommitMsgs, sh.Hash, sh.Height, vs)
+}
+
+// VerifyCommitQuorum checks that distinct validators holding a quorum
+// of the voting power signed a COMMIT for given block hash at given
+// height
+func VerifyCommitQuorum(msgs []Message, hash []byte, height uint64, vs Validators) bool {
+	return vs.HasQuorum(CommitSigners(msgs, hash, height, vs))
+}
+
+// CommitSigners returns the distinct validators that signed a COMMIT
+// for given block hash at given height among given messages
+func CommitSigners(msgs []Message, hash []byte, height uint64, vs Validators) []PublicKey {
+	var signers []PublicKey
+	seen := make(map[chain_util.Key]bool, len(msgs))
+	for _, msg := range msgs {
+		signer := chain_util.KeyOf(msg.PublicKey)
+		if msg.MsgType != MsgCommit ||
+			!chain_util.Equal(msg.BlockHash, hash) ||
+			msg.Height != height ||
+			seen[signer] ||
+			!vs.ValidatorExists(msg.PublicKey) ||
+			!VerifyMsg(msg) {
+			continue
+		}
+		seen[signer] = true
+		signers = append(signers, msg.PublicKey)
+	}
+	return signers
+}
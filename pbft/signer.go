@@ -0,0 +1,246 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+)
+
+/**
+A Signer holds a validator's private key and signs on behalf of its
+wallet. It is given what to sign rather than a bare hash and derives
+the hash itself, so a signer outside the node process, see
+remote_signer.go, knows what it signs and a compromised node cannot
+make it sign a vote disguised as something else.
+GuardedSigner keeps the last block and votes signed at each height in
+a state file and refuses to sign a conflicting one, i.e. another block
+or vote of the same type and height in the same view, or one in an
+older view. A COMMIT for another block at a height where a COMMIT
+was signed is refused even in a later view, unless the request is
+justified by a PreparedCert of that block from a view after the
+signed one, e.g. the certificate the node formed in the new view. The
+signer has no validator set, it checks the certificate's block and
+PREPARE signatures, the node checks their quorum. The state is saved
+before a signature is returned, so a restarted signer never
+equivocates.
+It features the following methods:
+1. HashSignRequest
+2. NewLocalSigner
+3. NewGuardedSigner
+4. Sign
+*/
+
+type Signer interface {
+	PublicKey() PublicKey
+	Sign(req SignRequest) ([]byte, error)
+}
+
+// SignRequest is what a signer signs, its type is the type of the
+// signed message and only the fields of that type are set
+type SignRequest struct {
+	Type       string       `json:"type"`
+	Header     *BlockHeader `json:"header,omitempty"`     // PRE-PREPARE
+	BlockHash  []byte       `json:"blockHash,omitempty"`  // votes and block requests
+	Height     uint64       `json:"height,omitempty"`     // votes, block requests and replies
+	View       uint64       `json:"view,omitempty"`       // votes and block requests
+	ViewChange *ViewChange  `json:"viewChange,omitempty"` // VIEW-CHANGE
+	NewView    *NewView     `json:"newView,omitempty"`    // NEW-VIEW
+	From       PublicKey    `json:"from,omitempty"`       // Tx
+	Event      *Event       `json:"event,omitempty"`      // Tx
+	Nonce      uint64       `json:"nonce,omitempty"`      // Tx
+	Priority   uint64       `json:"priority,omitempty"`   // Tx
+	TxId       string       `json:"txId,omitempty"`       // REPLY
+	Result     string       `json:"result,omitempty"`     // REPLY
+
+	// Justification is the certificate of a COMMIT's block, it is
+	// required to commit another block at the same height
+	Justification *PreparedCert `json:"justification,omitempty"` // COMMIT
+}
+
+// LocalSigner signs with a private key held in memory
+type LocalSigner struct {
+	privateKey PrivateKey
+	publicKey  PublicKey
+}
+
+// GuardedSigner wraps a signer with double-sign protection
+type GuardedSigner struct {
+	signer Signer
+	path   string // state file
+	state  SignState
+	mu     sync.Mutex
+}
+
+// SignState is the last block and votes signed at each of the latest
+// SIGNER_STATE_HEIGHTS heights, heights at or below the floor are
+// refused since what was signed there is forgotten
+type SignState struct {
+	Floor  uint64                `json:"floor"`
+	Signed map[string]SignedVote `json:"signed"` // by type and height
+}
+
+type SignedVote struct {
+	Type   string `json:"type"`
+	Height uint64 `json:"height"`
+	View   uint64 `json:"view"`
+	Hash   []byte `json:"hash"`
+}
+
+// HashSignRequest returns the hash to sign for a request, it returns
+// false if the request is malformed
+func HashSignRequest(req SignRequest) ([]byte, bool) {
+	switch req.Type {
+	case MsgTx:
+		if req.Event == nil {
+			return nil, false
+		}
+		return HashTx(req.From, *req.Event, req.Nonce, req.Priority), true
+	case MsgPrePrepare:
+		if req.Header == nil {
+			return nil, false
+		}
+		return HashBlock(*req.Header), true
+	case MsgPrepare, MsgCommit, MsgRC, MsgBlockRequest:
+		return HashMsg(req.Type, req.BlockHash, req.Height, req.View), true
+	case MsgReply:
+		return HashReply(req.TxId, req.Height, req.Result), true
+	case MsgViewChange:
+		if req.ViewChange == nil {
+			return nil, false
+		}
+		return HashViewChange(*req.ViewChange), true
+	case MsgNewView:
+		if req.NewView == nil {
+			return nil, false
+		}
+		return HashNewView(*req.NewView), true
+	default:
+		return nil, false
+	}
+}
+
+// guardedVote returns the block or vote of a request that must not
+// conflict with a previously signed one, it returns false for other
+// requests
+func guardedVote(req SignRequest, hash []byte) (SignedVote, bool) {
+	switch req.Type {
+	case MsgPrePrepare:
+		return SignedVote{Type: req.Type, Height: req.Header.Height, View: req.Header.View, Hash: hash}, true
+	case MsgPrepare, MsgCommit, MsgRC:
+		return SignedVote{Type: req.Type, Height: req.Height, View: req.View, Hash: hash}, true
+	default:
+		return SignedVote{}, false
+	}
+}
+
+// justifies checks that the certificate of a COMMIT request prepared
+// its block in a view after the given one and not after its own view
+func justifies(req SignRequest, view uint64) bool {
+	cert := req.Justification
+	if cert == nil || len(cert.Prepares) == 0 ||
+		cert.View <= view || cert.View > req.View ||
+		!chain_util.Equal(cert.Block.Hash, req.BlockHash) ||
+		cert.Block.Height != req.Height ||
+		!VerifyBlock(cert.Block) {
+		return false
+	}
+	for _, msg := range cert.Prepares {
+		if msg.MsgType != MsgPrepare ||
+			!chain_util.Equal(msg.BlockHash, req.BlockHash) ||
+			msg.Height != req.Height ||
+			msg.View != cert.View ||
+			!VerifyMsg(msg) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewLocalSigner creates a signer with given private key
+func NewLocalSigner(privateKey PrivateKey) *LocalSigner {
+	return &LocalSigner{privateKey: privateKey, publicKey: privateKey.Public()}
+}
+
+// PublicKey returns the signer's public key
+func (ls *LocalSigner) PublicKey() PublicKey {
+	return ls.publicKey
+}
+
+// Sign signs the hash of a request
+func (ls *LocalSigner) Sign(req SignRequest) ([]byte, error) {
+	hash, ok := HashSignRequest(req)
+	if !ok {
+		return nil, fmt.Errorf("malformed %s sign request", req.Type)
+	}
+	return chain_util.Sign(ls.privateKey, hash), nil
+}
+
+// NewGuardedSigner wraps a signer with the state saved at given path,
+// the state is created if the file does not exist
+func NewGuardedSigner(signer Signer, path string) (*GuardedSigner, error) {
+	gs := &GuardedSigner{signer: signer, path: path}
+	if err := readJSONFile(path, &gs.state); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if gs.state.Signed == nil {
+		gs.state.Signed = make(map[string]SignedVote)
+	}
+	return gs, nil
+}
+
+// PublicKey returns the wrapped signer's public key
+func (gs *GuardedSigner) PublicKey() PublicKey {
+	return gs.signer.PublicKey()
+}
+
+// Sign signs a request unless it conflicts with a block or vote signed
+// before, signing the same one again is allowed
+func (gs *GuardedSigner) Sign(req SignRequest) ([]byte, error) {
+	hash, ok := HashSignRequest(req)
+	if !ok {
+		return nil, fmt.Errorf("malformed %s sign request", req.Type)
+	}
+	vote, guarded := guardedVote(req, hash)
+	if !guarded {
+		return gs.signer.Sign(req)
+	}
+
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	if gs.state.Floor > 0 && vote.Height <= gs.state.Floor {
+		return nil, fmt.Errorf("%s at height %d is below the signer's floor %d", vote.Type, vote.Height, gs.state.Floor)
+	}
+	key := vote.Type + "/" + strconv.FormatUint(vote.Height, 10)
+	if last, ok := gs.state.Signed[key]; ok {
+		switch {
+		case vote.View < last.View:
+			return nil, fmt.Errorf("%s at height %d view %d, already signed in view %d", vote.Type, vote.Height, vote.View, last.View)
+		case vote.View == last.View && !chain_util.Equal(vote.Hash, last.Hash):
+			return nil, fmt.Errorf("conflicting %s at height %d view %d", vote.Type, vote.Height, vote.View)
+		case vote.View == last.View:
+			// the same vote again, e.g. after a lost response
+			return gs.signer.Sign(req)
+		case vote.Type == MsgCommit && !chain_util.Equal(vote.Hash, last.Hash) && !justifies(req, last.View):
+			return nil, fmt.Errorf("unjustified %s at height %d view %d, another block committed in view %d", vote.Type, vote.Height, vote.View, last.View)
+		}
+	}
+
+	next := SignState{Floor: gs.state.Floor, Signed: make(map[string]SignedVote, len(gs.state.Signed)+1)}
+	if vote.Height > SIGNER_STATE_HEIGHTS && vote.Height-SIGNER_STATE_HEIGHTS > next.Floor {
+		next.Floor = vote.Height - SIGNER_STATE_HEIGHTS
+	}
+	for k, v := range gs.state.Signed {
+		if v.Height > next.Floor {
+			next.Signed[k] = v
+		}
+	}
+	next.Signed[key] = vote
+	// the vote is recorded before it is signed
+	if err := replaceFile(gs.path, next, 0600); err != nil {
+		return nil, fmt.Errorf("save signer state failed, %v", err)
+	}
+	gs.state = next
+	return gs.signer.Sign(req)
+}
@@ -0,0 +1,151 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func voteRequest(msgType string, blockHash string, height uint64, view uint64) SignRequest {
+	return SignRequest{Type: msgType, BlockHash: chain_util.Hash(blockHash), Height: height, View: view}
+}
+
+func TestGuardedSigner_RefusesConflicts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	w := NewWallet("signer")
+	gs, err := NewGuardedSigner(w.Signer(), path)
+	if err != nil {
+		t.Fatalf("NewGuardedSigner failed, %v", err)
+	}
+	if _, err := gs.Sign(voteRequest(MsgCommit, "a", 5, 1)); err != nil {
+		t.Fatalf("first vote refused, %v", err)
+	}
+	if _, err := gs.Sign(voteRequest(MsgCommit, "a", 5, 1)); err != nil {
+		t.Errorf("same vote refused, %v", err)
+	}
+	if _, err := gs.Sign(voteRequest(MsgCommit, "b", 5, 1)); err == nil {
+		t.Errorf("conflicting vote signed")
+	}
+	if _, err := gs.Sign(voteRequest(MsgPrepare, "b", 5, 1)); err != nil {
+		t.Errorf("vote of another type refused, %v", err)
+	}
+	if _, err := gs.Sign(voteRequest(MsgPrepare, "c", 5, 2)); err != nil {
+		t.Errorf("vote in a later view refused, %v", err)
+	}
+	if _, err := gs.Sign(voteRequest(MsgPrepare, "b", 5, 1)); err == nil {
+		t.Errorf("vote in an older view signed")
+	}
+	if _, err := gs.Sign(voteRequest(MsgCommit, "b", 5, 2)); err == nil {
+		t.Errorf("unjustified commit of another block in a later view signed")
+	}
+	if _, err := gs.Sign(SignRequest{Type: MsgViewChange, ViewChange: &ViewChange{View: 1}}); err != nil {
+		t.Errorf("view change refused, %v", err)
+	}
+
+	// a restarted signer remembers what it signed
+	restarted, err := NewGuardedSigner(w.Signer(), path)
+	if err != nil {
+		t.Fatalf("NewGuardedSigner failed, %v", err)
+	}
+	if _, err := restarted.Sign(voteRequest(MsgCommit, "c", 5, 2)); err == nil {
+		t.Errorf("conflicting vote signed after restart")
+	}
+}
+
+func TestGuardedSigner_RefusesConflictingBlocks(t *testing.T) {
+	w := NewWallet("signer")
+	gs, _ := NewGuardedSigner(w.Signer(), filepath.Join(t.TempDir(), "state.json"))
+	guarded := NewSignerWallet(gs)
+	if guarded.CreateBlock(BlockHeader{Height: 3, View: 0, Timestamp: 1}, BlockBody{}) == nil {
+		t.Fatalf("first block refused")
+	}
+	if guarded.CreateBlock(BlockHeader{Height: 3, View: 0, Timestamp: 2}, BlockBody{}) != nil {
+		t.Errorf("conflicting block signed")
+	}
+	if guarded.CreateMsg(MsgCommit, chain_util.Hash("a"), 3, 0) == nil ||
+		guarded.CreateMsg(MsgCommit, chain_util.Hash("b"), 3, 0) != nil {
+		t.Errorf("CreateMsg should sign the first vote and refuse the conflicting one")
+	}
+}
+
+func TestGuardedSigner_JustifiedCommit(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	block := proposeOn(bc, "k=v")
+	gs, _ := NewGuardedSigner(NewWallet("signer").Signer(), filepath.Join(t.TempDir(), "state.json"))
+	guarded := NewSignerWallet(gs)
+	if guarded.CreateMsg(MsgCommit, chain_util.Hash("a"), block.Height, 1) == nil {
+		t.Fatalf("first commit refused")
+	}
+	if guarded.CreateCommit(&PreparedCert{Block: *block, View: 1, Prepares: prepareAll(bc, *block, 1)}, block.Height, 2) != nil {
+		t.Errorf("commit justified by a certificate of the committed view signed")
+	}
+	cert := &PreparedCert{Block: *block, View: 2, Prepares: prepareAll(bc, *block, 1)}
+	if guarded.CreateCommit(cert, block.Height, 2) != nil {
+		t.Errorf("commit justified by PREPAREs of another view signed")
+	}
+	cert.Prepares = prepareAll(bc, *block, 2)
+	if guarded.CreateCommit(cert, block.Height, 2) == nil {
+		t.Errorf("commit justified by a certificate of a later view refused")
+	}
+}
+
+func TestGuardedSigner_Floor(t *testing.T) {
+	w := NewWallet("signer")
+	gs, _ := NewGuardedSigner(w.Signer(), filepath.Join(t.TempDir(), "state.json"))
+	gs.Sign(voteRequest(MsgCommit, "a", 1, 0))
+	if _, err := gs.Sign(voteRequest(MsgCommit, "a", SIGNER_STATE_HEIGHTS+10, 0)); err != nil {
+		t.Fatalf("vote refused, %v", err)
+	}
+	if len(gs.state.Signed) != 1 {
+		t.Errorf("signer keeps %d votes, want 1", len(gs.state.Signed))
+	}
+	if _, err := gs.Sign(voteRequest(MsgCommit, "b", 1, 0)); err == nil {
+		t.Errorf("vote below the floor signed")
+	}
+}
+
+func TestHashSignRequest(t *testing.T) {
+	if _, ok := HashSignRequest(SignRequest{Type: "raw"}); ok {
+		t.Errorf("request of unknown type accepted")
+	}
+	if _, ok := HashSignRequest(SignRequest{Type: MsgPrePrepare}); ok {
+		t.Errorf("block request without header accepted")
+	}
+	hash, _ := HashSignRequest(voteRequest(MsgCommit, "a", 1, 23))
+	if chain_util.Equal(hash, HashMsg(MsgCommit, chain_util.Hash("a"), 12, 3)) {
+		t.Errorf("votes of different heights and views share a digest")
+	}
+}
+
+func TestRemoteSigner(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "signer.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	w := NewWallet("remote")
+	gs, _ := NewGuardedSigner(w.Signer(), filepath.Join(t.TempDir(), "state.json"))
+	go ServeSigner(listener, gs)
+
+	rs, err := DialSigner(path)
+	if err != nil {
+		t.Fatalf("DialSigner failed, %v", err)
+	}
+	if !chain_util.Equal(rs.PublicKey(), w.PublicKey()) {
+		t.Errorf("remote public key does not match the signer's")
+	}
+	remote := NewSignerWallet(rs)
+	msg := remote.CreateMsg(MsgPrepare, chain_util.Hash("a"), 1, 0)
+	if msg == nil || !VerifyMsg(*msg) {
+		t.Errorf("remote signer failed to sign a vote")
+	}
+	if remote.CreateMsg(MsgPrepare, chain_util.Hash("b"), 1, 0) != nil {
+		t.Errorf("remote signer signed a conflicting vote")
+	}
+	tx := remote.CreateTx("data")
+	if tx == nil || !tx.VerifyTx() {
+		t.Errorf("remote signer failed to sign a tx")
+	}
+}
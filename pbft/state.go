@@ -0,0 +1,219 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"strings"
+)
+
+/**
+StateStore keeps the application state of a node in a sparse Merkle
+tree, with one immutable version per committed block height for the
+latest STATE_VERSIONS heights. Versions share the unchanged parts of
+their trees. The state root after executing a block is committed in
+that block as its `AppHash`, so any query at a kept height can be
+proven against a block.
+
+The application is a plain key-value store: a tx whose data reads
+`key=value` sets `key`, any other tx stores its data under its id.
+The last executed nonce of each sender lives in the state as well,
+under `nonce/{sender}`, and a tx whose nonce is not greater than it
+is not executed. Txs cannot write keys under the reserved prefixes.
+Governance txs, see governance.go, record their vote in the state as
+well, the validator set changes they adopt are applied by the
+blockchain. A block is executed within its BlockEnv, i.e. its height
+and the validator set counting its governance votes.
+
+It features the following methods:
+1. NewStateStore
+2. ExecuteTx
+3. Simulate / SimulateOn / ExecuteBlock
+4. ApplyBlock
+5. AppHash
+6. Nonce
+7. Query
+8. VerifyStateProof
+*/
+
+const (
+	TxResultOK            = "OK"
+	TxResultBadNonce      = "BAD_NONCE"
+	TxResultReservedKey   = "RESERVED_KEY"
+	TxResultGovernance    = "GOVERNANCE"
+	TxResultBadGovernance = "BAD_GOVERNANCE"
+	TxResultNotValidator  = "NOT_VALIDATOR"
+	TxResultAdopted       = "GOVERNANCE_ADOPTED"
+
+	noncePrefix = "nonce/"
+)
+
+// BlockEnv is the chain context a block is executed in
+type BlockEnv struct {
+	Height      uint64
+	Validators  *Validators // the set of the block's height
+	EpochLength uint64
+}
+
+type StateStore struct {
+	height   uint64
+	current  *chain_util.SparseMerkleTree
+	versions map[uint64]*chain_util.SparseMerkleTree
+	retain   uint64 // versions kept, 0 keeps them all
+}
+
+// StateProof is the answer of a state query at a given height
+type StateProof struct {
+	Key     string              `json:"key"`
+	Value   string              `json:"value"`
+	Exists  bool                `json:"exists"`
+	Height  uint64              `json:"height"`
+	AppHash []byte              `json:"appHash"`
+	Proof   chain_util.SMTProof `json:"proof"`
+}
+
+// NewStateStore creates an empty state at height 0 (genesis)
+func NewStateStore() *StateStore {
+	genesis := chain_util.NewSparseMerkleTree()
+	return &StateStore{
+		height:   0,
+		current:  genesis,
+		versions: map[uint64]*chain_util.SparseMerkleTree{0: genesis},
+		retain:   STATE_VERSIONS,
+	}
+}
+
+// nonceKey returns the state key holding a sender's last nonce
+func nonceKey(from []byte) []byte {
+	return []byte(noncePrefix + chain_util.BytesToHex(from))
+}
+
+// readNonce reads a sender's last executed nonce from the given tree
+func readNonce(tree *chain_util.SparseMerkleTree, from []byte) uint64 {
+	raw, ok := tree.Get(nonceKey(from))
+	if !ok {
+		return 0
+	}
+	nonce, err := strconv.ParseUint(string(raw), 10, 64)
+	if err != nil {
+		return 0
+	}
+	return nonce
+}
+
+// ExecuteTx applies a tx to the given tree and returns its result, a
+// sender's txs are executed in nonce order without gaps
+func ExecuteTx(tree *chain_util.SparseMerkleTree, tx Transaction) string {
+	if tx.Nonce != readNonce(tree, tx.From)+1 {
+		return TxResultBadNonce
+	}
+	tree.Set(nonceKey(tx.From), []byte(strconv.FormatUint(tx.Nonce, 10)))
+	if strings.HasPrefix(tx.Event.Data, governancePrefix) {
+		if _, _, ok := parseGovernance(tx.Event.Data); !ok {
+			return TxResultBadGovernance
+		}
+		return TxResultGovernance
+	}
+	key, value, found := strings.Cut(tx.Event.Data, "=")
+	if !found || key == "" {
+		key, value = tx.Id, tx.Event.Data
+	}
+	if strings.HasPrefix(key, noncePrefix) || strings.HasPrefix(key, govStatePrefix) {
+		return TxResultReservedKey
+	}
+	tree.Set([]byte(key), []byte(value))
+	return TxResultOK
+}
+
+// ExecuteBlock applies a block's txs to the given tree within the
+// block's env and returns the result of each tx, the pending
+// governance votes are dropped at the first height of each epoch
+func ExecuteBlock(tree *chain_util.SparseMerkleTree, env BlockEnv, txs []Transaction) []string {
+	if env.EpochLength > 0 && env.Height > 0 && (env.Height-1)%env.EpochLength == 0 {
+		tree.Delete([]byte(govPendingKey))
+	}
+	results := make([]string, len(txs))
+	for i, tx := range txs {
+		results[i] = ExecuteTx(tree, tx)
+		if results[i] == TxResultGovernance {
+			results[i] = voteGovernance(tree, env, tx)
+		}
+	}
+	return results
+}
+
+// Simulate executes txs on a copy of the latest state and returns
+// the resulting state root without touching the store
+func (ss *StateStore) Simulate(env BlockEnv, txs []Transaction) []byte {
+	return SimulateOn(ss.current, env, txs).Root()
+}
+
+// SimulateOn executes txs on a copy of the given state and returns the
+// resulting state, it lets blocks chain on blocks not committed yet
+func SimulateOn(base *chain_util.SparseMerkleTree, env BlockEnv, txs []Transaction) *chain_util.SparseMerkleTree {
+	tree := base.Copy()
+	ExecuteBlock(tree, env, txs)
+	return tree
+}
+
+// Latest returns the latest committed state
+func (ss *StateStore) Latest() *chain_util.SparseMerkleTree {
+	return ss.current
+}
+
+// ApplyBlock executes a committed block's txs on top of the latest
+// state, stores the result as the version of the env's height, drops
+// the version that fell out of the kept ones and returns the result of
+// each tx
+func (ss *StateStore) ApplyBlock(env BlockEnv, txs []Transaction) []string {
+	tree := ss.current.Copy()
+	results := ExecuteBlock(tree, env, txs)
+	ss.height = env.Height
+	ss.current = tree
+	ss.versions[env.Height] = tree
+	if ss.retain > 0 && env.Height >= ss.retain {
+		delete(ss.versions, env.Height-ss.retain)
+	}
+	return results
+}
+
+// AppHash returns the latest state root
+func (ss *StateStore) AppHash() []byte {
+	return ss.current.Root()
+}
+
+// Nonce returns a sender's last executed nonce in the latest state
+func (ss *StateStore) Nonce(from []byte) uint64 {
+	return readNonce(ss.current, from)
+}
+
+// Height returns the height of the latest state version
+func (ss *StateStore) Height() uint64 {
+	return ss.height
+}
+
+// Query returns the value of a key at given height, together with a
+// membership or non-membership proof against that height's app hash,
+// it returns false if the height's version is not kept
+func (ss *StateStore) Query(key string, height uint64) (*StateProof, bool) {
+	tree, ok := ss.versions[height]
+	if !ok {
+		return nil, false
+	}
+	proof := tree.Prove([]byte(key))
+	return &StateProof{
+		Key:     key,
+		Value:   string(proof.Value),
+		Exists:  proof.Exists,
+		Height:  height,
+		AppHash: tree.Root(),
+		Proof:   proof,
+	}, true
+}
+
+// VerifyStateProof checks a state query answer against a trusted app hash
+func VerifyStateProof(sp StateProof, appHash []byte) bool {
+	return sp.Key == string(sp.Proof.Key) &&
+		sp.Exists == sp.Proof.Exists &&
+		sp.Value == string(sp.Proof.Value) &&
+		chain_util.VerifySMTProof(appHash, sp.Proof)
+}
@@ -0,0 +1,80 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"testing"
+)
+
+func TestStateStore_ApplyBlock(t *testing.T) {
+	w := NewWallet("test")
+	ss := NewStateStore()
+	txs := []Transaction{*w.CreateTx("color=red"), *w.CreateTx("plain data")}
+	simulated := ss.Simulate(BlockEnv{Height: 1}, txs)
+	if ss.Height() != 0 || chain_util.BytesToHex(simulated) == chain_util.BytesToHex(ss.AppHash()) {
+		t.Errorf("Simulate should not change the state")
+	}
+	results := ss.ApplyBlock(BlockEnv{Height: 1}, txs)
+	if len(results) != 2 || results[0] != TxResultOK {
+		t.Errorf("ApplyBlock should return a result per tx, got %v", results)
+	}
+	if chain_util.BytesToHex(simulated) != chain_util.BytesToHex(ss.AppHash()) {
+		t.Errorf("ApplyBlock should match Simulate")
+	}
+	ss.ApplyBlock(BlockEnv{Height: 2}, []Transaction{*w.CreateTx("color=blue")})
+
+	sp, ok := ss.Query("color", 1)
+	if !ok || !sp.Exists || sp.Value != "red" || !VerifyStateProof(*sp, simulated) {
+		t.Errorf("Query at height 1 failed, %+v", sp)
+	}
+	sp, ok = ss.Query("color", 2)
+	if !ok || sp.Value != "blue" || !VerifyStateProof(*sp, ss.AppHash()) {
+		t.Errorf("Query at height 2 failed, %+v", sp)
+	}
+	sp, ok = ss.Query("color", 0)
+	if !ok || sp.Exists || !VerifyStateProof(*sp, sp.AppHash) {
+		t.Errorf("Query at genesis should prove non-membership, %+v", sp)
+	}
+	if VerifyStateProof(*sp, ss.AppHash()) {
+		t.Errorf("VerifyStateProof should fail against another app hash")
+	}
+	if _, ok = ss.Query("color", 3); ok {
+		t.Errorf("Query should fail for an unknown height")
+	}
+}
+
+func TestStateStore_Versions(t *testing.T) {
+	w := NewWallet("test")
+	ss := NewStateStore()
+	ss.retain = 2
+	for height := range uint64(3) {
+		ss.ApplyBlock(BlockEnv{Height: height + 1}, []Transaction{*w.CreateTx("color=red")})
+	}
+	for height := range uint64(4) {
+		if _, ok := ss.Query("color", height); ok != (height >= 2) {
+			t.Errorf("Query at height %d should be %v with 2 versions kept", height, height >= 2)
+		}
+	}
+}
+
+func TestExecuteTx_Nonce(t *testing.T) {
+	w := NewWallet("test")
+	tree := chain_util.NewSparseMerkleTree()
+	tx1 := w.CreateTx("a=1")
+	tx2 := w.CreateTx("a=2")
+	if ExecuteTx(tree, *tx2) != TxResultBadNonce || readNonce(tree, w.publicKey) != 0 {
+		t.Errorf("ExecuteTx should reject a nonce after a gap")
+	}
+	if ExecuteTx(tree, *tx1) != TxResultOK || ExecuteTx(tree, *tx2) != TxResultOK {
+		t.Errorf("ExecuteTx should accept the next nonces in order")
+	}
+	if ExecuteTx(tree, *tx1) != TxResultBadNonce || ExecuteTx(tree, *tx2) != TxResultBadNonce {
+		t.Errorf("ExecuteTx should reject a replayed or lower nonce")
+	}
+	if value, _ := tree.Get([]byte("a")); string(value) != "2" {
+		t.Errorf("ExecuteTx should not apply rejected txs, got %s", value)
+	}
+	forged := w.CreateTx(string(nonceKey(w.publicKey)) + "=0")
+	if ExecuteTx(tree, *forged) != TxResultReservedKey || readNonce(tree, w.publicKey) != forged.Nonce {
+		t.Errorf("ExecuteTx should not let a tx overwrite a nonce")
+	}
+}
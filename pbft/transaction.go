@@ -4,6 +4,8 @@ import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
 	"encoding/json"
 	"log"
+	"slices"
+	"strconv"
 	"time"
 )
 
@@ -22,12 +24,24 @@ type Event struct {
 /**
 Transaction is created by a wallet, featured with the following methods:
 1. NewTx
-2. VerifyTx
+2. HashTx
+3. TxId
+4. VerifyTx
+
+Each sender numbers its txs with a strictly increasing nonce, which is
+covered by the signature. A tx whose nonce is not greater than the
+sender's last committed nonce is a replay and gets rejected, no matter
+which id it carries. The signature also covers the client-provided
+priority used to order the tx pool. The hash covers the sender too,
+and the id is derived from the hash: replies, proofs and request
+timers keyed by id are therefore bound to what the sender signed.
 */
 
 type Transaction struct {
 	Id        string `json:"id"`
 	From      []byte `json:"from"`
+	Nonce     uint64 `json:"nonce"`
+	Priority  uint64 `json:"priority"`
 	Event     Event  `json:"event"`
 	Hash      []byte `json:"hash"`
 	Signature []byte `json:"signature"`
@@ -84,18 +98,36 @@ func (tx *Transaction) UnmarshalJSON(data []byte) error {
 
 /**
 TransactionPool temporarily stores pool made by different wallets for each node.
+Instead of remembering every committed tx, it only keeps the last
+committed nonce of each sender, which is enough to reject replays.
+The waiting pool is bounded and ordered by priority, see mempool.go.
 It features the following methods:
 1. NewTxPool
-2. TxExists
-3. AddTx2Pool
-4. VerifyTx
-5. CleanPool
+2. NewTxPoolWithConfig
+3. TxExists
+4. CheckTx
+5. AddTx2Pool
+6. VerifyTx
+7. ReconcileBlock
+8. RequeueInProgress
+9. CommittedNonce
+10. ExpireTxs
+11. CutReadyBatch
+12. CutTimedBatch
+13. Metrics
+14. AwaitedTxs
 */
 
 type TransactionPool struct {
-	pool       []Transaction
+	pool       []Transaction // waiting txs, highest priority first
 	inProgress map[string]Transaction
-	committed  map[string]Transaction
+	nonces     map[chain_util.Key]uint64              // sender -> last committed nonce
+	pending    map[chain_util.Key]map[uint64]struct{} // sender -> nonces waiting or in progress
+	waiting    map[chain_util.Key]int                 // sender -> number of waiting txs
+	meta       map[string]poolMeta
+	bytes      int
+	config     MempoolConfig
+	metrics    MempoolMetrics
 }
 
 // NewEvent creates a message with given data and timestamp
@@ -106,19 +138,21 @@ func NewEvent(data string) *Event {
 	}
 }
 
-// NewTx create a tx with a wallet
-func NewTx(w Wallet, data string) *Transaction {
+// NewTx create a tx with a wallet, the sender's next nonce and a priority,
+// it returns nil if the wallet's signer refused to sign it
+func NewTx(w Wallet, data string, nonce uint64, priority uint64) *Transaction {
 	event := NewEvent(data)
-	eventStr, err := json.Marshal(event)
-	if err != nil {
-		log.Fatalf("Tx's event json marshal err, %v\n", err)
+	hash := HashTx(w.publicKey, *event, nonce, priority)
+	signature := w.Sign(SignRequest{Type: MsgTx, From: w.publicKey, Event: event, Nonce: nonce, Priority: priority})
+	if signature == nil {
+		return nil
 	}
-	hash := chain_util.Hash(string(eventStr))
-	signature := w.Sign(hash)
 
 	return &Transaction{
-		Id:        chain_util.Id(),
+		Id:        TxId(hash),
 		From:      w.publicKey,
+		Nonce:     nonce,
+		Priority:  priority,
 		Event:     *event,
 		Hash:      hash,
 		Signature: signature,
@@ -126,100 +160,191 @@ func NewTx(w Wallet, data string) *Transaction {
 	}
 }
 
-// VerifyTx verifies a given tx with tx's msg->hash and hash->signature
-func (tx *Transaction) VerifyTx() bool {
-	eventStr, err := json.Marshal(tx.Event)
+// HashTx returns the hash of a tx's sender, marshalled event, nonce
+// and priority
+func HashTx(from PublicKey, event Event, nonce uint64, priority uint64) []byte {
+	eventStr, err := json.Marshal(event)
 	if err != nil {
 		log.Fatalf("Tx's event json marshal err, %v\n", err)
 	}
-	return tx.MsgType == MsgTx && // verify msgType
-		chain_util.BytesToHex(tx.Hash) == chain_util.BytesToHex(chain_util.Hash(string(eventStr))) && // verify msg->hash
-		chain_util.Verify(tx.From, tx.Hash, tx.Signature) // verify hash->signature
+	return chain_util.Hash(chain_util.BytesToHex(from) + "/" + string(eventStr) + strconv.FormatUint(nonce, 10) + "/" + strconv.FormatUint(priority, 10))
+}
+
+// TxId returns the id of the tx with given hash
+func TxId(hash []byte) string {
+	return chain_util.BytesToHex(hash)
+}
+
+// validTxHash checks the tx's msgType, msg->hash and hash->id
+func (tx *Transaction) validTxHash() bool {
+	return tx.MsgType == MsgTx &&
+		chain_util.Equal(tx.Hash, HashTx(tx.From, tx.Event, tx.Nonce, tx.Priority)) &&
+		tx.Id == TxId(tx.Hash)
+}
+
+// VerifyTx verifies a given tx with tx's msg->hash, hash->id and
+// hash->signature
+func (tx *Transaction) VerifyTx() bool {
+	return tx.validTxHash() && sigVerifier.Verify(tx.From, tx.Hash, tx.Signature)
 }
 
 // NewTxPool creates a tx pool that temporarily stores the pool from
 // all available nodes. Txs in pool will be periodically removed
 // by matching tx's id.
 func NewTxPool() *TransactionPool {
+	return NewTxPoolWithConfig(DefaultMempoolConfig())
+}
+
+// NewTxPoolWithConfig creates a tx pool with given bounds and policies
+func NewTxPoolWithConfig(config MempoolConfig) *TransactionPool {
 	return &TransactionPool{
 		pool:       make([]Transaction, 0, TX_THRESHOLD+1),
 		inProgress: make(map[string]Transaction),
-		committed:  make(map[string]Transaction),
+		nonces:     make(map[chain_util.Key]uint64),
+		pending:    make(map[chain_util.Key]map[uint64]struct{}),
+		waiting:    make(map[chain_util.Key]int),
+		meta:       make(map[string]poolMeta),
+		config:     config,
+		metrics:    MempoolMetrics{Rejected: make(map[string]uint64)},
 	}
 }
 
-// TxExists checks if a tx exists in the pool or not
+// TxExists checks if a tx exists in the pool or not. A tx whose nonce
+// is already committed, or taken by a pending tx of the same sender,
+// counts as existing.
 func (tp *TransactionPool) TxExists(tx Transaction) bool {
-	var ok bool
-	// tx in committed
-	_, ok = tp.committed[tx.Id]
-	if ok {
+	from := chain_util.KeyOf(tx.From)
+	// nonce already committed
+	if tx.Nonce <= tp.nonces[from] {
 		return true
 	}
-	// tx in in-process
-	_, ok = tp.inProgress[tx.Id]
-	if ok {
+	// tx in in-process or in tx pool
+	if _, ok := tp.inProgress[tx.Id]; ok {
 		return true
 	}
-	// tx in tx pool
-	for _, _tx := range tp.pool {
-		if _tx.Id == tx.Id {
-			return true
-		}
+	if _, ok := tp.meta[tx.Id]; ok {
+		return true
 	}
-	return false
+	// nonce taken by a pending tx of the same sender
+	_, ok := tp.pending[from][tx.Nonce]
+	return ok
+}
+
+// CommittedNonce returns the last committed nonce of a sender
+func (tp *TransactionPool) CommittedNonce(from PublicKey) uint64 {
+	return tp.nonces[chain_util.KeyOf(from)]
 }
 
-// AddTx2Pool adds a given tx's address to the pool
-// returns true if it reaches
-func (tp *TransactionPool) AddTx2Pool(tx Transaction) ([]Transaction, bool) {
-	// skip if exists
-	if tp.TxExists(tx) {
-		return nil, false
+// AddTx2Pool adds a given tx's address to the pool, evicting waiting
+// txs if the pool is full and the eviction policy allows it.
+// Only the primary cuts batches from the pool, see CutReadyBatch.
+func (tp *TransactionPool) AddTx2Pool(tx Transaction) bool {
+	now := time.Now()
+	tp.ExpireTxs(now)
+	// skip if it cannot be admitted
+	if reason := tp.CheckTx(tx); reason != "" {
+		tp.reject(tx, reason)
+		return false
 	}
-	tp.pool = append(tp.pool, tx)
-	log.Printf("Tx [%s] added to tx pool\n", chain_util.BytesToHex(tx.Hash)[:6])
-	if len(tp.pool) >= TX_THRESHOLD {
-		// performing deep copy
-		poolCopy := make([]Transaction, len(tp.pool))
-		for i, transaction := range tp.pool {
-			// copy data for return
-			poolCopy[i] = transaction
-			// copy data to "in progress"
-			tp.inProgress[transaction.Id] = transaction
+	size := txSize(tx)
+	for tp.isFull(size) {
+		idx := tp.victim(tx)
+		if idx < 0 {
+			tp.reject(tx, RejectPoolFull)
+			return false
 		}
-		// performing delete pool
-		tp.pool = tp.pool[:0]
-		return poolCopy, true
+		evicted := tp.removeTx(idx)
+		tp.metrics.Evicted++
+		log.Printf("Tx [%s] evicted from tx pool\n", chain_util.BytesToHex(evicted.Hash)[:6])
 	}
-	return nil, true
+	tp.insertTx(tx, now)
+	tp.metrics.Admitted++
+	log.Printf("Tx [%s] added to tx pool\n", chain_util.BytesToHex(tx.Hash)[:6])
+	return true
 }
 
-// VerifyTx checks if a given tx is valid or not
-func (tp *TransactionPool) VerifyTx(tx Transaction) bool {
-	return tx.VerifyTx()
+// CutReadyBatch cuts a batch of the highest priority txs once the
+// waiting txs reach the batch max count or max byte size, it returns
+// nil otherwise
+func (tp *TransactionPool) CutReadyBatch() []Transaction {
+	if !tp.batchReady() {
+		return nil
+	}
+	log.Println("THRESHOLD REACHED!")
+	return tp.cutBatch()
 }
 
-// TransferInProgressToCommitted transfers txs from in-progress to committed
-func (tp *TransactionPool) TransferInProgressToCommitted(txs []Transaction) bool {
-	// check if all txs passed-in exist in "in-progress"
-	for _, tx := range txs {
-		if _, ok := tp.inProgress[tx.Id]; !ok {
-			return false
+// cutBatch moves the highest priority waiting txs to "in progress",
+// up to the batch max count and max byte size, and returns a copy
+// of them. A sender's txs are executed in nonce order without gaps,
+// so only the waiting tx with the nonce following the sender's
+// committed and in-progress ones is eligible, the next one becomes
+// eligible once it is taken. Txs after a gap wait until it is filled.
+// A batch holds at least one tx, it is nil if no tx is eligible.
+func (tp *TransactionPool) cutBatch() []Transaction {
+	// nonces of each sender's in-progress txs
+	inProgress := make(map[chain_util.Key]map[uint64]bool)
+	for _, tx := range tp.inProgress {
+		from := chain_util.KeyOf(tx.From)
+		if inProgress[from] == nil {
+			inProgress[from] = make(map[uint64]bool)
 		}
+		inProgress[from][tx.Nonce] = true
 	}
-	// delete from "in-progress"
-	// then add to "committed"
-	for _, tx := range txs {
-		delete(tp.inProgress, tx.Id)
-		tp.committed[tx.Id] = tx
+	// next executable nonce of each sender
+	expected := make(map[chain_util.Key]uint64, len(tp.waiting))
+	nextNonce := func(from chain_util.Key, nonce uint64) {
+		for inProgress[from][nonce] {
+			nonce++
+		}
+		expected[from] = nonce
 	}
-	return true
+	for from := range tp.waiting {
+		nextNonce(from, tp.nonces[from]+1)
+	}
+	// performing deep copy
+	poolCopy := make([]Transaction, 0, min(tp.config.BatchMaxTxs, len(tp.pool)))
+	size := 0
+	for len(poolCopy) < tp.config.BatchMaxTxs {
+		// the highest priority eligible tx, the pool is in priority order
+		idx := slices.IndexFunc(tp.pool, func(tx Transaction) bool {
+			return tx.Nonce == expected[chain_util.KeyOf(tx.From)]
+		})
+		if idx < 0 {
+			break
+		}
+		next := tp.meta[tp.pool[idx].Id].size
+		if len(poolCopy) > 0 && size+next > tp.config.BatchMaxBytes {
+			break
+		}
+		size += next
+		transaction := tp.removeTx(idx)
+		// copy data for return
+		poolCopy = append(poolCopy, transaction)
+		// copy data to "in progress"
+		tp.inProgress[transaction.Id] = transaction
+		tp.trackPending(transaction)
+		// the sender's next nonce becomes eligible
+		nextNonce(chain_util.KeyOf(transaction.From), transaction.Nonce+1)
+	}
+	if len(poolCopy) == 0 {
+		return nil
+	}
+	return poolCopy
+}
+
+// VerifyTx checks if a given tx is valid or not
+func (tp *TransactionPool) VerifyTx(tx Transaction) bool {
+	return tx.VerifyTx()
 }
 
 // Clear clears all subPools in tx pool
 func (tp *TransactionPool) Clear() {
 	tp.pool = tp.pool[:0]
 	tp.inProgress = make(map[string]Transaction)
-	tp.committed = make(map[string]Transaction)
+	tp.nonces = make(map[chain_util.Key]uint64)
+	tp.pending = make(map[chain_util.Key]map[uint64]struct{})
+	tp.waiting = make(map[chain_util.Key]int)
+	tp.meta = make(map[string]poolMeta)
+	tp.bytes = 0
 }
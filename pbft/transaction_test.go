@@ -36,8 +36,8 @@ func TestNewEvent(t *testing.T) {
 func TestNewTx(t *testing.T) {
 	w := NewWallet("test")
 	data := "test"
-	tx1 := NewTx(*w, data)
-	tx2 := NewTx(*w, data)
+	tx1 := NewTx(*w, data, 1, 0)
+	tx2 := NewTx(*w, data, 2, 0)
 	if tx1 == tx2 {
 		t.Errorf("tx1 and tx2 should be different")
 	}
@@ -52,7 +52,7 @@ func TestNewTx(t *testing.T) {
 	}
 
 	// marshal & unmarshal
-	tx3 := NewTx(*w, data)
+	tx3 := NewTx(*w, data, 3, 0)
 	tx3Str, err := json.Marshal(tx3)
 	if err != nil {
 		t.Error(err)
@@ -64,6 +64,7 @@ func TestNewTx(t *testing.T) {
 	}
 	if tx3.Id != tx4.Id ||
 		chain_util.BytesToHex(tx3.From) != chain_util.BytesToHex(tx4.From) ||
+		tx3.Nonce != tx4.Nonce ||
 		tx3.Event != tx4.Event ||
 		chain_util.BytesToHex(tx3.Hash) != chain_util.BytesToHex(tx4.Hash) ||
 		chain_util.BytesToHex(tx3.Signature) != chain_util.BytesToHex(tx4.Signature) ||
@@ -76,14 +77,36 @@ func TestNewTx(t *testing.T) {
 func TestTransaction_VerifyTx(t *testing.T) {
 	data := "data"
 	w := NewWallet("test")
-	tx := NewTx(*w, data)
+	tx := NewTx(*w, data, 1, 0)
 	if !tx.VerifyTx() {
 		t.Errorf("VerifyTx should be true")
 	}
+	tx.Nonce = 2
+	if tx.VerifyTx() {
+		t.Errorf("VerifyTx should be false for a changed nonce")
+	}
+	tx.Nonce = 1
 	tx.Event.Data = "data2"
 	if tx.VerifyTx() {
 		t.Errorf("VerifyTx should be false")
 	}
+
+	// the id is derived from the signed hash, which covers the sender
+	tx = NewTx(*w, data, 1, 0)
+	replayed := *tx
+	replayed.Id = "chosen"
+	if replayed.VerifyTx() {
+		t.Errorf("VerifyTx should be false for an id not derived from the hash")
+	}
+	other := NewWallet("other")
+	copied := *tx
+	copied.From = other.PublicKey()
+	copied.Hash = HashTx(copied.From, copied.Event, copied.Nonce, copied.Priority)
+	copied.Id = TxId(copied.Hash)
+	copied.Signature = other.Sign(SignRequest{Type: MsgTx, From: copied.From, Event: &copied.Event, Nonce: copied.Nonce, Priority: copied.Priority})
+	if !copied.VerifyTx() || copied.Id == tx.Id {
+		t.Errorf("A tx copied by another sender should get its own id")
+	}
 }
 
 func TestTransactionPool_AddTx2Pool(t *testing.T) {
@@ -91,12 +114,15 @@ func TestTransactionPool_AddTx2Pool(t *testing.T) {
 	w := NewWallet("test")
 	tp := NewTxPool()
 	for i := range TX_THRESHOLD {
-		tx := NewTx(*w, data)
-		poolCopy, _ := tp.AddTx2Pool(*tx)
+		tx := w.CreateTx(data)
+		if !tp.AddTx2Pool(*tx) {
+			t.Errorf("AddTx2Pool should return true")
+		}
+		poolCopy := tp.CutReadyBatch()
 		if i+1 < TX_THRESHOLD && (poolCopy != nil || len(tp.inProgress) != 0) {
-			t.Errorf("AddTx2Pool should return false")
+			t.Errorf("CutReadyBatch should return nil")
 		} else if i+1 >= TX_THRESHOLD && (poolCopy == nil || len(tp.inProgress) == 0) {
-			t.Errorf("AddTx2Pool should return true")
+			t.Errorf("CutReadyBatch should return txs")
 		}
 	}
 }
@@ -104,9 +130,9 @@ func TestTransactionPool_AddTx2Pool(t *testing.T) {
 func TestTransactionPool_TxExists(t *testing.T) {
 	data := "data"
 	w := NewWallet("test")
-	tx1 := NewTx(*w, data)
-	tx2 := NewTx(*w, data)
-	tx3 := NewTx(*w, data)
+	tx1 := w.CreateTx(data)
+	tx2 := w.CreateTx(data)
+	tx3 := w.CreateTx(data)
 	tp := NewTxPool()
 	tp.AddTx2Pool(*tx1)
 	tp.AddTx2Pool(*tx2)
@@ -122,40 +148,65 @@ func TestTransactionPool_TxExists(t *testing.T) {
 	}
 }
 
-func TestTransactionPool_TransferInProgressToCommitted(t *testing.T) {
+func TestTransactionPool_ReconcileBlock(t *testing.T) {
 	data := "data"
 	w := NewWallet("test")
-	tx1 := NewTx(*w, data)
-	tx2 := NewTx(*w, data)
-	tx3 := NewTx(*w, data)
+	tx1 := w.CreateTx(data)
+	tx2 := w.CreateTx(data)
+	tx3 := w.CreateTx(data)
 	tp := NewTxPool()
 	var returnedTxs []Transaction
-	returnedTxs, _ = tp.AddTx2Pool(*tx1)
+	tp.AddTx2Pool(*tx1)
+	returnedTxs = tp.CutReadyBatch()
 	if returnedTxs != nil {
-		t.Errorf("AddTx2Pool should return nil")
+		t.Errorf("CutReadyBatch should return nil")
 	}
-	returnedTxs, _ = tp.AddTx2Pool(*tx2)
+	tp.AddTx2Pool(*tx2)
+	returnedTxs = tp.CutReadyBatch()
 	if returnedTxs != nil {
-		t.Errorf("AddTx2Pool should return nil")
+		t.Errorf("CutReadyBatch should return nil")
 	}
 	if len(tp.inProgress) != 0 {
 		t.Errorf("InProgress should be empty")
 	}
-	if len(tp.committed) != 0 {
-		t.Errorf("Committed should be empty")
+	if len(tp.nonces) != 0 {
+		t.Errorf("Committed nonces should be empty")
 	}
-	returnedTxs, _ = tp.AddTx2Pool(*tx3)
+	tp.AddTx2Pool(*tx3)
+	returnedTxs = tp.CutReadyBatch()
 	if returnedTxs == nil {
-		t.Errorf("AddTx2Pool should return txs")
+		t.Errorf("CutReadyBatch should return txs")
 	}
 	if len(tp.inProgress) == 0 {
 		t.Errorf("InProgress should not be empty")
 	}
-	if len(tp.committed) != 0 {
-		t.Errorf("Committed should be empty")
+	if len(tp.nonces) != 0 {
+		t.Errorf("Committed nonces should be empty")
+	}
+	rec := tp.ReconcileBlock(returnedTxs, nil)
+	if rec.FromInProgress != 3 || len(tp.inProgress) != 0 || tp.CommittedNonce(w.publicKey) != tx3.Nonce {
+		t.Errorf("ReconcileBlock failed")
+	}
+}
+
+func TestTransactionPool_RejectsReplay(t *testing.T) {
+	w := NewWallet("test")
+	tp := NewTxPool()
+	tx1 := w.CreateTx("data")
+	tp.AddTx2Pool(*tx1)
+
+	// same nonce under a fresh id is still a duplicate
+	replay := NewTx(*w, "data", tx1.Nonce, 0)
+	if !tp.TxExists(*replay) {
+		t.Errorf("TxExists should catch a pending nonce reused under a new id")
+	}
+
+	tp.cutBatch()
+	tp.ReconcileBlock([]Transaction{*tx1}, nil)
+	if !tp.TxExists(*replay) {
+		t.Errorf("TxExists should catch a committed nonce reused under a new id")
 	}
-	success := tp.TransferInProgressToCommitted(returnedTxs)
-	if !success || len(tp.inProgress) != 0 || len(tp.committed) == 0 {
-		t.Errorf("TransferInProgressToCommitted failed")
+	if tp.TxExists(*w.CreateTx("data")) {
+		t.Errorf("TxExists should accept the next nonce")
 	}
 }
@@ -2,6 +2,10 @@ package pbft
 
 import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
 	"strconv"
 )
 
@@ -10,7 +14,17 @@ PBFT is a permission required blockchain consensus algorithm.
 Therefore, only nodes in the validator list are considered valid.
 Our validators struct features the following methods:
 1. NewValidators
-2. ValidatorExists
+2. NewValidatorsFromKeys
+3. ValidatorExists
+4. Quorum
+5. MaxFaulty
+6. Hash
+7. NewWeightedValidators
+8. Power / TotalPower / PowerOf
+9. WithPower
+10. MarshalJSON / UnmarshalJSON
+11. QuorumPower / HonestPower
+12. HasQuorum / VotingPower
 
 NOTE:
 The secret to create a key-pair is usually a 128/256-bit seed
@@ -21,8 +35,36 @@ secret should never be revealed publicly, otherwise the security of
 the wallet is compromised.
 */
 
+// ValidatorInfo is the JSON form of a validator
+type ValidatorInfo struct {
+	PublicKey string `json:"publicKey"`
+	Power     uint64 `json:"power"`
+}
+
 type Validators struct {
-	list []PublicKey // use each node/wallet's publicKey as identifier
+	list   []PublicKey            // use each node/wallet's publicKey as identifier
+	powers []uint64               // voting power of each validator, weighs its votes and proposer turns
+	index  map[chain_util.Key]int // public key -> position in the list
+}
+
+// newValidators indexes the given list of public keys, each validator
+// has a voting power of 1
+func newValidators(list []PublicKey) *Validators {
+	powers := make([]uint64, len(list))
+	for i := range powers {
+		powers[i] = 1
+	}
+	return newWeightedValidators(list, powers)
+}
+
+// newWeightedValidators indexes the given list of public keys with
+// their voting powers
+func newWeightedValidators(list []PublicKey, powers []uint64) *Validators {
+	index := make(map[chain_util.Key]int, len(list))
+	for i, pubKey := range list {
+		index[chain_util.KeyOf(pubKey)] = i
+	}
+	return &Validators{list: list, powers: powers, index: index}
 }
 
 // NewValidators creates a slice of given num of validators
@@ -31,15 +73,185 @@ func NewValidators(n int) *Validators {
 	for i := range n {
 		list[i] = NewWallet("NODE-" + strconv.Itoa(i)).publicKey
 	}
-	return &Validators{list}
+	return newValidators(list)
+}
+
+// NewValidatorsFromKeys creates the validator list from known public keys
+func NewValidatorsFromKeys(keys []PublicKey) *Validators {
+	list := make([]PublicKey, len(keys))
+	copy(list, keys)
+	return newValidators(list)
+}
+
+// NewWeightedValidators creates the validator list from known public
+// keys and their voting powers
+func NewWeightedValidators(keys []PublicKey, powers []uint64) *Validators {
+	list := make([]PublicKey, len(keys))
+	copy(list, keys)
+	powersCopy := make([]uint64, len(keys))
+	copy(powersCopy, powers)
+	return newWeightedValidators(list, powersCopy)
 }
 
 // ValidatorExists checks if a node/wallet is within the list
 func (vs *Validators) ValidatorExists(validator PublicKey) bool {
-	for _, pubKey := range vs.list {
-		if chain_util.BytesToHex(pubKey) == chain_util.BytesToHex(validator) {
-			return true
+	_, ok := vs.index[chain_util.KeyOf(validator)]
+	return ok
+}
+
+// Quorum returns the minimum number of distinct validators that is
+// more than 2/3 of the set, i.e. n-f, which is 2f+1 out of n = 3f+1
+func (vs *Validators) Quorum() int {
+	return len(vs.list) - vs.MaxFaulty()
+}
+
+// QuorumPower returns the minimum voting power required to certify a
+// phase, i.e. more than 2/3 of the total power
+func (vs *Validators) QuorumPower() uint64 {
+	return vs.TotalPower()*2/3 + 1
+}
+
+// HonestPower returns the minimum voting power that must include an
+// honest validator, i.e. more than 1/3 of the total power
+func (vs *Validators) HonestPower() uint64 {
+	return vs.TotalPower()/3 + 1
+}
+
+// HasQuorum checks if given voters hold a quorum of the voting power,
+// non-validators and repeated voters are not counted
+func (vs *Validators) HasQuorum(voters []PublicKey) bool {
+	return vs.VotingPower(voters) >= vs.QuorumPower()
+}
+
+// VotingPower returns the summed power of the distinct validators
+// among given voters
+func (vs *Validators) VotingPower(voters []PublicKey) uint64 {
+	seen := make(map[chain_util.Key]struct{}, len(voters))
+	power := uint64(0)
+	for _, voter := range voters {
+		voterKey := chain_util.KeyOf(voter)
+		i, ok := vs.index[voterKey]
+		if _, dup := seen[voterKey]; !ok || dup {
+			continue
 		}
+		seen[voterKey] = struct{}{}
+		power += vs.powers[i]
+	}
+	return power
+}
+
+// MaxFaulty returns the number of faulty validators f tolerated by
+// the set, i.e. n = 3f+1
+func (vs *Validators) MaxFaulty() int {
+	return (len(vs.list) - 1) / 3
+}
+
+// Power returns the voting power of the validator at given index
+func (vs *Validators) Power(i int) uint64 {
+	return vs.powers[i]
+}
+
+// PowerOf returns the voting power of given validator, 0 if it is
+// not in the set
+func (vs *Validators) PowerOf(validator PublicKey) uint64 {
+	i, ok := vs.index[chain_util.KeyOf(validator)]
+	if !ok {
+		return 0
+	}
+	return vs.powers[i]
+}
+
+// TotalPower returns the sum of the validators' voting powers
+func (vs *Validators) TotalPower() uint64 {
+	total := uint64(0)
+	for _, power := range vs.powers {
+		total += power
+	}
+	return total
+}
+
+// Hash returns the hash of the ordered validator list and powers,
+// blocks carry it so that a header commits to the set that certifies it
+func (vs *Validators) Hash() []byte {
+	h := sha256.New()
+	for i, pubKey := range vs.list {
+		h.Write(pubKey)
+		h.Write(binary.BigEndian.AppendUint64(nil, vs.powers[i]))
+	}
+	return h.Sum(nil)
+}
+
+// validPowers checks that voting powers are within MAX_VALIDATOR_POWER
+// each and MAX_TOTAL_POWER in total
+func validPowers(powers []uint64) bool {
+	total := uint64(0)
+	for _, power := range powers {
+		if power > MAX_VALIDATOR_POWER {
+			return false
+		}
+		total += power
+		if total > MAX_TOTAL_POWER {
+			return false
+		}
+	}
+	return true
+}
+
+// WithPower returns a copy of the set where the given validator has
+// given power: a new validator joins at the end of the list and a
+// power of 0 removes it. It returns false if the set would be empty
+// or its powers out of bounds.
+func (vs *Validators) WithPower(validator PublicKey, power uint64) (*Validators, bool) {
+	list := make([]PublicKey, 0, len(vs.list)+1)
+	powers := make([]uint64, 0, len(vs.list)+1)
+	found := false
+	for i, pubKey := range vs.list {
+		if chain_util.Equal(pubKey, validator) {
+			found = true
+			if power == 0 {
+				continue
+			}
+			list, powers = append(list, pubKey), append(powers, power)
+			continue
+		}
+		list, powers = append(list, pubKey), append(powers, vs.powers[i])
+	}
+	if !found && power > 0 {
+		list, powers = append(list, validator), append(powers, power)
+	}
+	if len(list) == 0 || !validPowers(powers) {
+		return nil, false
+	}
+	return newWeightedValidators(list, powers), true
+}
+
+// MarshalJSON encodes the set as a list of hex public keys and powers
+func (vs Validators) MarshalJSON() ([]byte, error) {
+	infos := make([]ValidatorInfo, len(vs.list))
+	for i, pubKey := range vs.list {
+		infos[i] = ValidatorInfo{PublicKey: chain_util.BytesToHex(pubKey), Power: vs.powers[i]}
+	}
+	return json.Marshal(infos)
+}
+
+// UnmarshalJSON decodes a set encoded by MarshalJSON
+func (vs *Validators) UnmarshalJSON(data []byte) error {
+	var infos []ValidatorInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return err
+	}
+	list := make([]PublicKey, len(infos))
+	powers := make([]uint64, len(infos))
+	for i, info := range infos {
+		pubKey, err := chain_util.ParsePublicKey(info.PublicKey)
+		if err != nil {
+			return err
+		}
+		list[i], powers[i] = pubKey, info.Power
+	}
+	if !validPowers(powers) {
+		return fmt.Errorf("validator powers exceed %d each or %d in total", uint64(MAX_VALIDATOR_POWER), uint64(MAX_TOTAL_POWER))
 	}
-	return false
+	*vs = *newWeightedValidators(list, powers)
+	return nil
 }
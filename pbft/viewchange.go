@@ -0,0 +1,407 @@
+package pbft
+
+import (
+	"bytes"
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+A view is the period during which one validator acts as the primary
+(proposer). When backups suspect the primary, e.g. it does not include
+a client request in time, they broadcast VIEW-CHANGE messages for the
+next view. A VIEW-CHANGE carries the sender's committed height, proven
+by the COMMITs of its committed block, and a prepared certificate for
+each block above it the sender prepared: the block and the quorum of
+PREPAREs it got in a view.
+Once a quorum of validators asks for the same view, every node moves
+to it and the primary of the new view broadcasts a NEW-VIEW holding
+those VIEW-CHANGEs. From them, every node selects the same prepared
+blocks, see SelectPrepared: above the highest committed height, the
+block of each height with a certificate from the highest view. These
+blocks are carried into the new view and voted on again, and the new
+primary's proposals chain on them. A block committed by any honest
+node was prepared by a quorum, which intersects the quorum of the
+NEW-VIEW, so it is always carried and never replaced.
+ViewChange features the following methods:
+1. NewViewChange
+2. HashViewChange
+3. VerifyViewChange
+4. NewNewView
+5. HashNewView
+6. VerifyNewView
+7. SelectPrepared
+The blockchain side features the following methods:
+1. ViewChangeFor
+2. SetPrepared
+3. VerifyViewChange
+4. ViewPrimary
+5. VerifyNewView
+6. ApplyNewView
+*/
+
+type ViewChange struct {
+	MsgType    string         `json:"msgType"`
+	View       uint64         `json:"view"`
+	Height     uint64         `json:"height"`     // sender's committed height
+	LastHash   []byte         `json:"lastHash"`   // hash of the block at that height
+	LastCommit []Message      `json:"lastCommit"` // COMMITs of that block, none at genesis
+	Prepared   []PreparedCert `json:"prepared"`   // blocks prepared above that height
+	PublicKey  PublicKey      `json:"publicKey"`
+	Signature  []byte         `json:"signature"`
+}
+
+// PreparedCert proves a block was prepared in a view, i.e. validators
+// holding a quorum of the power sent a PREPARE for it in that view
+type PreparedCert struct {
+	Block    Block     `json:"block"`
+	View     uint64    `json:"view"`
+	Prepares []Message `json:"prepares"`
+}
+
+// NewView is sent by the primary of a view, it justifies the view and
+// the blocks carried into it with a quorum of VIEW-CHANGEs
+type NewView struct {
+	MsgType     string       `json:"msgType"`
+	View        uint64       `json:"view"`
+	ViewChanges []ViewChange `json:"viewChanges"`
+	PublicKey   PublicKey    `json:"publicKey"`
+	Signature   []byte       `json:"signature"`
+}
+
+/**
+ViewChangePool stores the VIEW-CHANGE messages for each view, each
+element of a view's list is sent from a different validator.
+It features the following methods:
+1. NewViewChangePool
+2. ViewChangeExists
+3. AddViewChange2Pool
+4. Count / Voters / ViewChanges
+5. CleanPool
+6. Clear
+*/
+
+type ViewChangePool struct {
+	mapPool map[uint64][]ViewChange
+}
+
+// NewViewChange creates a view change message for given view, from
+// given committed block and prepared blocks
+func NewViewChange(view uint64, height uint64, lastHash []byte, lastCommit []Message,
+	prepared []PreparedCert, publicKey PublicKey, signature []byte) *ViewChange {
+	return &ViewChange{
+		MsgType:    MsgViewChange,
+		View:       view,
+		Height:     height,
+		LastHash:   lastHash,
+		LastCommit: lastCommit,
+		Prepared:   prepared,
+		PublicKey:  publicKey,
+		Signature:  signature,
+	}
+}
+
+// HashViewChange returns the hash signed by a view change, it covers
+// the view, the committed block and the prepared blocks and views.
+// The votes are not covered, they are signed on their own.
+func HashViewChange(vc ViewChange) []byte {
+	var sb strings.Builder
+	sb.WriteString(MsgViewChange + "/" + strconv.FormatUint(vc.View, 10) + "/" +
+		strconv.FormatUint(vc.Height, 10) + "/" + chain_util.BytesToHex(vc.LastHash))
+	for _, cert := range vc.Prepared {
+		sb.WriteString("/" + chain_util.BytesToHex(cert.Block.Hash) + ":" + strconv.FormatUint(cert.View, 10))
+	}
+	return chain_util.Hash(sb.String())
+}
+
+// VerifyViewChange verifies the view change's signature
+func VerifyViewChange(vc ViewChange) bool {
+	return vc.MsgType == MsgViewChange &&
+		sigVerifier.Verify(vc.PublicKey, HashViewChange(vc), vc.Signature)
+}
+
+// NewNewView creates a new view message from given view changes
+func NewNewView(view uint64, vcs []ViewChange, publicKey PublicKey, signature []byte) *NewView {
+	return &NewView{
+		MsgType:     MsgNewView,
+		View:        view,
+		ViewChanges: vcs,
+		PublicKey:   publicKey,
+		Signature:   signature,
+	}
+}
+
+// HashNewView returns the hash signed by a new view, it covers the view
+// and the signatures of the view changes it holds
+func HashNewView(nv NewView) []byte {
+	var sb strings.Builder
+	sb.WriteString(MsgNewView + "/" + strconv.FormatUint(nv.View, 10))
+	for _, vc := range nv.ViewChanges {
+		sb.WriteString("/" + chain_util.BytesToHex(vc.Signature))
+	}
+	return chain_util.Hash(sb.String())
+}
+
+// VerifyNewView verifies the new view's signature
+func VerifyNewView(nv NewView) bool {
+	return nv.MsgType == MsgNewView &&
+		sigVerifier.Verify(nv.PublicKey, HashNewView(nv), nv.Signature)
+}
+
+// SelectPrepared selects the blocks carried into a new view from its
+// view changes. The highest committed height reported is the base,
+// then each following height gets, among the certificates chaining on
+// the block selected below it, the one from the highest view. It
+// returns the base, the hash of its block and the selected certificates
+// in height order.
+func SelectPrepared(vcs []ViewChange) (uint64, []byte, []PreparedCert) {
+	var base uint64
+	var baseHash []byte
+	var certs []PreparedCert
+	for _, vc := range vcs {
+		if baseHash == nil || vc.Height > base {
+			base, baseHash = vc.Height, vc.LastHash
+		}
+		certs = append(certs, vc.Prepared...)
+	}
+	// highest view first, ties broken by hash so that every node
+	// selects the same certificate
+	sort.SliceStable(certs, func(i, j int) bool {
+		if certs[i].View != certs[j].View {
+			return certs[i].View > certs[j].View
+		}
+		return bytes.Compare(certs[i].Block.Hash, certs[j].Block.Hash) < 0
+	})
+	var selected []PreparedCert
+	lastHash := baseHash
+	for height := base + 1; ; height++ {
+		found := false
+		for _, cert := range certs {
+			if cert.Block.Height == height && chain_util.Equal(cert.Block.LastHash, lastHash) {
+				selected = append(selected, cert)
+				lastHash = cert.Block.Hash
+				found = true
+				break
+			}
+		}
+		if !found {
+			return base, baseHash, selected
+		}
+	}
+}
+
+// ViewChangeFor returns this node's unsigned view change for given
+// view, from its committed tip and the prepared blocks in flight
+func (bc *Blockchain) ViewChangeFor(view uint64) ViewChange {
+	tip := bc.chain[len(bc.chain)-1]
+	var prepared []PreparedCert
+	for _, ib := range bc.inflight {
+		if ib.cert != nil {
+			prepared = append(prepared, *ib.cert)
+		}
+	}
+	sort.Slice(prepared, func(i, j int) bool {
+		return prepared[i].Block.Height < prepared[j].Block.Height
+	})
+	return ViewChange{
+		MsgType:    MsgViewChange,
+		View:       view,
+		Height:     bc.Height(),
+		LastHash:   tip.Hash,
+		LastCommit: tip.Commits(),
+		Prepared:   prepared,
+	}
+}
+
+// SetPrepared records the certificate of a block in flight that got
+// given PREPAREs, a certificate from a higher view replaces it. It
+// returns the block's certificate, nil if the block is not in flight.
+func (bc *Blockchain) SetPrepared(hash []byte, view uint64, prepares []Message) *PreparedCert {
+	ib, ok := bc.inflight[chain_util.KeyOf(hash)]
+	if !ok {
+		return nil
+	}
+	if ib.cert != nil && ib.cert.View >= view {
+		return ib.cert
+	}
+	cert := &PreparedCert{Block: ib.block, View: view}
+	for _, msg := range prepares {
+		if msg.View == view {
+			cert.Prepares = append(cert.Prepares, msg)
+		}
+	}
+	ib.cert = cert
+	return cert
+}
+
+// verifyPreparedCert checks the block of a certificate and that
+// validators holding a quorum of the power prepared it in its view
+func (bc *Blockchain) verifyPreparedCert(cert PreparedCert) bool {
+	voters := make([]PublicKey, 0, len(cert.Prepares))
+	for _, msg := range cert.Prepares {
+		if msg.MsgType != MsgPrepare ||
+			!chain_util.Equal(msg.BlockHash, cert.Block.Hash) ||
+			msg.Height != cert.Block.Height ||
+			msg.View != cert.View ||
+			!VerifyMsg(msg) {
+			return false
+		}
+		voters = append(voters, msg.PublicKey)
+	}
+	return cert.Block.View <= cert.View &&
+		VerifyBlock(cert.Block) &&
+		bc.ValidatorsAt(cert.Block.Height).HasQuorum(voters)
+}
+
+// VerifyViewChange verifies a view change: its signature, the COMMITs
+// of its committed block and its prepared certificates
+func (bc *Blockchain) VerifyViewChange(vc ViewChange) bool {
+	if !VerifyViewChange(vc) {
+		return false
+	}
+	if vc.Height == 0 && !chain_util.Equal(vc.LastHash, bc.chain[0].Hash) ||
+		vc.Height > 0 && !VerifyCommitQuorum(vc.LastCommit, vc.LastHash, vc.Height, *bc.ValidatorsAt(vc.Height)) {
+		return false
+	}
+	for _, cert := range vc.Prepared {
+		if cert.Block.Height <= vc.Height || !bc.verifyPreparedCert(cert) {
+			return false
+		}
+	}
+	return true
+}
+
+// ViewPrimary returns the primary of given view, i.e. the proposer of
+// the block after the committed tip in that view
+func (bc *Blockchain) ViewPrimary(view uint64) PublicKey {
+	proposer, _ := bc.proposerFor(bc.chain[len(bc.chain)-1].Hash, view)
+	return proposer
+}
+
+// VerifyNewView verifies a new view for a view not justified yet: its
+// signature by the view's primary and a quorum of valid view changes
+// for the view
+func (bc *Blockchain) VerifyNewView(nv NewView) bool {
+	if nv.View <= bc.justified || nv.View < bc.view ||
+		!VerifyNewView(nv) || !chain_util.Equal(nv.PublicKey, bc.ViewPrimary(nv.View)) {
+		return false
+	}
+	vs := bc.ValidatorsAt(bc.Height() + 1)
+	voters := make([]PublicKey, 0, len(nv.ViewChanges))
+	for _, vc := range nv.ViewChanges {
+		if vc.View != nv.View || !vs.ValidatorExists(vc.PublicKey) || !bc.VerifyViewChange(vc) {
+			return false
+		}
+		voters = append(voters, vc.PublicKey)
+	}
+	return vs.HasQuorum(voters)
+}
+
+// ApplyNewView moves to the view of a verified new view and carries
+// the selected prepared blocks into it: they replace the blocks in
+// flight and keep their certificate. New proposals must chain on the
+// last carried block. It returns the carried blocks above the
+// committed tip, they are voted on again.
+func (bc *Blockchain) ApplyNewView(nv NewView) []Block {
+	base, baseHash, certs := SelectPrepared(nv.ViewChanges)
+	old := bc.inflight
+	bc.view, bc.justified = nv.View, nv.View
+	bc.carried = base + uint64(len(certs))
+	bc.inflight = make(map[chain_util.Key]*inflightBlock)
+	if base > bc.Height() {
+		log.Printf("New view %d starts above height %d, this node is behind", nv.View, base)
+		return nil
+	}
+	if !chain_util.Equal(bc.chain[base].Hash, baseHash) {
+		log.Printf("New view %d committed block at height %d MISMATCHED the chain", nv.View, base)
+		return nil
+	}
+	var carried []Block
+	for _, cert := range certs {
+		hashKey := chain_util.KeyOf(cert.Block.Hash)
+		if cert.Block.Height <= bc.Height() {
+			if !chain_util.Equal(bc.chain[cert.Block.Height].Hash, cert.Block.Hash) {
+				log.Printf("New view %d block at height %d MISMATCHED the chain", nv.View, cert.Block.Height)
+				return carried
+			}
+			continue
+		}
+		parentHeight, parentState, ok := bc.parent(cert.Block.LastHash)
+		if !ok {
+			return carried
+		}
+		ib, ok := old[hashKey]
+		if !ok {
+			ib = &inflightBlock{
+				block:  cert.Block,
+				height: parentHeight + 1,
+				state:  SimulateOn(parentState, bc.envAt(parentHeight+1), cert.Block.Data),
+			}
+		}
+		certCopy := cert
+		ib.cert = &certCopy
+		bc.inflight[hashKey] = ib
+		carried = append(carried, cert.Block)
+	}
+	return carried
+}
+
+// NewViewChangePool creates an empty view change pool
+func NewViewChangePool() *ViewChangePool {
+	return &ViewChangePool{mapPool: make(map[uint64][]ViewChange)}
+}
+
+// ViewChangeExists checks if the sender already asked for the view
+func (vcp *ViewChangePool) ViewChangeExists(vc ViewChange) bool {
+	for _, _vc := range vcp.mapPool[vc.View] {
+		if chain_util.Equal(_vc.PublicKey, vc.PublicKey) {
+			return true
+		}
+	}
+	return false
+}
+
+// AddViewChange2Pool adds a view change to the pool
+func (vcp *ViewChangePool) AddViewChange2Pool(vc ViewChange) bool {
+	if vcp.ViewChangeExists(vc) {
+		return false
+	}
+	vcp.mapPool[vc.View] = append(vcp.mapPool[vc.View], vc)
+	return true
+}
+
+// Count returns the number of validators asking for given view
+func (vcp *ViewChangePool) Count(view uint64) int {
+	return len(vcp.mapPool[view])
+}
+
+// Voters returns the public keys of the validators asking for given view
+func (vcp *ViewChangePool) Voters(view uint64) []PublicKey {
+	voters := make([]PublicKey, len(vcp.mapPool[view]))
+	for i, vc := range vcp.mapPool[view] {
+		voters[i] = vc.PublicKey
+	}
+	return voters
+}
+
+// ViewChanges returns a copy of the view changes for given view
+func (vcp *ViewChangePool) ViewChanges(view uint64) []ViewChange {
+	return append([]ViewChange(nil), vcp.mapPool[view]...)
+}
+
+// CleanPool removes the view changes of views up to given view
+func (vcp *ViewChangePool) CleanPool(view uint64) {
+	for v := range vcp.mapPool {
+		if v <= view {
+			delete(vcp.mapPool, v)
+		}
+	}
+}
+
+// Clear clears the content of view change pool
+func (vcp *ViewChangePool) Clear() {
+	vcp.mapPool = make(map[uint64][]ViewChange)
+}
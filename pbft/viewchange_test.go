@@ -0,0 +1,183 @@
+package pbft
+
+import (
+	"consensus-algorithms-with-golang/pbft/chain_util"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestViewChangePool_AddViewChange2Pool(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	w1, w2 := NewWallet("NODE-0"), NewWallet("NODE-1")
+	vcp := NewViewChangePool()
+	vc := w1.CreateViewChange(bc.ViewChangeFor(1))
+	if !VerifyViewChange(*vc) || !bc.VerifyViewChange(*vc) {
+		t.Errorf("VerifyViewChange should be true")
+	}
+	if !vcp.AddViewChange2Pool(*vc) || vcp.AddViewChange2Pool(*vc) {
+		t.Errorf("AddViewChange2Pool should add a sender once per view")
+	}
+	vcp.AddViewChange2Pool(*w2.CreateViewChange(bc.ViewChangeFor(1)))
+	vcp.AddViewChange2Pool(*w2.CreateViewChange(bc.ViewChangeFor(2)))
+	if vcp.Count(1) != 2 || vcp.Count(2) != 1 || len(vcp.ViewChanges(1)) != 2 {
+		t.Errorf("Count mismatch, got %d and %d", vcp.Count(1), vcp.Count(2))
+	}
+	vcp.CleanPool(1)
+	if vcp.Count(1) != 0 || vcp.Count(2) != 1 {
+		t.Errorf("CleanPool should only drop views up to the given one")
+	}
+
+	// the signature binds the view
+	vc.View = 5
+	if VerifyViewChange(*vc) {
+		t.Errorf("VerifyViewChange should be false for another view")
+	}
+}
+
+// nodeWallet returns the `NODE-{i}` wallet of given public key
+func nodeWallet(pubKey PublicKey) *Wallet {
+	for i := range 2 * NUM_OF_NODES {
+		w := NewWallet("NODE-" + strconv.Itoa(i))
+		if chain_util.Equal(w.publicKey, pubKey) {
+			return w
+		}
+	}
+	panic("wallet not found")
+}
+
+// prepareAll has every validator of the height prepare the block in
+// given view and returns the PREPAREs
+func prepareAll(bc *Blockchain, block Block, view uint64) []Message {
+	var prepares []Message
+	for _, pubKey := range bc.ValidatorsAt(block.Height).list {
+		prepares = append(prepares, *nodeWallet(pubKey).CreateMsg(MsgPrepare, block.Hash, block.Height, view))
+	}
+	return prepares
+}
+
+func TestBlockchain_NewView(t *testing.T) {
+	primary := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	backup := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	primary.depth, backup.depth = 1, 1
+
+	// block 1 is prepared in view 0 by the primary only
+	block := primary.CreateBlock(proposerWallet(primary), []Transaction{*NewWallet("client").CreateTx("k=v")})
+	primary.SetPrepared(block.Hash, 0, prepareAll(primary, *block, 0))
+	if vc := primary.ViewChangeFor(1); len(vc.Prepared) != 1 || !primary.VerifyViewChange(*NewWallet("NODE-0").CreateViewChange(vc)) {
+		t.Fatalf("a view change should carry the prepared block")
+	}
+
+	vcs := make([]ViewChange, 0, NUM_OF_NODES)
+	for i := range NUM_OF_NODES {
+		bc := backup
+		if i == 0 {
+			bc = primary
+		}
+		vcs = append(vcs, *NewWallet("NODE-" + strconv.Itoa(i)).CreateViewChange(bc.ViewChangeFor(1)))
+	}
+	forged := vcs[0]
+	forged.Prepared = []PreparedCert{forged.Prepared[0]}
+	forged.Prepared[0].Prepares = forged.Prepared[0].Prepares[:1]
+	if backup.VerifyViewChange(forged) {
+		t.Errorf("a certificate without a quorum of PREPAREs should be refused")
+	}
+
+	backup.SetView(1)
+	if backup.CanPropose() {
+		t.Errorf("no block should be proposed before the NEW-VIEW")
+	}
+	leader := nodeWallet(backup.ViewPrimary(1))
+	short := leader.CreateNewView(1, vcs[:backup.ValidatorsAt(1).Quorum()-1])
+	if backup.VerifyNewView(*short) {
+		t.Errorf("a NEW-VIEW without a quorum of view changes should be refused")
+	}
+	other := NewWallet("NODE-"+strconv.Itoa(NUM_OF_NODES+1)).CreateNewView(1, vcs)
+	if backup.VerifyNewView(*other) {
+		t.Errorf("a NEW-VIEW should be sent by the primary of its view")
+	}
+	nv := leader.CreateNewView(1, vcs)
+	if !backup.VerifyNewView(*nv) {
+		t.Fatalf("VerifyNewView should be true")
+	}
+	carried := backup.ApplyNewView(*nv)
+	if len(carried) != 1 || !chain_util.Equal(carried[0].Hash, block.Hash) || backup.View() != 1 {
+		t.Fatalf("the prepared block should be carried into the new view")
+	}
+	if backup.VerifyNewView(*nv) {
+		t.Errorf("a NEW-VIEW should be applied once")
+	}
+
+	// the new primary cannot replace the carried block, only chain on it
+	proposer := nodeWallet(backup.ViewPrimary(1))
+	conflicting := proposer.CreateBlock(BlockHeader{
+		ChainID:            backup.chainID,
+		Height:             1,
+		View:               1,
+		Timestamp:          NextBlockTime(Genesis().Timestamp),
+		LastHash:           Genesis().Hash,
+		AppHash:            NewStateStore().Simulate(backup.envAt(1), nil),
+		ValidatorsHash:     backup.epochAt(1).hash,
+		NextValidatorsHash: backup.epochAt(2).hash,
+	}, BlockBody{})
+	if backup.VerifyBlock(*conflicting) {
+		t.Errorf("a block conflicting with a carried one should be refused")
+	}
+	next := backup.CreateBlock(proposerWallet(backup), nil)
+	if next.Height != 2 || !chain_util.Equal(next.LastHash, block.Hash) {
+		t.Errorf("new proposals should chain on the carried block")
+	}
+}
+
+// proposeOn creates a block holding a tx with given data on the
+// chain's head
+func proposeOn(bc *Blockchain, data string) *Block {
+	return bc.CreateBlock(proposerWallet(bc), []Transaction{*NewWallet("client").CreateTx(data)})
+}
+
+func TestSelectPrepared(t *testing.T) {
+	// two forks at height 1, prepared in different views
+	a := proposeOn(NewBlockchain(*NewValidators(NUM_OF_NODES)), "a")
+	b := proposeOn(NewBlockchain(*NewValidators(NUM_OF_NODES)), "b")
+	vcs := []ViewChange{
+		{Height: 0, LastHash: Genesis().Hash, Prepared: []PreparedCert{{Block: *a, View: 0}}},
+		{Height: 0, LastHash: Genesis().Hash, Prepared: []PreparedCert{{Block: *b, View: 2}}},
+		{Height: 0, LastHash: Genesis().Hash},
+	}
+	base, _, certs := SelectPrepared(vcs)
+	if base != 0 || len(certs) != 1 || !chain_util.Equal(certs[0].Block.Hash, b.Hash) {
+		t.Errorf("SelectPrepared should select the certificate of the highest view")
+	}
+}
+
+func TestRequestTimers_Expired(t *testing.T) {
+	w := NewWallet("client")
+	tx1, tx2 := w.CreateTx("a"), w.CreateTx("b")
+	rt := NewRequestTimers(time.Second)
+	now := time.Now()
+	rt.Start(tx1.Id, now)
+	rt.Start(tx2.Id, now)
+	if rt.Expired(now) != 0 {
+		t.Errorf("Expired should be 0 before the timeout")
+	}
+	rt.Stop([]Transaction{*tx1})
+	if rt.Expired(now.Add(2*time.Second)) != 1 {
+		t.Errorf("Expired should only count pending requests")
+	}
+	rt.Restart(now.Add(2 * time.Second))
+	if rt.Expired(now.Add(2*time.Second)) != 0 {
+		t.Errorf("Restart should give pending requests a fresh timeout")
+	}
+}
+
+func TestBlockchain_GetProposer(t *testing.T) {
+	bc := NewBlockchain(*NewValidators(NUM_OF_NODES))
+	proposers := make(map[string]bool)
+	for view := range uint64(NUM_OF_NODES) {
+		bc.SetView(view)
+		proposers[string(bc.GetProposer())] = true
+	}
+	if len(proposers) != NUM_OF_NODES {
+		t.Errorf("each view change should rotate the proposer, got %d proposers", len(proposers))
+	}
+}
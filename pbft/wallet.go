@@ -2,39 +2,61 @@ package pbft
 
 import (
 	"consensus-algorithms-with-golang/pbft/chain_util"
-	"crypto/ed25519"
 	"fmt"
 	"log"
-	"time"
 )
 
 /**
+Wallet signs with its signer, which holds its private key in memory,
+see NewLocalSigner, or in a separate process, see remote_signer.go.
+A signer may refuse to sign, e.g. a vote conflicting with one it
+signed before, then the Create methods return nil and nothing is sent.
 Wallet features the following methods:
 1. NewWallet
-2. PrintWallet
-3. Sign
-4. Verify
-5. CreateTx
-6. CreateBlock
+2. NewSignerWallet
+3. PrintWallet
+4. PublicKey
+5. Signer
+6. Sign
+7. CreateTx
+8. CreatePriorityTx
+9. SetNonce
+10. CreateBlock
+11. CreateReply
+12. CreateViewChange / CreateNewView
+13. CreateMsg / CreateCommit
 */
 
-// set alias
-type PrivateKey = ed25519.PrivateKey
-type PublicKey = ed25519.PublicKey
+// set alias, keys of any signature scheme, see chain_util/crypto.go
+type PrivateKey = chain_util.PrivateKey
+type PublicKey = chain_util.PublicKey
 
-// Wallet contains the private-public keypair
+// Wallet contains the signer of a keypair
 type Wallet struct {
-	privateKey PrivateKey
-	publicKey  PublicKey
+	signer    Signer
+	publicKey PublicKey
+	nonce     uint64 // nonce of the latest tx created by the wallet
 }
 
 // NewWallet creates a new wallet by generating a keypair with given secret
 func NewWallet(secret string) *Wallet {
-	privateKey, publicKey := chain_util.GenKeypair(secret)
-	return &Wallet{
-		privateKey: privateKey,
-		publicKey:  publicKey,
+	privateKey, _ := chain_util.GenKeypair(secret)
+	return NewSignerWallet(NewLocalSigner(privateKey))
+}
+
+// NewSignerWallet creates a wallet signing with given signer
+func NewSignerWallet(signer Signer) *Wallet {
+	return &Wallet{signer: signer, publicKey: signer.PublicKey()}
+}
+
+// privateKey returns the wallet's private key, it returns false if the
+// key is not held by the wallet's process
+func (w *Wallet) privateKey() (PrivateKey, bool) {
+	ls, ok := w.signer.(*LocalSigner)
+	if !ok {
+		return nil, false
 	}
+	return ls.privateKey, true
 }
 
 // PrintWallet prints wallet's publicKey
@@ -42,46 +64,115 @@ func (w *Wallet) PrintWallet() {
 	fmt.Printf("Wallet - public key: %s\n", chain_util.BytesToHex(w.publicKey)[:6])
 }
 
-// Sign uses wallet's privateKey to sign a given hash and returns a signature
-func (w *Wallet) Sign(hash []byte) []byte {
-	signature := chain_util.Sign(w.privateKey, hash)
+// PublicKey returns wallet's publicKey
+func (w *Wallet) PublicKey() PublicKey {
+	return w.publicKey
+}
+
+// Signer returns wallet's signer
+func (w *Wallet) Signer() Signer {
+	return w.signer
+}
+
+// Sign has the wallet's signer sign a request and returns a signature,
+// or nil if the signer refused
+func (w *Wallet) Sign(req SignRequest) []byte {
+	signature, err := w.signer.Sign(req)
+	if err != nil {
+		log.Printf("Sign %s failed, %v\n", req.Type, err)
+		return nil
+	}
 	return signature
 }
 
-// CreateTx creates a tx with given data
+// CreateTx creates a tx with given data and the wallet's next nonce
 func (w *Wallet) CreateTx(data string) *Transaction {
-	return NewTx(*w, data)
+	return w.CreatePriorityTx(data, 0)
+}
+
+// CreatePriorityTx creates a tx with given data and priority
+func (w *Wallet) CreatePriorityTx(data string, priority uint64) *Transaction {
+	tx := NewTx(*w, data, w.nonce+1, priority)
+	if tx == nil {
+		return nil
+	}
+	w.nonce++
+	return tx
 }
 
-// CreateBlock creates a block with lastBlock and provided data
-func (w *Wallet) CreateBlock(lastBlock Block, data []Transaction) *Block {
-	timestamp := time.Now().String()
-	lastHash := lastBlock.Hash
-	nonce := lastBlock.Nonce + 1
-	// hash block with timestamp, lastBlock's hash, marshalled data and current nonce
-	hash := HashBlock(timestamp, lastHash, data, nonce)
+// SetNonce sets the nonce of the latest tx, e.g. to the committed
+// nonce fetched from a node when the wallet is restored
+func (w *Wallet) SetNonce(nonce uint64) {
+	w.nonce = nonce
+}
+
+// CreateBlock completes the given header with the tx root and last
+// commit hash of provided body and the wallet as proposer, then hashes
+// and signs the header
+func (w *Wallet) CreateBlock(header BlockHeader, body BlockBody) *Block {
+	header.TxRoot = TxRoot(body.Data)
+	header.LastCommitHash = HashCommits(body.LastCommit)
+	header.Proposer = w.publicKey
+	// hash every header field but the hash and the signature
+	header.Hash = HashBlock(header)
 	// sign the hash
-	signature := w.Sign(hash)
-	block := NewBlock(
-		timestamp,
-		lastHash,
-		hash,
-		data,
-		w.publicKey,
-		signature,
-		nonce,
-		nil, nil, nil, nil,
-	)
+	header.Signature = w.Sign(SignRequest{Type: MsgPrePrepare, Header: &header})
+	if header.Signature == nil {
+		return nil
+	}
+	block := NewBlock(header, body)
 	log.Printf("Created block [%s]\n", chain_util.BytesToHex(block.Hash)[:6])
 	return block
 }
 
+// CreateReply creates a signed reply with the execution outcome of a tx
+func (w *Wallet) CreateReply(txId string, height uint64, result string) *Reply {
+	signature := w.Sign(SignRequest{Type: MsgReply, TxId: txId, Height: height, Result: result})
+	if signature == nil {
+		return nil
+	}
+	return NewReply(txId, height, result, w.publicKey, signature)
+}
+
+// CreateViewChange signs the given view change, see
+// Blockchain.ViewChangeFor
+func (w *Wallet) CreateViewChange(vc ViewChange) *ViewChange {
+	signature := w.Sign(SignRequest{Type: MsgViewChange, ViewChange: &vc})
+	if signature == nil {
+		return nil
+	}
+	return NewViewChange(vc.View, vc.Height, vc.LastHash, vc.LastCommit, vc.Prepared, w.publicKey, signature)
+}
+
+// CreateNewView creates a new view message for given view, justified
+// by given view changes
+func (w *Wallet) CreateNewView(view uint64, vcs []ViewChange) *NewView {
+	nv := NewNewView(view, vcs, w.publicKey, nil)
+	nv.Signature = w.Sign(SignRequest{Type: MsgNewView, NewView: nv})
+	if nv.Signature == nil {
+		return nil
+	}
+	return nv
+}
+
 // CreateMsg creates a message for PBFT phase transition
-func (w *Wallet) CreateMsg(msgType string, blockHash []byte) *Message {
-	return NewMsg(
-		msgType,
-		blockHash,
-		w.publicKey,
-		w.Sign(blockHash),
-	)
+func (w *Wallet) CreateMsg(msgType string, blockHash []byte, height uint64, view uint64) *Message {
+	signature := w.Sign(SignRequest{Type: msgType, BlockHash: blockHash, Height: height, View: view})
+	if signature == nil {
+		return nil
+	}
+	return NewMsg(msgType, blockHash, height, view, w.publicKey, signature)
+}
+
+// CreateCommit creates a COMMIT for a block justified by its prepared
+// certificate, see GuardedSigner
+func (w *Wallet) CreateCommit(cert *PreparedCert, height uint64, view uint64) *Message {
+	if cert == nil {
+		return nil
+	}
+	signature := w.Sign(SignRequest{Type: MsgCommit, BlockHash: cert.Block.Hash, Height: height, View: view, Justification: cert})
+	if signature == nil {
+		return nil
+	}
+	return NewMsg(MsgCommit, cert.Block.Hash, height, view, w.publicKey, signature)
 }
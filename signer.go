@@ -0,0 +1,57 @@
+package main
+
+import (
+	"consensus-algorithms-with-golang/pbft"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// signerCmd runs a remote signer holding the node's key, the node
+// connects to its socket with -SIGNER. The votes it signs are recorded
+// in the state file, which must be kept across restarts.
+func signerCmd(args []string) {
+	fs := flag.NewFlagSet("signer", flag.ExitOnError)
+	SOCKET := fs.String("SOCKET", "signer.sock", "Unix socket to listen on")
+	STATE := fs.String("STATE", "signer_state.json", "State file of the signed votes")
+	KEYSTORE := fs.String("KEYSTORE", "", "Encrypted keystore of the key")
+	PASSPHRASE_FILE := fs.String("PASSPHRASE_FILE", "", "File holding the keystore passphrase, else "+pbft.KEYSTORE_PASSPHRASE_ENV+" or a prompt")
+	KEY_FILE := fs.String("KEY_FILE", "", "Plain key file of the key")
+	fs.Parse(args)
+
+	wallet := loadWallet(*KEYSTORE, *PASSPHRASE_FILE, *KEY_FILE, "", false)
+	signer, err := pbft.NewGuardedSigner(wallet.Signer(), *STATE)
+	if err != nil {
+		log.Fatalf("Load signer state failed, %v\n", err)
+	}
+
+	// two signers sharing a key but not their state could equivocate
+	if conn, err := net.Dial("unix", *SOCKET); err == nil {
+		conn.Close()
+		log.Fatalf("A signer already listens on %s\n", *SOCKET)
+	}
+	os.Remove(*SOCKET)
+	// the socket is created owner-only, there is no window in which
+	// another user could connect before it is restricted
+	umask := syscall.Umask(0177)
+	listener, err := net.Listen("unix", *SOCKET)
+	syscall.Umask(umask)
+	if err != nil {
+		log.Fatalf("Listen on %s failed, %v\n", *SOCKET, err)
+	}
+	wallet.PrintWallet()
+	log.Printf("Signer listening on %s\n", *SOCKET)
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down...")
+		listener.Close()
+	}()
+	err = pbft.ServeSigner(listener, signer)
+	log.Printf("Signer stopped, %v\n", err)
+}